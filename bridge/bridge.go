@@ -14,10 +14,12 @@ import (
 	"sync"
 	"time"
 
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/crypt"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/metrics"
 	"ehang.io/nps/lib/version"
 	"ehang.io/nps/server/connection"
 	"ehang.io/nps/server/tool"
@@ -28,14 +30,14 @@ import (
 var ServerTlsEnable bool = false
 
 type Client struct {
-	tunnel    *nps_mux.Mux
+	tunnel    conn.Tunnel
 	signal    *conn.Conn
-	file      *nps_mux.Mux
+	file      conn.Tunnel
 	Version   string
 	retryTime int // it will be add 1 when ping not ok until to 3 will close the client
 }
 
-func NewClient(t, f *nps_mux.Mux, s *conn.Conn, vs string) *Client {
+func NewClient(t, f conn.Tunnel, s *conn.Conn, vs string) *Client {
 	return &Client{
 		signal:  s,
 		tunnel:  t,
@@ -48,7 +50,7 @@ type Bridge struct {
 	TunnelPort     int //通信隧道端口
 	Client         sync.Map
 	Register       sync.Map
-	tunnelType     string //bridge type kcp or tcp
+	tunnelType     string //bridge type kcp, quic or tcp
 	OpenTask       chan *file.Tunnel
 	CloseTask      chan *file.Tunnel
 	CloseClient    chan int
@@ -79,6 +81,12 @@ func (s *Bridge) StartTunnel() error {
 		return conn.NewKcpListenerAndProcess(beego.AppConfig.String("bridge_ip")+":"+beego.AppConfig.String("bridge_port"), func(c net.Conn) {
 			s.cliProcess(conn.NewConn(c))
 		})
+	} else if s.tunnelType == "quic" {
+		logs.Info("server start, the bridge type is %s, the bridge port is %d", s.tunnelType, s.TunnelPort)
+		return conn.NewQuicListenerAndProcess(beego.AppConfig.String("bridge_ip")+":"+beego.AppConfig.String("bridge_port"),
+			&tls.Config{Certificates: []tls.Certificate{crypt.GetCert()}}, func(c net.Conn) {
+				s.cliProcess(conn.NewConn(c))
+			})
 	} else {
 
 		go func() {
@@ -124,54 +132,38 @@ func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 			file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 				v := value.(*file.Tunnel)
 				if v.Client.Id == id && v.Mode == "tcp" && strings.Contains(v.Target.TargetStr, info) {
-					v.Lock()
-					if v.Target.TargetArr == nil || (len(v.Target.TargetArr) == 0 && len(v.HealthRemoveArr) == 0) {
-						v.Target.TargetArr = common.TrimArr(strings.Split(v.Target.TargetStr, "\n"))
-					}
-					v.Target.TargetArr = common.RemoveArrVal(v.Target.TargetArr, info)
-					if v.HealthRemoveArr == nil {
-						v.HealthRemoveArr = make([]string, 0)
+					v.Target.HealthDown(info)
+					if !common.IsArrContains(v.HealthRemoveArr, info) {
+						v.HealthRemoveArr = append(v.HealthRemoveArr, info)
 					}
-					v.HealthRemoveArr = append(v.HealthRemoveArr, info)
-					v.Unlock()
 				}
 				return true
 			})
 			file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
 				v := value.(*file.Host)
 				if v.Client.Id == id && strings.Contains(v.Target.TargetStr, info) {
-					v.Lock()
-					if v.Target.TargetArr == nil || (len(v.Target.TargetArr) == 0 && len(v.HealthRemoveArr) == 0) {
-						v.Target.TargetArr = common.TrimArr(strings.Split(v.Target.TargetStr, "\n"))
+					v.Target.HealthDown(info)
+					if !common.IsArrContains(v.HealthRemoveArr, info) {
+						v.HealthRemoveArr = append(v.HealthRemoveArr, info)
 					}
-					v.Target.TargetArr = common.RemoveArrVal(v.Target.TargetArr, info)
-					if v.HealthRemoveArr == nil {
-						v.HealthRemoveArr = make([]string, 0)
-					}
-					v.HealthRemoveArr = append(v.HealthRemoveArr, info)
-					v.Unlock()
 				}
 				return true
 			})
 		} else { //the status is false,remove target from the targetArr
 			file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 				v := value.(*file.Tunnel)
-				if v.Client.Id == id && v.Mode == "tcp" && common.IsArrContains(v.HealthRemoveArr, info) && !common.IsArrContains(v.Target.TargetArr, info) {
-					v.Lock()
-					v.Target.TargetArr = append(v.Target.TargetArr, info)
+				if v.Client.Id == id && v.Mode == "tcp" && common.IsArrContains(v.HealthRemoveArr, info) {
+					v.Target.HealthUp(info)
 					v.HealthRemoveArr = common.RemoveArrVal(v.HealthRemoveArr, info)
-					v.Unlock()
 				}
 				return true
 			})
 
 			file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
 				v := value.(*file.Host)
-				if v.Client.Id == id && common.IsArrContains(v.HealthRemoveArr, info) && !common.IsArrContains(v.Target.TargetArr, info) {
-					v.Lock()
-					v.Target.TargetArr = append(v.Target.TargetArr, info)
+				if v.Client.Id == id && common.IsArrContains(v.HealthRemoveArr, info) {
+					v.Target.HealthUp(info)
 					v.HealthRemoveArr = common.RemoveArrVal(v.HealthRemoveArr, info)
-					v.Unlock()
 				}
 				return true
 			})
@@ -222,6 +214,7 @@ func (s *Bridge) cliProcess(c *conn.Conn) {
 	id, err := file.GetDb().GetIdByVerifyKey(string(buf), c.Conn.RemoteAddr().String())
 	if err != nil {
 		logs.Info("Current client connection validation error, close this client:", c.Conn.RemoteAddr())
+		ban.Fail(c.Conn.RemoteAddr().String(), ban.ReasonVkey)
 		s.verifyError(c)
 		return
 	} else {
@@ -276,7 +269,7 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 		go s.GetHealthFromClient(id, c)
 		logs.Info("clientId %d connection succeeded, address:%s ", id, c.Conn.RemoteAddr())
 	case common.WORK_CHAN:
-		muxConn := nps_mux.NewMux(c.Conn, s.tunnelType, s.disconnectTime)
+		muxConn := conn.NewTunnel(c.Conn, s.tunnelType, s.disconnectTime)
 		if v, ok := s.Client.LoadOrStore(id, NewClient(muxConn, nil, nil, vs)); ok {
 			v.(*Client).tunnel = muxConn
 		}
@@ -297,7 +290,7 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 			logs.Error("secret error, failed to match the key successfully")
 		}
 	case common.WORK_FILE:
-		muxConn := nps_mux.NewMux(c.Conn, s.tunnelType, s.disconnectTime)
+		muxConn := conn.NewTunnel(c.Conn, s.tunnelType, s.disconnectTime)
 		if v, ok := s.Client.LoadOrStore(id, NewClient(nil, muxConn, nil, vs)); ok {
 			v.(*Client).file = muxConn
 		}
@@ -337,10 +330,46 @@ func (s *Bridge) register(c *conn.Conn) {
 	}
 }
 
+// getDialResult 等待客户端回复连接目标的结果，连接失败时关闭 target
+func (s *Bridge) getDialResult(target net.Conn, link *conn.Link) error {
+	target.SetReadDeadline(time.Now().Add(link.Option.Timeout + 5*time.Second))
+	reason, err := conn.NewConn(target).GetDialResult()
+	target.SetReadDeadline(time.Time{})
+	if err == nil && reason != "" {
+		err = &TargetError{Target: link.Host, Err: errors.New(reason)}
+	}
+	if err != nil {
+		target.Close()
+	}
+	return err
+}
+
+// TargetError 表示目标拒绝连接，客户端不在线等其他错误不是目标的问题
+type TargetError struct {
+	Target string
+	Err    error
+}
+
+func (e *TargetError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
+
 func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (target net.Conn, err error) {
+	defer func() {
+		metrics.Dial(metrics.Client, clientId, err)
+		if t != nil && t.Mode != "httpHostServer" {
+			metrics.Dial(metrics.Tunnel, t.Id, err)
+		}
+	}()
 	//if the proxy type is local
 	if link.LocalProxy {
-		target, err = net.Dial("tcp", link.Host)
+		if target, err = net.Dial("tcp", link.Host); err != nil {
+			err = &TargetError{Target: link.Host, Err: err}
+		}
 		return
 	}
 	if v, ok := s.Client.Load(clientId); ok {
@@ -355,7 +384,7 @@ func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (ta
 				}
 			}
 		}
-		var tunnel *nps_mux.Mux
+		var tunnel conn.Tunnel
 		if t != nil && t.Mode == "file" {
 			tunnel = v.(*Client).file
 		} else {
@@ -374,16 +403,41 @@ func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (ta
 			link.Compress = false
 			return
 		}
+		// 新版本的客户端会回复连接目标的结果，目标拒绝连接时可以换其他目标重试
+		link.DialReport = (link.ConnType == common.CONN_TCP || link.ConnType == "http") && version.AtLeast(v.(*Client).Version, version.DialReportVersion)
 		if _, err = conn.NewConn(target).SendInfo(link, ""); err != nil {
 			logs.Info("new connect error ,the target %s refuse to connect", link.Host)
 			return
 		}
+		if link.DialReport {
+			if err = s.getDialResult(target, link); err != nil {
+				target = nil
+			}
+		}
 	} else {
 		err = errors.New(fmt.Sprintf("the client %d is not connect", clientId))
 	}
 	return
 }
 
+// MuxStats 返回在线客户端的多路复用统计
+func (s *Bridge) MuxStats(clientId int) (tunnel, file *nps_mux.Stats, ok bool) {
+	v, ok := s.Client.Load(clientId)
+	if !ok {
+		return
+	}
+	c := v.(*Client)
+	if c.tunnel != nil {
+		st := c.tunnel.Stats()
+		tunnel = &st
+	}
+	if c.file != nil {
+		st := c.file.Stats()
+		file = &st
+	}
+	return
+}
+
 func (s *Bridge) ping() {
 	ticker := time.NewTicker(time.Second * 5)
 	defer ticker.Stop()
@@ -400,7 +454,7 @@ func (s *Bridge) ping() {
 					}
 					return true
 				}
-				if v.tunnel.IsClose {
+				if v.tunnel.IsClosed() {
 					arr = append(arr, key.(int))
 				}
 				return true
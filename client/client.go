@@ -26,7 +26,7 @@ type TRPClient struct {
 	proxyUrl       string
 	vKey           string
 	p2pAddr        map[string]string
-	tunnel         *nps_mux.Mux
+	tunnel         conn.Tunnel
 	signal         *conn.Conn
 	ticker         *time.Ticker
 	cnf            *config.Config
@@ -62,15 +62,17 @@ retry:
 	c, err := NewConn(s.bridgeConnType, s.vKey, s.svrAddr, common.WORK_MAIN, s.proxyUrl)
 	if err != nil {
 		logs.Error("The connection server failed and will be reconnected in five seconds, error", err.Error())
+		NextServer(s.svrAddr)
 		time.Sleep(time.Second * 5)
 		goto retry
 	}
 	if c == nil {
 		logs.Error("Error data from server, and will be reconnected in five seconds")
+		NextServer(s.svrAddr)
 		time.Sleep(time.Second * 5)
 		goto retry
 	}
-	logs.Info("Successful connection with server %s", s.svrAddr)
+	logs.Info("Successful connection with server %s", CurrentServer(s.svrAddr))
 	//monitor the connection
 	go s.ping()
 	s.signal = c
@@ -91,6 +93,8 @@ func (s *TRPClient) handleMain() {
 		flags, err := s.signal.ReadFlag()
 		if err != nil {
 			logs.Error("Accept server data error %s, end this service", err.Error())
+			// the signal connection is lost, try the next server when reconnecting
+			NextServer(s.svrAddr)
 			break
 		}
 		switch flags {
@@ -159,7 +163,7 @@ func (s *TRPClient) newChan() {
 		logs.Error("connect to ", s.svrAddr, "error:", err)
 		return
 	}
-	s.tunnel = nps_mux.NewMux(tunnel.Conn, s.bridgeConnType, s.disconnectTime)
+	s.tunnel = conn.NewTunnel(tunnel.Conn, s.bridgeConnType, s.disconnectTime)
 	for {
 		src, err := s.tunnel.Accept()
 		if err != nil {
@@ -182,7 +186,11 @@ func (s *TRPClient) handleChan(src net.Conn) {
 	lk.Host = common.FormatAddress(lk.Host)
 	//if Conn type is http, read the request and log
 	if lk.ConnType == "http" {
-		if targetConn, err := net.DialTimeout(common.CONN_TCP, lk.Host, lk.Option.Timeout); err != nil {
+		targetConn, err := net.DialTimeout(common.CONN_TCP, lk.Host, lk.Option.Timeout)
+		if lk.DialReport {
+			conn.NewConn(src).SendDialResult(err)
+		}
+		if err != nil {
 			logs.Warn("connect to %s error %s", lk.Host, err.Error())
 			src.Close()
 		} else {
@@ -214,7 +222,11 @@ func (s *TRPClient) handleChan(src net.Conn) {
 		s.handleUdp(src)
 	}
 	//connect to target if conn type is tcp or udp
-	if targetConn, err := net.DialTimeout(lk.ConnType, lk.Host, lk.Option.Timeout); err != nil {
+	targetConn, err := net.DialTimeout(lk.ConnType, lk.Host, lk.Option.Timeout)
+	if lk.DialReport {
+		conn.NewConn(src).SendDialResult(err)
+	}
+	if err != nil {
 		logs.Warn("connect to %s error %s", lk.Host, err.Error())
 		src.Close()
 	} else {
@@ -289,7 +301,7 @@ loop:
 	for {
 		select {
 		case <-s.ticker.C:
-			if s.tunnel != nil && s.tunnel.IsClose {
+			if s.tunnel != nil && s.tunnel.IsClosed() {
 				s.Close()
 				break loop
 			}
@@ -26,6 +26,7 @@ import (
 	"ehang.io/nps/lib/crypt"
 	"ehang.io/nps/lib/version"
 	"github.com/astaxie/beego/logs"
+	"github.com/quic-go/quic-go"
 	"github.com/xtaci/kcp-go"
 	"golang.org/x/net/proxy"
 )
@@ -122,6 +123,7 @@ re:
 	c, err := NewConn(cnf.CommonConfig.Tp, cnf.CommonConfig.VKey, cnf.CommonConfig.Server, common.WORK_CONFIG, cnf.CommonConfig.ProxyUrl)
 	if err != nil {
 		logs.Error(err)
+		NextServer(cnf.CommonConfig.Server)
 		goto re
 	}
 	var isPub bool
@@ -195,9 +197,18 @@ re:
 
 // Create a new connection with the server and verify it
 func NewConn(tp string, vkey string, server string, connType string, proxyUrl string) (*conn.Conn, error) {
-	var err error
+	c, err := newConn(tp, vkey, server, connType, proxyUrl)
+	if tp == "quic" && errors.Is(err, quic.Err0RTTRejected) {
+		// 服务端重启后旧的会话票据失效，0-RTT 被拒绝时重新握手
+		return newConn(tp, vkey, server, connType, proxyUrl)
+	}
+	return c, err
+}
+
+func newConn(tp string, vkey string, server string, connType string, proxyUrl string) (c *conn.Conn, err error) {
 	var connection net.Conn
 	var sess *kcp.UDPSession
+	server = CurrentServer(server)
 	if tp == "tcp" {
 		if proxyUrl != "" {
 			u, er := url.Parse(proxyUrl)
@@ -242,6 +253,8 @@ func NewConn(tp string, vkey string, server string, connType string, proxyUrl st
 			//_, err = header.WriteTo(connection)
 			//_, err = io.WriteString(connection, "HELO")
 		}
+	} else if tp == "quic" {
+		connection, err = conn.DialQuic(server)
 	} else {
 		sess, err = kcp.DialWithOptions(server, nil, 10, 3)
 		if err == nil {
@@ -252,9 +265,14 @@ func NewConn(tp string, vkey string, server string, connType string, proxyUrl st
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			connection.Close()
+		}
+	}()
 	connection.SetDeadline(time.Now().Add(time.Second * 10))
 	defer connection.SetDeadline(time.Time{})
-	c := conn.NewConn(connection)
+	c = conn.NewConn(connection)
 	if _, err := c.Write([]byte(common.CONN_TEST)); err != nil {
 		return nil, err
 	}
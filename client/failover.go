@@ -0,0 +1,53 @@
+package client
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// server_addr 可以配置多个以逗号分隔的服务端地址，连接失败或断开后依次切换
+var serverLists sync.Map
+
+type serverList struct {
+	addrs []string
+	index int
+	sync.Mutex
+}
+
+func getServerList(server string) *serverList {
+	if v, ok := serverLists.Load(server); ok {
+		return v.(*serverList)
+	}
+	l := &serverList{addrs: strings.Split(server, ",")}
+	for i := range l.addrs {
+		l.addrs[i] = strings.TrimSpace(l.addrs[i])
+	}
+	v, _ := serverLists.LoadOrStore(server, l)
+	return v.(*serverList)
+}
+
+// CurrentServer 返回当前使用的服务端地址
+func CurrentServer(server string) string {
+	if !strings.Contains(server, ",") {
+		return server
+	}
+	l := getServerList(server)
+	l.Lock()
+	defer l.Unlock()
+	return l.addrs[l.index]
+}
+
+// NextServer 切换到下一个服务端地址
+func NextServer(server string) string {
+	if !strings.Contains(server, ",") {
+		return server
+	}
+	l := getServerList(server)
+	l.Lock()
+	defer l.Unlock()
+	l.index = (l.index + 1) % len(l.addrs)
+	logs.Info("switch to server %s", l.addrs[l.index])
+	return l.addrs[l.index]
+}
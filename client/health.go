@@ -1,7 +1,11 @@
 package client
 
 import (
+	"bytes"
 	"container/heap"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
@@ -12,6 +16,7 @@ import (
 	"ehang.io/nps/lib/sheap"
 	"github.com/astaxie/beego/logs"
 	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
 )
 
 var isStart bool
@@ -76,6 +81,8 @@ func check(t *file.Health) {
 			if err == nil {
 				c.Close()
 			}
+		} else if t.HealthCheckType == "grpc" {
+			err = grpcHealthCheck(v, t.HealthGrpcService, time.Duration(t.HealthCheckTimeout)*time.Second)
 		} else {
 			client := &http.Client{}
 			client.Timeout = time.Duration(t.HealthCheckTimeout) * time.Second
@@ -100,3 +107,50 @@ func check(t *file.Health) {
 		t.Unlock()
 	}
 }
+
+// grpcHealthCheck 通过 h2c 调用目标的 grpc.health.v1.Health/Check，返回 SERVING 时才算健康
+func grpcHealthCheck(addr, service string, timeout time.Duration) error {
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, timeout)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	// HealthCheckRequest 只有 service 一个字段
+	var msg []byte
+	if service != "" {
+		msg = append([]byte{0x0a}, binary.AppendUvarint(nil, uint64(len(service)))...)
+		msg = append(msg, service...)
+	}
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	req, err := http.NewRequest("POST", "http://"+addr+"/grpc.health.v1.Health/Check", bytes.NewReader(append(body, msg...)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	client := &http.Client{Transport: tr, Timeout: timeout}
+	rs, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rs.Body.Close()
+	b, err := ioutil.ReadAll(rs.Body)
+	if err != nil {
+		return err
+	}
+	status := rs.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = rs.Header.Get("Grpc-Status")
+	}
+	if rs.StatusCode != http.StatusOK || status != "0" {
+		return errors.New("grpc status is " + status)
+	}
+	// HealthCheckResponse 的 status 字段，1 为 SERVING
+	if len(b) < 5 || !bytes.Equal(b[5:], []byte{0x08, 0x01}) {
+		return errors.New("grpc service is not serving")
+	}
+	return nil
+}
@@ -11,15 +11,21 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/geoip"
 	"ehang.io/nps/lib/install"
 	"ehang.io/nps/lib/version"
 	"ehang.io/nps/server"
 	"ehang.io/nps/server/connection"
+	"ehang.io/nps/server/proxy"
 	"ehang.io/nps/server/tool"
 	"ehang.io/nps/web/routers"
 
+	"ehang.io/nps/lib/accesslog"
+	"ehang.io/nps/lib/audit"
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/crypt"
 	"github.com/astaxie/beego"
@@ -195,6 +201,8 @@ func (p *nps) Start(s service.Service) error {
 func (p *nps) Stop(s service.Service) error {
 	_, _ = s.Status()
 	close(p.exit)
+	file.GetDb().JsonDb.Flush()
+	server.ReleaseCluster()
 	if service.Interactive() {
 		os.Exit(0)
 	}
@@ -232,6 +240,43 @@ func run() {
 	logs.Info("the config path is:" + common.GetRunPath())
 	logs.Info("the version of server is %s ,allow client core version to be %s,tls enable is %t", version.VERSION, version.GetVersion(), bridge.ServerTlsEnable)
 	connection.InitConnectionService()
+	if err := accesslog.Init(beego.AppConfig.String("access_log_path"), strings.Split(beego.AppConfig.String("access_log_fields"), ","),
+		int64(beego.AppConfig.DefaultInt("access_log_max_size", 100))<<20, beego.AppConfig.DefaultInt("access_log_max_files", 7)); err != nil {
+		logs.Error("open access log error %s", err)
+	}
+	auditPath := beego.AppConfig.DefaultString("audit_log_path", filepath.Join("conf", "audit.log"))
+	if !filepath.IsAbs(auditPath) {
+		auditPath = filepath.Join(common.GetRunPath(), auditPath)
+	}
+	if err := audit.Init(auditPath); err != nil {
+		logs.Error("open audit log error %s", err)
+	}
+	file.OutlierMaxFails = beego.AppConfig.DefaultInt("outlier_max_fails", 5)
+	file.OutlierEjectTime = time.Duration(beego.AppConfig.DefaultInt("outlier_eject_time", 30)) * time.Second
+	file.OutlierMaxEjectTime = time.Duration(beego.AppConfig.DefaultInt("outlier_max_eject_time", 300)) * time.Second
+	// 相对路径以运行目录为准
+	geoPath := func(key string) string {
+		p := beego.AppConfig.String(key)
+		if p != "" && !filepath.IsAbs(p) {
+			p = filepath.Join(common.GetRunPath(), p)
+		}
+		return p
+	}
+	if err := geoip.Open(geoPath("geoip_country_db"), geoPath("geoip_asn_db")); err != nil {
+		logs.Error("open geoip database error %s", err)
+	}
+	ban.MaxFails = beego.AppConfig.DefaultInt("ban_max_fails", 10)
+	ban.FindTime = time.Duration(beego.AppConfig.DefaultInt("ban_find_time", 600)) * time.Second
+	ban.BanTime = time.Duration(beego.AppConfig.DefaultInt("ban_time", 1800)) * time.Second
+	// 全局白名单内的 ip 不封禁
+	ban.Ignore = func(ip string) bool {
+		g := file.GetDb().GetGlobal()
+		return g != nil && g.WhiteIp(ip) != nil
+	}
+	proxy.DialRetries = beego.AppConfig.DefaultInt("dial_retries", 2)
+	proxy.HttpMaxIdleConns = beego.AppConfig.DefaultInt("http_max_idle_conns", 32)
+	proxy.HttpIdleTimeout = time.Duration(beego.AppConfig.DefaultInt("http_idle_timeout", 90)) * time.Second
+	proxy.Http3Enable = beego.AppConfig.DefaultBool("http3_enable", false)
 	//crypt.InitTls(filepath.Join(common.GetRunPath(), "conf", "server.pem"), filepath.Join(common.GetRunPath(), "conf", "server.key"))
 	crypt.InitTls()
 	tool.InitAllowPort()
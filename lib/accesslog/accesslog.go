@@ -0,0 +1,218 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"github.com/astaxie/beego/logs"
+)
+
+// 访问日志，每个连接或者 http 请求结束时写入一行 json
+
+// 认证结果
+const (
+	AuthPass           = "pass"
+	AuthWhiteList      = "white_list"
+	AuthBlackList      = "black_list"
+	AuthGlobalPassword = "global_password"
+	AuthBasicAuth      = "basic_auth"
+	AuthAcl            = "acl"
+)
+
+// 关闭原因
+const (
+	ReasonClosed    = "closed"
+	ReasonDenied    = "denied"
+	ReasonLimit     = "limit"
+	ReasonDialError = "dial_error"
+	ReasonError     = "error"
+)
+
+// AllFields 是所有可以输出的字段，access_log_fields 为空时全部输出
+var AllFields = []string{"time", "type", "tunnel_id", "host_id", "client_id", "remote_ip", "target", "host",
+	"method", "url", "status", "bytes_in", "bytes_out", "duration_ms", "close_reason", "auth"}
+
+var (
+	writer *rotateWriter
+	fields []string
+)
+
+// Init 打开访问日志文件，path 为空时不记录
+func Init(path string, fieldList []string, maxSize int64, maxFiles int) error {
+	if path == "" {
+		return nil
+	}
+	w, err := newRotateWriter(path, maxSize, maxFiles)
+	if err != nil {
+		return err
+	}
+	fields = nil
+	for _, f := range fieldList {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == 0 {
+		fields = AllFields
+	}
+	writer = w
+	return nil
+}
+
+// Enabled 返回是否开启了访问日志
+func Enabled() bool {
+	return writer != nil
+}
+
+// Entry 是一条访问记录
+type Entry struct {
+	Type     string
+	TunnelId int
+	HostId   int
+	ClientId int
+	RemoteIp string
+	Target   string
+	Host     string
+	Method   string
+	Url      string
+	Status   int
+	Auth     string
+	Reason   string
+	start    time.Time
+	bytesIn  int64
+	bytesOut int64
+	once     sync.Once
+}
+
+// New 创建一条访问记录，remoteAddr 为访问者地址
+func New(typ, remoteAddr string) *Entry {
+	return &Entry{Type: typ, RemoteIp: common.GetIpByAddr(remoteAddr), Auth: AuthPass, start: time.Now()}
+}
+
+// Deny 记录连接被拒绝的原因
+func (e *Entry) Deny(auth string) {
+	e.Auth = auth
+	e.Reason = ReasonDenied
+}
+
+// Close 设置关闭原因，已经设置过的不覆盖
+func (e *Entry) Close(reason string) {
+	if e.Reason == "" {
+		e.Reason = reason
+	}
+}
+
+func (e *Entry) AddIn(n int64) {
+	atomic.AddInt64(&e.bytesIn, n)
+}
+
+func (e *Entry) AddOut(n int64) {
+	atomic.AddInt64(&e.bytesOut, n)
+}
+
+// Wrap 统计访问者连接上的读写字节数，读为 bytes_in，写为 bytes_out
+func (e *Entry) Wrap(c net.Conn) net.Conn {
+	if !Enabled() {
+		return c
+	}
+	return &countConn{Conn: c, e: e}
+}
+
+// Write 写入访问日志，只会写入一次
+func (e *Entry) Write() {
+	if !Enabled() {
+		return
+	}
+	e.once.Do(func() {
+		e.Close(ReasonClosed)
+		if _, err := writer.Write(e.marshal()); err != nil {
+			logs.Error("write access log error %s", err)
+		}
+	})
+}
+
+func (e *Entry) value(field string) (interface{}, bool) {
+	switch field {
+	case "time":
+		return e.start.Format(time.RFC3339Nano), true
+	case "type":
+		return e.Type, true
+	case "tunnel_id":
+		return e.TunnelId, e.TunnelId != 0
+	case "host_id":
+		return e.HostId, e.HostId != 0
+	case "client_id":
+		return e.ClientId, e.ClientId != 0
+	case "remote_ip":
+		return e.RemoteIp, true
+	case "target":
+		return e.Target, e.Target != ""
+	case "host":
+		return e.Host, e.Host != ""
+	case "method":
+		return e.Method, e.Method != ""
+	case "url":
+		return e.Url, e.Url != ""
+	case "status":
+		return e.Status, e.Status != 0
+	case "bytes_in":
+		return atomic.LoadInt64(&e.bytesIn), true
+	case "bytes_out":
+		return atomic.LoadInt64(&e.bytesOut), true
+	case "duration_ms":
+		return time.Since(e.start).Milliseconds(), true
+	case "close_reason":
+		return e.Reason, true
+	case "auth":
+		return e.Auth, true
+	}
+	return nil, false
+}
+
+// marshal 按配置的字段顺序输出，空值的字段省略
+func (e *Entry) marshal() []byte {
+	b := new(bytes.Buffer)
+	b.WriteByte('{')
+	first := true
+	for _, f := range fields {
+		v, ok := e.value(f)
+		if !ok {
+			continue
+		}
+		val, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		b.WriteString(`"` + f + `":`)
+		b.Write(val)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+type countConn struct {
+	net.Conn
+	e *Entry
+}
+
+func (c *countConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.e.AddIn(int64(n))
+	return
+}
+
+func (c *countConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.e.AddOut(int64(n))
+	return
+}
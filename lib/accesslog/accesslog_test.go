@@ -0,0 +1,42 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEntryWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := Init(path, []string{"type", "tunnel_id", "remote_ip", "bytes_in", "close_reason", "auth"}, 200, 2); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { writer = nil }()
+	for i := 0; i < 5; i++ {
+		e := New("tcp", "1.2.3.4:5678")
+		e.TunnelId = 3
+		e.AddIn(10)
+		if i == 0 {
+			e.Deny(AuthBlackList)
+		}
+		e.Write()
+		e.Write()
+	}
+	b, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal("log was not rotated", err)
+	}
+	line := strings.SplitN(string(b), "\n", 2)[0]
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(line), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 6 || m["remote_ip"] != "1.2.3.4" || m["tunnel_id"] != float64(3) || m["bytes_in"] != float64(10) {
+		t.Fatalf("unexpected entry %s", line)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("too many rotated files")
+	}
+}
@@ -0,0 +1,73 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotateWriter 按文件大小切割日志，保留 path.1 ~ path.N 共 maxFiles 个历史文件
+type rotateWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	size     int64
+	f        *os.File
+	sync.Mutex
+}
+
+func newRotateWriter(path string, maxSize int64, maxFiles int) (*rotateWriter, error) {
+	w := &rotateWriter{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotateWriter) Write(b []byte) (n int, err error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.maxSize > 0 && w.size+int64(len(b)) > w.maxSize && w.size > 0 {
+		if err = w.rotate(); err != nil {
+			return
+		}
+	}
+	n, err = w.f.Write(b)
+	w.size += int64(n)
+	return
+}
+
+func (w *rotateWriter) rotate() error {
+	w.f.Close()
+	if w.maxFiles <= 0 {
+		os.Remove(w.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+		for i := w.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		os.Rename(w.path, w.path+".1")
+	}
+	return w.open()
+}
+
+func (w *rotateWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.f.Close()
+}
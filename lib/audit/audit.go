@@ -0,0 +1,324 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// 配置变更审计日志，每条记录一行 json，只追加不修改。
+// 每条记录包含上一条记录的 hash，删除或修改中间的记录后 Verify 会报告断开的位置
+
+// 操作
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	ActionStart  = "start"
+	ActionStop   = "stop"
+)
+
+// 对象类型
+const (
+	ObjectTunnel  = "tunnel"
+	ObjectHost    = "host"
+	ObjectClient  = "client"
+	ObjectGlobal  = "global"
+	ObjectUser    = "user"
+	ObjectToken   = "token"
+	ObjectAccount = "account"
+	ObjectBan     = "ban"
+)
+
+// 不记录的运行时字段
+var ignoreKeys = map[string]bool{"ExportFlow": true, "InletFlow": true, "Rate": true, "NowConn": true, "IsConnect": true, "Addr": true,
+	"Version": true, "LastOnlineTime": true, "RunStatus": true, "HealthNextTime": true, "HealthMap": true,
+	"HealthRemoveArr": true, "CertExpire": true, "CertStatus": true, "LastUsedTime": true, "TargetArr": true}
+
+// 只记录是否修改，不记录值的字段
+var secretKeys = map[string]bool{"Password": true, "WebPassword": true, "GlobalPassword": true, "global_password": true,
+	"VerifyKey": true, "P": true, "Hash": true, "Secret": true, "RecoveryCodes": true, "KeyFilePath": true}
+
+const redacted = "******"
+
+// Change 是一个字段修改前后的值
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Entry 是一条审计记录
+type Entry struct {
+	Seq      int64              `json:"seq"`
+	Time     string             `json:"time"`
+	Actor    string             `json:"actor"`
+	Ip       string             `json:"ip"`
+	Action   string             `json:"action"`
+	Object   string             `json:"object"`
+	ObjectId int                `json:"object_id"`
+	Diff     map[string]*Change `json:"diff,omitempty"`
+	Prev     string             `json:"prev"`
+	Hash     string             `json:"hash"`
+}
+
+func (e *Entry) sum() string {
+	h := e.Hash
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	e.Hash = h
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	path     string
+	lastSeq  int64
+	lastHash string
+	lock     sync.Mutex
+)
+
+// Init 打开审计日志，读取最后一条记录继续 hash 链
+func Init(p string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	path, lastSeq, lastHash = p, 0, ""
+	err := scan(func(e *Entry) bool {
+		lastSeq, lastHash = e.Seq, e.Hash
+		return true
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func scan(f func(e *Entry) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	s := bufio.NewScanner(file)
+	s.Buffer(make([]byte, 64*1024), 16<<20)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		e := new(Entry)
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			continue
+		}
+		if !f(e) {
+			break
+		}
+	}
+	return s.Err()
+}
+
+// Capture 记录对象当前的配置，用于和修改后的对象比较，v 为 nil 时返回 nil
+func Capture(v interface{}) map[string]interface{} {
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	m := make(map[string]interface{})
+	if json.Unmarshal(b, &m) != nil {
+		return nil
+	}
+	dst := make(map[string]interface{})
+	flatten(dst, "", m)
+	return dst
+}
+
+// flatten 将嵌套的对象展开为 a.b 形式的字段，客户端只保留 id
+func flatten(dst map[string]interface{}, prefix string, src map[string]interface{}) {
+	for k, v := range src {
+		if ignoreKeys[k] {
+			continue
+		}
+		if secretKeys[k] && v != nil && v != "" {
+			// 敏感字段只保存摘要，用于判断是否修改
+			v = fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprint(v))))
+		}
+		if sub, ok := v.(map[string]interface{}); ok {
+			if k == "Client" {
+				dst[prefix+"Client.Id"] = sub["Id"]
+				continue
+			}
+			flatten(dst, prefix+k+".", sub)
+			continue
+		}
+		dst[prefix+k] = v
+	}
+}
+
+func isSecret(key string) bool {
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		key = key[i+1:]
+	}
+	return secretKeys[key]
+}
+
+// diff 比较修改前后的配置，敏感字段只记录已修改
+func diff(before, after map[string]interface{}) map[string]*Change {
+	d := make(map[string]*Change)
+	for k, a := range after {
+		b, ok := before[k]
+		if ok && reflect.DeepEqual(a, b) {
+			continue
+		}
+		d[k] = &Change{Before: b, After: a}
+	}
+	for k, b := range before {
+		if _, ok := after[k]; !ok {
+			d[k] = &Change{Before: b}
+		}
+	}
+	for k, c := range d {
+		if isSecret(k) {
+			if c.Before != nil && c.Before != "" {
+				c.Before = redacted
+			}
+			if c.After != nil && c.After != "" {
+				c.After = redacted
+			}
+		}
+	}
+	return d
+}
+
+// Log 写入一条审计记录，before、after 由 Capture 获得，新建时 before 为 nil，删除时 after 为 nil
+func Log(actor, ip, action, object string, id int, before, after map[string]interface{}) {
+	e := &Entry{
+		Time:     time.Now().Format(time.RFC3339),
+		Actor:    actor,
+		Ip:       ip,
+		Action:   action,
+		Object:   object,
+		ObjectId: id,
+		Diff:     diff(before, after),
+	}
+	if action == ActionUpdate && len(e.Diff) == 0 {
+		return
+	}
+	if err := write(e); err != nil {
+		logs.Error("write audit log error %s", err)
+	}
+}
+
+func write(e *Entry) error {
+	lock.Lock()
+	defer lock.Unlock()
+	if path == "" {
+		return errors.New("audit log is not initialized")
+	}
+	e.Seq = lastSeq + 1
+	e.Prev = lastHash
+	e.Hash = e.sum()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	lastSeq, lastHash = e.Seq, e.Hash
+	return nil
+}
+
+// Query 是查询条件，为空的条件不过滤
+type Query struct {
+	Actor    string
+	Ip       string
+	Action   string
+	Object   string
+	ObjectId int
+	Search   string // 在字段名和修改前后的值中查找
+	Since    time.Time
+	Until    time.Time
+}
+
+func (q *Query) match(e *Entry) bool {
+	if q.Actor != "" && e.Actor != q.Actor || q.Ip != "" && e.Ip != q.Ip || q.Action != "" && e.Action != q.Action ||
+		q.Object != "" && e.Object != q.Object || q.ObjectId != 0 && e.ObjectId != q.ObjectId {
+		return false
+	}
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		t, err := time.Parse(time.RFC3339, e.Time)
+		if err != nil || !q.Since.IsZero() && t.Before(q.Since) || !q.Until.IsZero() && t.After(q.Until) {
+			return false
+		}
+	}
+	if q.Search != "" {
+		b, _ := json.Marshal(e.Diff)
+		if !strings.Contains(strings.ToLower(string(b)), strings.ToLower(q.Search)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Search 返回符合条件的记录，新的在前
+func Search(q *Query, offset, limit int) ([]*Entry, int, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	list := make([]*Entry, 0)
+	err := scan(func(e *Entry) bool {
+		if q.match(e) {
+			list = append(list, e)
+		}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Seq > list[j].Seq })
+	total := len(list)
+	if offset > total {
+		offset = total
+	}
+	list = list[offset:]
+	if limit > 0 && limit < len(list) {
+		list = list[:limit]
+	}
+	return list, total, nil
+}
+
+// Verify 检查 hash 链，返回第一条被篡改或者前面缺失记录的序号，0 表示完整
+func Verify() (int64, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	var prev string
+	var seq, broken int64
+	err := scan(func(e *Entry) bool {
+		if e.Seq != seq+1 || e.Prev != prev || e.sum() != e.Hash {
+			broken = e.Seq
+			return false
+		}
+		seq, prev = e.Seq, e.Hash
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return broken, nil
+}
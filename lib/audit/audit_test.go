@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tunnel struct {
+	Port     int
+	Password string
+	Flow     struct{ InletFlow, FlowLimit int64 }
+}
+
+func TestLogAndVerify(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "audit.log")
+	if err := Init(p); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &tunnel{Port: 8000, Password: "secret"}
+	Log("admin:admin", "127.0.0.1", ActionCreate, ObjectTunnel, 1, nil, Capture(a))
+	before := Capture(a)
+	a.Flow.InletFlow = 100
+	Log("admin:admin", "127.0.0.1", ActionUpdate, ObjectTunnel, 1, before, Capture(a))
+	before = Capture(a)
+	a.Port, a.Password, a.Flow.FlowLimit = 10000, "changed", 5
+	Log("user:ops", "10.0.0.1", ActionUpdate, ObjectTunnel, 1, before, Capture(a))
+
+	list, total, err := Search(&Query{Search: "10000"}, 0, 10)
+	if err != nil || total != 1 {
+		t.Fatalf("search got %d entries, err %v", total, err)
+	}
+	e := list[0]
+	if e.Seq != 2 || e.Actor != "user:ops" || len(e.Diff) != 3 {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if c := e.Diff["Password"]; c.Before != redacted || c.After != redacted {
+		t.Fatalf("password not redacted: %+v", c)
+	}
+	if c := e.Diff["Flow.FlowLimit"]; c.After != float64(5) {
+		t.Fatalf("nested field not recorded: %+v", c)
+	}
+	if b, _ := os.ReadFile(p); strings.Contains(string(b), "changed") {
+		t.Fatal("password written to the audit log")
+	}
+
+	if seq, err := Verify(); err != nil || seq != 0 {
+		t.Fatalf("verify got %d, err %v", seq, err)
+	}
+	b, _ := os.ReadFile(p)
+	b = []byte(strings.Replace(string(b), "user:ops", "user:xxx", 1))
+	if err := os.WriteFile(p, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if seq, _ := Verify(); seq != 2 {
+		t.Fatalf("tampered entry not detected, got %d", seq)
+	}
+}
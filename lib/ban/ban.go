@@ -0,0 +1,175 @@
+package ban
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// 按来源 ip 统计认证失败，FindTime 内失败 MaxFails 次后封禁 BanTime，
+// 封禁期间所有监听在接受连接后立即关闭该 ip 的连接，不做任何协议处理
+
+// 失败的类型
+const (
+	ReasonLogin          = "login"           // web 管理登录
+	ReasonGlobalPassword = "global_password" // 全局访问密码
+	ReasonBasicAuth      = "basic_auth"      // http 代理和域名的 basic 认证
+	ReasonSocks5         = "socks5"          // socks5 用户名密码
+	ReasonVkey           = "vkey"            // 客户端验证密钥
+)
+
+var (
+	MaxFails = 10               // 为 0 时不封禁
+	FindTime = 10 * time.Minute // 统计失败次数的时间窗口
+	BanTime  = 30 * time.Minute // 封禁时长
+	// Ignore 返回 true 的 ip 不会被封禁，用于排除全局白名单
+	Ignore func(ip string) bool
+)
+
+// Ban 是一条封禁记录
+type Ban struct {
+	Ip     string    `json:"ip"`
+	Reason string    `json:"reason"` // 触发封禁的最后一次失败
+	Fails  int       `json:"fails"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+var (
+	mu        sync.RWMutex
+	fails     = make(map[string][]time.Time)
+	bans      = make(map[string]*Ban)
+	lastSweep time.Time
+)
+
+// normalize 去掉端口，ipv4 映射的 ipv6 地址转换为 ipv4
+func normalize(addr string) string {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return ap.Addr().Unmap().String()
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if a, err := netip.ParseAddr(addr); err == nil {
+		return a.Unmap().String()
+	}
+	return ""
+}
+
+// Fail 记录一次失败，达到次数后封禁该 ip，返回是否因此被封禁
+func Fail(addr, reason string) bool {
+	ip := normalize(addr)
+	if ip == "" || MaxFails <= 0 || Ignore != nil && Ignore(ip) {
+		return false
+	}
+	now := time.Now()
+	mu.Lock()
+	defer mu.Unlock()
+	sweep(now)
+	if b, ok := bans[ip]; ok && now.Before(b.Until) {
+		return false
+	}
+	list := append(window(fails[ip], now), now)
+	if len(list) < MaxFails {
+		fails[ip] = list
+		return false
+	}
+	delete(fails, ip)
+	bans[ip] = &Ban{Ip: ip, Reason: reason, Fails: len(list), Since: now, Until: now.Add(BanTime)}
+	logs.Warn("ip %s banned until %s after %d failures, last reason %s", ip, now.Add(BanTime).Format("2006-01-02 15:04:05"), len(list), reason)
+	return true
+}
+
+// window 去掉时间窗口之前的失败记录
+func window(list []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(list) && now.Sub(list[i]) >= FindTime {
+		i++
+	}
+	return list[i:]
+}
+
+// sweep 清理过期的封禁和失败记录，最多每个时间窗口执行一次
+func sweep(now time.Time) {
+	if now.Sub(lastSweep) < FindTime {
+		return
+	}
+	lastSweep = now
+	for ip, list := range fails {
+		if list = window(list, now); len(list) == 0 {
+			delete(fails, ip)
+		} else {
+			fails[ip] = list
+		}
+	}
+	for ip, b := range bans {
+		if !now.Before(b.Until) {
+			delete(bans, ip)
+		}
+	}
+}
+
+// IsBanned 判断地址是否在封禁中，addr 可以带端口
+func IsBanned(addr string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	if len(bans) == 0 {
+		return false
+	}
+	b, ok := bans[normalize(addr)]
+	return ok && time.Now().Before(b.Until)
+}
+
+// List 返回正在封禁的 ip，按解除时间排序
+func List() []*Ban {
+	now := time.Now()
+	mu.RLock()
+	defer mu.RUnlock()
+	list := make([]*Ban, 0, len(bans))
+	for _, b := range bans {
+		if now.Before(b.Until) {
+			v := *b
+			list = append(list, &v)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Until.Before(list[j].Until)
+	})
+	return list
+}
+
+// Unban 解除封禁并清空失败次数，返回解除前的记录，没有封禁时返回 nil
+func Unban(addr string) *Ban {
+	ip := normalize(addr)
+	mu.Lock()
+	defer mu.Unlock()
+	delete(fails, ip)
+	b, ok := bans[ip]
+	if !ok {
+		return nil
+	}
+	delete(bans, ip)
+	if !time.Now().Before(b.Until) {
+		return nil
+	}
+	return b
+}
+
+// Listener 在 Accept 时关闭被封禁的连接，用于交给 http.Serve 的监听
+type Listener struct {
+	net.Listener
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || !IsBanned(c.RemoteAddr().String()) {
+			return c, err
+		}
+		c.Close()
+	}
+}
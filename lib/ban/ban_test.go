@@ -0,0 +1,46 @@
+package ban
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBan(t *testing.T) {
+	MaxFails, FindTime, BanTime = 3, time.Minute, time.Minute
+	Ignore = func(ip string) bool { return ip == "10.0.0.1" }
+	for i := 0; i < 2; i++ {
+		if Fail("1.2.3.4:1000", ReasonLogin) {
+			t.Fatal("should not be banned before max fails")
+		}
+	}
+	if IsBanned("1.2.3.4") {
+		t.Fatal("should not be banned")
+	}
+	if !Fail("[::ffff:1.2.3.4]:2000", ReasonSocks5) {
+		t.Fatal("should be banned after max fails")
+	}
+	if !IsBanned("1.2.3.4:3000") || IsBanned("1.2.3.5") {
+		t.Fatal("ban check error")
+	}
+	if l := List(); len(l) != 1 || l[0].Ip != "1.2.3.4" || l[0].Reason != ReasonSocks5 || l[0].Fails != 3 {
+		t.Fatalf("list error %+v", l)
+	}
+	if Unban("1.2.3.4") == nil || IsBanned("1.2.3.4") || Unban("1.2.3.4") != nil {
+		t.Fatal("unban error")
+	}
+	for i := 0; i < 5; i++ {
+		Fail("10.0.0.1", ReasonVkey)
+	}
+	if IsBanned("10.0.0.1") {
+		t.Fatal("ignored ip should not be banned")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	FindTime = time.Minute
+	now := time.Now()
+	list := []time.Time{now.Add(-2 * time.Minute), now.Add(-time.Minute), now.Add(-time.Second)}
+	if w := window(list, now); len(w) != 1 || !w[0].Equal(list[2]) {
+		t.Fatalf("window error %v", w)
+	}
+}
@@ -0,0 +1,118 @@
+package cluster
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Lease 记录某个监听端口当前由哪个节点负责
+type Lease struct {
+	Node   string `json:"node"`
+	Expire int64  `json:"expire"`
+}
+
+// Leases 保存在共享目录中的端口租约表，节点需要在租约过期前续约，
+// 节点宕机后租约过期，其他节点即可接管对应端口
+type Leases struct {
+	path string
+	node string
+	ttl  time.Duration
+	lock *FileLock
+}
+
+func NewLeases(dir, node string, ttl time.Duration) *Leases {
+	return &Leases{
+		path: filepath.Join(dir, "leases.json"),
+		node: node,
+		ttl:  ttl,
+		lock: NewFileLock(filepath.Join(dir, "leases.lock")),
+	}
+}
+
+func (s *Leases) Node() string {
+	return s.node
+}
+
+// Update 为 want 中的端口申请或续约租约，并释放本节点持有但不再需要的租约，返回本节点持有的端口
+func (s *Leases) Update(want []string) (owned map[string]bool, err error) {
+	if err = s.lock.Lock(); err != nil {
+		return
+	}
+	defer s.lock.Unlock()
+	table, err := s.read()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	wanted := make(map[string]bool, len(want))
+	owned = make(map[string]bool)
+	for _, key := range want {
+		wanted[key] = true
+		if l, ok := table[key]; ok && l.Node != s.node && l.Expire > now.Unix() {
+			continue
+		}
+		table[key] = &Lease{Node: s.node, Expire: now.Add(s.ttl).Unix()}
+		owned[key] = true
+	}
+	for key, l := range table {
+		if (l.Node == s.node && !wanted[key]) || l.Expire <= now.Unix() {
+			delete(table, key)
+		}
+	}
+	return owned, s.write(table)
+}
+
+// List 返回当前所有未过期的租约
+func (s *Leases) List() (map[string]*Lease, error) {
+	if err := s.lock.Lock(); err != nil {
+		return nil, err
+	}
+	defer s.lock.Unlock()
+	table, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	for key, l := range table {
+		if l.Expire <= time.Now().Unix() {
+			delete(table, key)
+		}
+	}
+	return table, nil
+}
+
+// Release 释放本节点持有的所有租约，节点正常退出时调用
+func (s *Leases) Release() error {
+	_, err := s.Update(nil)
+	return err
+}
+
+func (s *Leases) read() (map[string]*Lease, error) {
+	table := make(map[string]*Lease)
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return table, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, &table); err != nil {
+			// 租约文件损坏时重新选举即可
+			return make(map[string]*Lease), nil
+		}
+	}
+	return table, nil
+}
+
+func (s *Leases) write(table map[string]*Lease) error {
+	b, err := json.Marshal(table)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
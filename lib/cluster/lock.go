@@ -0,0 +1,42 @@
+package cluster
+
+import (
+	"os"
+	"sync"
+)
+
+// FileLock 是基于文件的跨进程互斥锁，用于多个 nps 节点共享同一目录时串行化写入
+type FileLock struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+func (l *FileLock) Lock() error {
+	l.mu.Lock()
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		l.mu.Unlock()
+		return err
+	}
+	l.f = f
+	return nil
+}
+
+func (l *FileLock) Unlock() {
+	if l.f != nil {
+		unlockFile(l.f)
+		l.f.Close()
+		l.f = nil
+	}
+	l.mu.Unlock()
+}
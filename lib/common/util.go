@@ -16,7 +16,6 @@ import (
 	"net/http"
 	"os"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -290,26 +289,6 @@ func GetPortByAddr(addr string) int {
 	return p
 }
 
-func in(target string, str_array []string) bool {
-	sort.Strings(str_array)
-	index := sort.SearchStrings(str_array, target)
-	if index < len(str_array) && str_array[index] == target {
-		return true
-	}
-	return false
-}
-
-// 判断访问地址是否在黑名单内
-func IsBlackIp(ipPort, vkey string, blackIpList []string) bool {
-	ip := GetIpByAddr(ipPort)
-	if in(ip, blackIpList) {
-		logs.Error("IP地址[" + ip + "]在隧道[" + vkey + "]黑名单列表内")
-		return true
-	}
-
-	return false
-}
-
 func CopyBuffer(dst io.Writer, src io.Reader, label ...string) (written int64, err error) {
 	buf := CopyBuff.Get()
 	defer CopyBuff.Put(buf)
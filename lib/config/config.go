@@ -13,7 +13,7 @@ import (
 type CommonConfig struct {
 	Server           string
 	VKey             string
-	Tp               string //bridgeType kcp or tcp
+	Tp               string //bridgeType kcp, quic or tcp
 	AutoReconnection bool
 	TlsEnable        bool
 	ProxyUrl         string
@@ -175,12 +175,16 @@ func dealHost(s string) *file.Host {
 			h.Host = item[1]
 		case "target_addr":
 			h.Target.TargetStr = strings.Replace(item[1], ",", "\n", -1)
+		case "balance":
+			h.Target.Balance = item[1]
 		case "host_change":
 			h.HostChange = item[1]
 		case "scheme":
 			h.Scheme = item[1]
 		case "location":
 			h.Location = item[1]
+		case "target_proto":
+			h.TargetProto = item[1]
 		default:
 			if strings.Contains(item[0], "header") {
 				headerChange += strings.Replace(item[0], "header_", "", -1) + ":" + item[1] + "\n"
@@ -213,6 +217,8 @@ func dealHealth(s string) *file.Health {
 			h.HealthCheckType = item[1]
 		case "health_check_target":
 			h.HealthCheckTarget = item[1]
+		case "health_grpc_service":
+			h.HealthGrpcService = item[1]
 		}
 	}
 	return h
@@ -237,6 +243,8 @@ func dealTunnel(s string) *file.Tunnel {
 			t.Mode = item[1]
 		case "target_addr":
 			t.Target.TargetStr = strings.Replace(item[1], ",", "\n", -1)
+		case "balance":
+			t.Target.Balance = item[1]
 		case "target_port":
 			t.Target.TargetStr = item[1]
 		case "target_ip":
@@ -151,6 +151,8 @@ func (s *Conn) SetAlive(tp string) {
 		//conn.SetKeepAlivePeriod(time.Duration(2 * time.Second))
 	case *pmux.PortConn:
 		s.Conn.(*pmux.PortConn).SetReadDeadline(time.Time{})
+	case *QuicStream:
+		s.Conn.(*QuicStream).SetReadDeadline(time.Time{})
 	}
 }
 
@@ -163,6 +165,8 @@ func (s *Conn) SetReadDeadlineBySecond(t time.Duration) {
 		s.Conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
 	case *pmux.PortConn:
 		s.Conn.(*pmux.PortConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
+	case *QuicStream:
+		s.Conn.(*QuicStream).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
 	}
 }
 
@@ -172,6 +176,26 @@ func (s *Conn) GetLinkInfo() (lk *Link, err error) {
 	return
 }
 
+// SendDialResult 回复连接目标的结果，err 为 nil 表示连接成功
+func (s *Conn) SendDialResult(err error) error {
+	var reason string
+	if err != nil {
+		if reason = err.Error(); reason == "" {
+			reason = "dial error"
+		}
+	}
+	return s.WriteLenContent([]byte(reason))
+}
+
+// GetDialResult 读取客户端连接目标的结果，reason 为空表示连接成功
+func (s *Conn) GetDialResult() (reason string, err error) {
+	var b []byte
+	if b, err = s.GetShortLenContent(); err != nil {
+		return
+	}
+	return string(b), nil
+}
+
 //send info for link
 func (s *Conn) SendHealthInfo(info, status string) (int, error) {
 	raw := bytes.NewBuffer([]byte{})
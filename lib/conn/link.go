@@ -21,6 +21,7 @@ type Link struct {
 	Compress   bool
 	LocalProxy bool
 	RemoteAddr string
+	DialReport bool // 客户端连接目标后回复连接结果
 	Option     Options
 }
 
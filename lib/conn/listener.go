@@ -4,6 +4,7 @@ import (
 	"net"
 	"strings"
 
+	"ehang.io/nps/lib/ban"
 	"github.com/astaxie/beego/logs"
 	"github.com/xtaci/kcp-go"
 )
@@ -31,6 +32,10 @@ func NewKcpListenerAndProcess(addr string, f func(c net.Conn)) error {
 			logs.Warn(err)
 			continue
 		}
+		if ban.IsBanned(c.RemoteAddr().String()) {
+			c.Close()
+			continue
+		}
 		go f(c)
 	}
 	return nil
@@ -53,6 +58,11 @@ func Accept(l net.Listener, f func(c net.Conn)) {
 			logs.Warn("nil connection")
 			break
 		}
+		// 被封禁的 ip 不做任何处理
+		if ban.IsBanned(c.RemoteAddr().String()) {
+			c.Close()
+			continue
+		}
 		go f(c)
 	}
 }
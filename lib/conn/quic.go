@@ -0,0 +1,276 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/ban"
+	"ehang.io/nps/lib/nps_mux"
+	"github.com/astaxie/beego/logs"
+	"github.com/quic-go/quic-go"
+)
+
+// QuicAlpn 是 quic 桥接使用的 alpn
+const QuicAlpn = "nps"
+
+// quic 连接的参数，服务端会主动打开流，两端都需要允许足够多的流
+var quicConfig = &quic.Config{
+	MaxIncomingStreams: 1 << 16,
+	KeepAlivePeriod:    10 * time.Second,
+	// 0-RTT 的数据在握手完成后才会交给桥接处理，不会被重放
+	Allow0RTT: true,
+}
+
+// Tunnel 是客户端和服务端之间的数据通道，tcp、kcp 使用 nps_mux 多路复用，quic 直接使用原生的流
+type Tunnel interface {
+	NewConn() (net.Conn, error)
+	Accept() (net.Conn, error)
+	Close() error
+	Addr() net.Addr
+	IsClosed() bool
+	Stats() nps_mux.Stats
+}
+
+// NewTunnel 在握手完成的桥接连接上建立数据通道
+func NewTunnel(c net.Conn, connType string, disconnectTime int) Tunnel {
+	if s, ok := c.(*QuicStream); ok {
+		return &quicTunnel{conn: s.conn}
+	}
+	return muxTunnel{nps_mux.NewMux(c, connType, disconnectTime)}
+}
+
+type muxTunnel struct {
+	*nps_mux.Mux
+}
+
+func (t muxTunnel) NewConn() (net.Conn, error) {
+	c, err := t.Mux.NewConn()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t muxTunnel) IsClosed() bool {
+	return t.Mux.IsClose
+}
+
+// QuicStream 把 quic 的流包装成 net.Conn，桥接的握手在连接的第一个流上进行
+type QuicStream struct {
+	*quic.Stream
+	conn  *quic.Conn
+	first bool
+	once  sync.Once
+	done  func()
+}
+
+func (s *QuicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *QuicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close 关闭流的两个方向，第一个流关闭时整个连接也随之关闭
+func (s *QuicStream) Close() error {
+	s.once.Do(func() {
+		s.Stream.CancelRead(0)
+		s.Stream.Close()
+		if s.done != nil {
+			s.done()
+		}
+		if s.first {
+			go func() {
+				// 留一点时间把剩余的数据发给对端
+				select {
+				case <-s.conn.Context().Done():
+				case <-time.After(time.Second):
+				}
+				s.conn.CloseWithError(0, "")
+			}()
+		}
+	})
+	return nil
+}
+
+type quicTunnel struct {
+	conn  *quic.Conn
+	conns int64
+}
+
+func (t *quicTunnel) wrap(s *quic.Stream) net.Conn {
+	atomic.AddInt64(&t.conns, 1)
+	return &QuicStream{Stream: s, conn: t.conn, done: func() { atomic.AddInt64(&t.conns, -1) }}
+}
+
+func (t *quicTunnel) NewConn() (net.Conn, error) {
+	s, err := t.conn.OpenStreamSync(t.conn.Context())
+	if err != nil {
+		return nil, err
+	}
+	return t.wrap(s), nil
+}
+
+func (t *quicTunnel) Accept() (net.Conn, error) {
+	s, err := t.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return t.wrap(s), nil
+}
+
+func (t *quicTunnel) Close() error {
+	return t.conn.CloseWithError(0, "")
+}
+
+func (t *quicTunnel) Addr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *quicTunnel) IsClosed() bool {
+	select {
+	case <-t.conn.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *quicTunnel) Stats() nps_mux.Stats {
+	return nps_mux.Stats{Conns: int(atomic.LoadInt64(&t.conns))}
+}
+
+// NewQuicListenerAndProcess 监听 quic，每个连接的第一个流交给 f 处理
+func NewQuicListenerAndProcess(addr string, config *tls.Config, f func(c net.Conn)) error {
+	config.NextProtos = []string{QuicAlpn}
+	l, err := quic.ListenAddr(addr, config, quicConfig)
+	if err != nil {
+		logs.Error(err)
+		return err
+	}
+	for {
+		c, err := l.Accept(context.Background())
+		if err != nil {
+			logs.Warn(err)
+			return err
+		}
+		if ban.IsBanned(c.RemoteAddr().String()) {
+			c.CloseWithError(0, "")
+			continue
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(c.Context(), 10*time.Second)
+			defer cancel()
+			s, err := c.AcceptStream(ctx)
+			if err != nil {
+				c.CloseWithError(0, "")
+				return
+			}
+			f(&QuicStream{Stream: s, conn: c, first: true})
+		}()
+	}
+}
+
+// 会话票据在重连时复用，服务端没有重启时可以 0-RTT 建立连接
+var quicSessionCache = tls.NewLRUClientSessionCache(32)
+
+// DialQuic 建立 quic 连接并打开第一个流，本机的出口地址变化时连接会迁移到新的地址上
+func DialQuic(server string) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := tr.DialEarly(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{QuicAlpn},
+		ClientSessionCache: quicSessionCache}, quicConfig)
+	if err != nil {
+		closeTransport(tr)
+		return nil, err
+	}
+	s, err := c.OpenStreamSync(ctx)
+	if err != nil {
+		c.CloseWithError(0, "")
+		closeTransport(tr)
+		return nil, err
+	}
+	go migrateQuic(c, tr, addr)
+	return &QuicStream{Stream: s, conn: c, first: true}, nil
+}
+
+// migrateQuic 定时检查到服务端的出口地址，变化后在新的 udp socket 上验证路径并切换过去
+func migrateQuic(c *quic.Conn, tr *quic.Transport, server *net.UDPAddr) {
+	transports := []*quic.Transport{tr}
+	defer func() {
+		for _, t := range transports {
+			closeTransport(t)
+		}
+	}()
+	last := localIpTo(server)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		ip := localIpTo(server)
+		if ip == "" || ip == last {
+			continue
+		}
+		udpConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			continue
+		}
+		t := &quic.Transport{Conn: udpConn}
+		if err := switchPath(c, t); err != nil {
+			logs.Warn("migrate quic connection from %s to %s error %s", last, ip, err)
+			closeTransport(t)
+			continue
+		}
+		logs.Info("quic connection migrated from %s to %s", last, ip)
+		transports = append(transports, t)
+		last = ip
+	}
+}
+
+// closeTransport 关闭 Transport 和它使用的 udp socket，Transport 不会关闭外部传入的 socket
+func closeTransport(t *quic.Transport) {
+	t.Close()
+	t.Conn.Close()
+}
+
+func switchPath(c *quic.Conn, t *quic.Transport) error {
+	p, err := c.AddPath(t)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(c.Context(), 5*time.Second)
+	defer cancel()
+	if err := p.Probe(ctx); err != nil {
+		p.Close()
+		return err
+	}
+	return p.Switch()
+}
+
+// localIpTo 返回连接 server 时使用的本机地址，udp 的 Dial 不会发送数据
+func localIpTo(server *net.UDPAddr) string {
+	c, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		return ""
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP.String()
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
+	crand "crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
@@ -78,6 +79,27 @@ func GetRandomString(l int) string {
 	return string(result)
 }
 
+// GetSecretString 使用 crypto/rand 生成随机字符串，用于令牌等需要保密的场景
+func GetSecretString(l int) string {
+	str := "0123456789abcdefghijklmnopqrstuvwxyz"
+	b := make([]byte, l)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		// 256 不是 36 的整数倍，丢弃超出的部分避免偏差
+		for b[i] >= 252 {
+			var c [1]byte
+			if _, err := crand.Read(c[:]); err != nil {
+				panic(err)
+			}
+			b[i] = c[0]
+		}
+		b[i] = str[int(b[i])%len(str)]
+	}
+	return string(b)
+}
+
 func GetVkey() string {
 	// 生成UUID
 	u, _ := uuid.NewRandom()
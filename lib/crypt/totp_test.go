@@ -0,0 +1,24 @@
+package crypt
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录 B 的 SHA1 测试向量，取后 6 位
+func TestTotpCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		code, err := TotpCode(secret, TotpStep(time.Unix(unix, 0)))
+		if err != nil || code != want {
+			t.Fatalf("time %d: got %s %v, want %s", unix, code, err, want)
+		}
+	}
+	if _, ok := VerifyTotp(secret, "287082", time.Unix(59+TotpPeriod, 0)); !ok {
+		t.Fatal("code of the previous step should be accepted")
+	}
+	if _, ok := VerifyTotp(secret, "287082", time.Unix(59+3*TotpPeriod, 0)); ok {
+		t.Fatal("expired code should be rejected")
+	}
+}
@@ -0,0 +1,40 @@
+package file
+
+import "ehang.io/nps/lib/iplist"
+
+// 隧道和域名访问控制的结果
+const (
+	AclNone  = iota // 没有设置或者没有命中，继续检查全局名单
+	AclAllow        // 命中允许列表
+	AclDeny         // 命中拒绝列表，或者设置了允许列表但不在其中
+)
+
+// Acl 是隧道和域名的访问控制列表，格式与全局黑白名单相同
+type Acl struct {
+	AllowIpList []string // 不为空时只有列表内的地址可以访问
+	DenyIpList  []string // 优先于允许列表
+	allowIps    iplist.Cache
+	denyIps     iplist.Cache
+}
+
+// CheckIp 依次检查拒绝列表和允许列表，返回结果和命中的记录
+func (a *Acl) CheckIp(addr string) (int, *iplist.Entry) {
+	if e := a.denyIps.Get(a.DenyIpList).Lookup(addr); e != nil {
+		return AclDeny, e
+	}
+	if allow := a.allowIps.Get(a.AllowIpList); allow.Len() > 0 {
+		if e := allow.Lookup(addr); e != nil {
+			return AclAllow, e
+		}
+		return AclDeny, nil
+	}
+	return AclNone, nil
+}
+
+// CheckAcl 检查允许和拒绝列表的格式
+func CheckAcl(allow, deny []string) error {
+	if err := iplist.Check(allow); err != nil {
+		return err
+	}
+	return iplist.Check(deny)
+}
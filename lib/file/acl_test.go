@@ -0,0 +1,22 @@
+package file
+
+import "testing"
+
+func TestAcl(t *testing.T) {
+	a := &Acl{AllowIpList: []string{"10.0.0.0/8"}, DenyIpList: []string{"10.1.0.0/16 # lab"}}
+	if r, _ := a.CheckIp("10.2.0.1:22"); r != AclAllow {
+		t.Fatalf("want allow got %d", r)
+	}
+	if r, e := a.CheckIp("10.1.0.1:22"); r != AclDeny || e == nil || e.Comment != "lab" {
+		t.Fatalf("deny list should win, got %d %+v", r, e)
+	}
+	if r, e := a.CheckIp("1.1.1.1:22"); r != AclDeny || e != nil {
+		t.Fatalf("address out of allow list should be denied, got %d %+v", r, e)
+	}
+	if r, _ := new(Acl).CheckIp("1.1.1.1:22"); r != AclNone {
+		t.Fatalf("empty acl should not match, got %d", r)
+	}
+	if CheckAcl([]string{"10.0.0.0/8"}, []string{"10.0.0.0/33"}) == nil {
+		t.Fatal("invalid deny list should be rejected")
+	}
+}
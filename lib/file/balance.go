@@ -0,0 +1,222 @@
+package file
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"ehang.io/nps/lib/common"
+	"github.com/pkg/errors"
+)
+
+// 负载均衡策略
+const (
+	BalanceRoundRobin         = "rr"
+	BalanceWeightedRoundRobin = "wrr"
+	BalanceLeastConn          = "leastconn"
+	BalanceRandom             = "random"
+	BalanceIpHash             = "iphash" // 按访问者 ip 一致性哈希，同一 ip 访问同一个目标
+)
+
+var BalanceStrategies = []string{BalanceRoundRobin, BalanceWeightedRoundRobin, BalanceLeastConn, BalanceRandom, BalanceIpHash}
+
+func ValidBalance(balance string) bool {
+	if balance == "" {
+		return true
+	}
+	for _, v := range BalanceStrategies {
+		if v == balance {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTargetStr 解析每行一个的目标，addr@weight 指定权重，未指定时权重为 1
+func ParseTargetStr(str string) (addrs []string, weights map[string]int, err error) {
+	weights = make(map[string]int)
+	for _, line := range strings.Split(str, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		addr, weight := line, 1
+		if i := strings.LastIndex(line, "@"); i >= 0 {
+			addr = strings.TrimSpace(line[:i])
+			if weight, err = strconv.Atoi(strings.TrimSpace(line[i+1:])); err != nil || weight <= 0 {
+				return nil, nil, errors.New("invalid weight in " + line)
+			}
+		}
+		if _, ok := weights[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		weights[addr] = weight
+	}
+	return addrs, weights, nil
+}
+
+// Addrs 返回配置的所有目标地址，不包含权重
+func (s *Target) Addrs() []string {
+	addrs, _, _ := ParseTargetStr(s.TargetStr)
+	return addrs
+}
+
+func (s *Target) weight(addr string) int {
+	if s.weights == nil {
+		if _, s.weights, _ = ParseTargetStr(s.TargetStr); s.weights == nil {
+			s.weights = make(map[string]int)
+		}
+	}
+	if w, ok := s.weights[addr]; ok {
+		return w
+	}
+	return 1
+}
+
+// GetTarget 按负载均衡策略选择一个目标，ip 为访问者的 ip，exclude 为重试时已经试过的目标，
+// 连接结束后需要调用返回的 done，用于统计各目标的连接数
+func (s *Target) GetTarget(ip string, exclude ...string) (string, func(), error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.TargetArr == nil {
+		s.TargetArr = s.Addrs()
+	}
+	s.restoreEjected()
+	if len(s.TargetArr) == 0 {
+		return "", func() {}, errors.New("all inward-bending targets are offline")
+	}
+	arr := s.TargetArr
+	if len(exclude) > 0 {
+		arr = make([]string, 0, len(s.TargetArr))
+		for _, v := range s.TargetArr {
+			if !common.InStrArr(exclude, v) {
+				arr = append(arr, v)
+			}
+		}
+		if len(arr) == 0 {
+			return "", func() {}, errors.New("no other target to retry")
+		}
+	}
+	var addr string
+	switch {
+	case len(arr) == 1:
+		addr = arr[0]
+	case s.Balance == BalanceWeightedRoundRobin:
+		addr = s.weightedRoundRobin(arr)
+	case s.Balance == BalanceLeastConn:
+		addr = s.leastConn(arr)
+	case s.Balance == BalanceRandom:
+		addr = s.random(arr)
+	case s.Balance == BalanceIpHash && ip != "":
+		addr = s.ipHash(arr, ip)
+	default:
+		addr = s.roundRobin(arr)
+	}
+	if s.conns == nil {
+		s.conns = make(map[string]int64)
+	}
+	s.conns[addr]++
+	return addr, func() {
+		s.Lock()
+		if s.conns[addr]--; s.conns[addr] <= 0 {
+			delete(s.conns, addr)
+		}
+		s.Unlock()
+	}, nil
+}
+
+// Conns 返回各目标正在处理的连接数
+func (s *Target) Conns() map[string]int64 {
+	s.RLock()
+	defer s.RUnlock()
+	m := make(map[string]int64, len(s.conns))
+	for k, v := range s.conns {
+		m[k] = v
+	}
+	return m
+}
+
+func (s *Target) roundRobin(arr []string) string {
+	if s.nowIndex >= len(arr)-1 {
+		s.nowIndex = -1
+	}
+	s.nowIndex++
+	return arr[s.nowIndex]
+}
+
+// weightedRoundRobin 平滑加权轮询，与 nginx 相同，权重高的目标不会被连续选中
+func (s *Target) weightedRoundRobin(arr []string) string {
+	if s.current == nil {
+		s.current = make(map[string]int)
+	}
+	var best string
+	total := 0
+	for _, addr := range arr {
+		w := s.weight(addr)
+		s.current[addr] += w
+		total += w
+		if best == "" || s.current[addr] > s.current[best] {
+			best = addr
+		}
+	}
+	s.current[best] -= total
+	return best
+}
+
+// leastConn 选择连接数与权重之比最小的目标，相同时轮流选择
+func (s *Target) leastConn(arr []string) string {
+	n := len(arr)
+	s.nowIndex = (s.nowIndex + 1) % n
+	best := arr[s.nowIndex]
+	for i := 1; i < n; i++ {
+		addr := arr[(s.nowIndex+i)%n]
+		if s.conns[addr]*int64(s.weight(best)) < s.conns[best]*int64(s.weight(addr)) {
+			best = addr
+		}
+	}
+	return best
+}
+
+func (s *Target) random(arr []string) string {
+	total := 0
+	for _, addr := range arr {
+		total += s.weight(addr)
+	}
+	r := rand.Intn(total)
+	for _, addr := range arr {
+		if r -= s.weight(addr); r < 0 {
+			return addr
+		}
+	}
+	return arr[len(arr)-1]
+}
+
+// ipHash 加权的最高随机权重哈希，目标增减时只有原先分配到该目标的 ip 会改变
+func (s *Target) ipHash(arr []string, ip string) string {
+	var best string
+	bestScore := math.Inf(-1)
+	for _, addr := range arr {
+		h := fnv.New64a()
+		h.Write([]byte(ip))
+		h.Write([]byte{0})
+		h.Write([]byte(addr))
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		if score := -float64(s.weight(addr)) / math.Log(u); score > bestScore {
+			best, bestScore = addr, score
+		}
+	}
+	return best
+}
+
+// Check 校验目标的权重和负载均衡策略
+func (s *Target) Check() error {
+	if _, _, err := ParseTargetStr(s.TargetStr); err != nil {
+		return err
+	}
+	if !ValidBalance(s.Balance) {
+		return errors.New("invalid load balancing strategy " + s.Balance)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package file
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParseTargetStr(t *testing.T) {
+	addrs, weights, err := ParseTargetStr("10.0.0.1:80@3\r\n\n10.0.0.2:80\n")
+	if err != nil || len(addrs) != 2 || weights["10.0.0.1:80"] != 3 || weights["10.0.0.2:80"] != 1 {
+		t.Fatalf("got %v %v %v", addrs, weights, err)
+	}
+	for _, s := range []string{"10.0.0.1:80@0", "10.0.0.1:80@x"} {
+		if _, _, err := ParseTargetStr(s); err == nil {
+			t.Fatalf("%s should be invalid", s)
+		}
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	target := &Target{TargetStr: "a@5\nb@1\nc@1", Balance: BalanceWeightedRoundRobin}
+	count := make(map[string]int)
+	var last string
+	for i := 0; i < 70; i++ {
+		addr, done, _ := target.GetTarget("")
+		done()
+		count[addr]++
+		if addr == last && addr != "a" {
+			t.Fatalf("%s picked twice in a row", addr)
+		}
+		last = addr
+	}
+	if count["a"] != 50 || count["b"] != 10 || count["c"] != 10 {
+		t.Fatalf("unexpected distribution %v", count)
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	target := &Target{TargetStr: "a@2\nb", Balance: BalanceLeastConn}
+	count := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		addr, _, _ := target.GetTarget("")
+		count[addr]++
+	}
+	if count["a"] != 4 || count["b"] != 2 {
+		t.Fatalf("unexpected distribution %v", count)
+	}
+	if conns := target.Conns(); conns["a"] != 4 || conns["b"] != 2 {
+		t.Fatalf("unexpected conns %v", conns)
+	}
+}
+
+func TestIpHash(t *testing.T) {
+	target := &Target{TargetStr: "a\nb\nc", Balance: BalanceIpHash}
+	picked := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		ip := "10.0.0." + strconv.Itoa(i)
+		picked[ip], _, _ = target.GetTarget(ip)
+		if addr, _, _ := target.GetTarget(ip); addr != picked[ip] {
+			t.Fatalf("%s moved from %s to %s", ip, picked[ip], addr)
+		}
+	}
+	// 移除一个目标后，只有原先分配到该目标的 ip 改变
+	target.TargetArr = []string{"a", "c"}
+	for ip, old := range picked {
+		if addr, _, _ := target.GetTarget(ip); old != "b" && addr != old {
+			t.Fatalf("%s moved from %s to %s", ip, old, addr)
+		}
+	}
+}
+
+func TestGetTargetExclude(t *testing.T) {
+	target := &Target{TargetStr: "a\nb\nc", Balance: BalanceIpHash}
+	first, _, _ := target.GetTarget("10.0.0.1")
+	second, _, _ := target.GetTarget("10.0.0.1", first)
+	third, _, _ := target.GetTarget("10.0.0.1", first, second)
+	if first == second || second == third || first == third {
+		t.Fatalf("tried target picked again: %s %s %s", first, second, third)
+	}
+	if _, _, err := target.GetTarget("10.0.0.1", "a", "b", "c"); err == nil {
+		t.Fatal("all targets tried, should fail")
+	}
+}
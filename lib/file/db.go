@@ -51,10 +51,16 @@ func notifyGlobalConfigUpdate() {
 func GetDb() *DbUtils {
 	once.Do(func() {
 		jsonDb := NewJsonDb(common.GetRunPath())
-		jsonDb.LoadClientFromJsonFile()
-		jsonDb.LoadTaskFromJsonFile()
-		jsonDb.LoadHostFromJsonFile()
-		jsonDb.LoadGlobalFromJsonFile()
+		store, err := NewStore(jsonDb.RunPath)
+		if err != nil {
+			logs.Error("open db error: %s", err)
+			panic(err)
+		}
+		jsonDb.Store = store
+		if err = jsonDb.LoadFromStore(); err != nil {
+			logs.Error("load db error: %s", err)
+			panic(err)
+		}
 		Db = &DbUtils{JsonDb: jsonDb}
 	})
 	return Db
@@ -72,7 +78,8 @@ func GetMapKeys(m sync.Map, isSort bool, sortKey, order string) (keys []int) {
 	return
 }
 
-func (s *DbUtils) GetClientList(start, length int, search, sort, order string, clientId int) ([]*Client, int) {
+// allow 不为 nil 时只返回 allow 为 true 的客户端
+func (s *DbUtils) GetClientList(start, length int, search, sort, order string, clientId int, allow func(clientId int) bool) ([]*Client, int) {
 	list := make([]*Client, 0)
 	var cnt int
 	keys := GetMapKeys(s.JsonDb.Clients, true, sort, order)
@@ -82,7 +89,7 @@ func (s *DbUtils) GetClientList(start, length int, search, sort, order string, c
 			if v.NoDisplay {
 				continue
 			}
-			if clientId != 0 && clientId != v.Id {
+			if clientId != 0 && clientId != v.Id || allow != nil && !allow(v.Id) {
 				continue
 			}
 			if search != "" && !(v.Id == common.GetIntNoErrByStr(search) || strings.Contains(v.VerifyKey, search) || strings.Contains(v.Remark, search)) {
@@ -213,7 +220,7 @@ func (s *DbUtils) NewHost(t *Host) error {
 	return nil
 }
 
-func (s *DbUtils) GetHost(start, length int, id int, search string) ([]*Host, int) {
+func (s *DbUtils) GetHost(start, length int, id int, search string, allow func(clientId int) bool) ([]*Host, int) {
 	list := make([]*Host, 0)
 	var cnt int
 	keys := GetMapKeys(s.JsonDb.Hosts, false, "", "")
@@ -223,6 +230,9 @@ func (s *DbUtils) GetHost(start, length int, id int, search string) ([]*Host, in
 			if search != "" && !(v.Id == common.GetIntNoErrByStr(search) || strings.Contains(v.Host, search) || strings.Contains(v.Remark, search) || strings.Contains(v.Client.VerifyKey, search)) {
 				continue
 			}
+			if allow != nil && !allow(v.Client.Id) {
+				continue
+			}
 			if id == 0 || v.Client.Id == id {
 				cnt++
 				if start--; start < 0 {
@@ -360,43 +370,9 @@ func (s *DbUtils) GetHostById(id int) (h *Host, err error) {
 
 // get key by host from x
 func (s *DbUtils) GetInfoByHost(host string, r *http.Request) (h *Host, err error) {
-	var hosts []*Host
 	//Handling Ported Access
 	host = common.GetIpByAddr(host)
-	s.JsonDb.Hosts.Range(func(key, value interface{}) bool {
-		v := value.(*Host)
-		if v.IsClose {
-			return true
-		}
-		//Remove http(s) http(s)://a.proxy.com
-		//*.proxy.com *.a.proxy.com  Do some pan-parsing
-		if v.Scheme != "all" && v.Scheme != r.URL.Scheme {
-			return true
-		}
-		tmpHost := v.Host
-		if strings.Contains(tmpHost, "*") {
-			tmpHost = strings.Replace(tmpHost, "*", "", -1)
-			if strings.Contains(host, tmpHost) {
-				hosts = append(hosts, v)
-			}
-		} else if v.Host == host {
-			hosts = append(hosts, v)
-		}
-		return true
-	})
-
-	for _, v := range hosts {
-		//If not set, default matches all
-		if v.Location == "" {
-			v.Location = "/"
-		}
-		if strings.Index(r.RequestURI, v.Location) == 0 {
-			if h == nil || (len(v.Location) > len(h.Location)) {
-				h = v
-			}
-		}
-	}
-	if h != nil {
+	if h = s.JsonDb.getHostIndex().lookup(host, r.URL.Scheme, r.RequestURI); h != nil {
 		return
 	}
 	err = errors.New("The host could not be parsed")
@@ -1,17 +1,14 @@
 package file
 
 import (
-	"encoding/json"
 	"errors"
 	"github.com/astaxie/beego/logs"
-	"os"
 	"path/filepath"
-	"strings"
+	"sort"
 	"sync"
 	"sync/atomic"
 
-	"ehang.io/nps/lib/common"
-	"ehang.io/nps/lib/rate"
+	"ehang.io/nps/lib/iplist"
 )
 
 func NewJsonDb(runPath string) *JsonDb {
@@ -21,6 +18,7 @@ func NewJsonDb(runPath string) *JsonDb {
 		HostFilePath:   filepath.Join(runPath, "conf", "hosts.json"),
 		ClientFilePath: filepath.Join(runPath, "conf", "clients.json"),
 		GlobalFilePath: filepath.Join(runPath, "conf", "global.json"),
+		Store:          NewJsonStore(filepath.Join(runPath, "conf")),
 	}
 }
 
@@ -29,79 +27,88 @@ type JsonDb struct {
 	Hosts            sync.Map
 	HostsTmp         sync.Map
 	Clients          sync.Map
+	Tokens           sync.Map
+	Users            sync.Map
 	Global           *Glob
 	RunPath          string
 	ClientIncreaseId int32  //client increased id
 	TaskIncreaseId   int32  //task increased id
 	HostIncreaseId   int32  //host increased id
+	TokenIncreaseId  int32  //api token increased id
+	UserIncreaseId   int32  //web user increased id
 	TaskFilePath     string //task file path
 	HostFilePath     string //host file path
 	ClientFilePath   string //client file path
 	GlobalFilePath   string //global file path
+	Store            Store  //persistent storage
+	storeLock        sync.Mutex
+	synced           map[string]string // config hash of records at last sync, cluster mode only
+	changedTasks     []int             // tasks changed by other nodes
+	hostIndex        atomic.Value      // *hostIndex, rebuilt when hosts change
 }
 
-func (s *JsonDb) LoadTaskFromJsonFile() {
-	loadSyncMapFromFile(s.TaskFilePath, func(v string) {
-		var err error
-		post := new(Tunnel)
-		if json.Unmarshal([]byte(v), &post) != nil {
-			return
+// LoadFromStore load clients, tasks, hosts and global config from the store
+func (s *JsonDb) LoadFromStore() error {
+	if ss, ok := s.Store.(SharedStore); ok {
+		if err := ss.Lock(); err != nil {
+			return err
+		}
+		defer ss.Unlock()
+	}
+	snap, err := s.Store.Load()
+	if err != nil {
+		return err
+	}
+	s.markSynced(snap)
+	for _, post := range snap.Clients {
+		initClientRate(post)
+		s.Clients.Store(post.Id, post)
+		if post.Id > int(s.ClientIncreaseId) {
+			s.ClientIncreaseId = int32(post.Id)
+		}
+	}
+	for _, post := range snap.Tasks {
+		if post.Client == nil {
+			continue
 		}
 		if post.Client, err = s.GetClient(post.Client.Id); err != nil {
-			return
+			continue
 		}
 		s.Tasks.Store(post.Id, post)
 		if post.Id > int(s.TaskIncreaseId) {
 			s.TaskIncreaseId = int32(post.Id)
 		}
-	})
-}
-
-func (s *JsonDb) LoadClientFromJsonFile() {
-	loadSyncMapFromFile(s.ClientFilePath, func(v string) {
-		post := new(Client)
-		if json.Unmarshal([]byte(v), &post) != nil {
-			return
-		}
-		if post.RateLimit > 0 {
-			post.Rate = rate.NewRate(int64(post.RateLimit * 1024))
-		} else {
-			post.Rate = rate.NewRate(int64(2 << 23))
-		}
-		post.Rate.Start()
-		post.NowConn = 0
-		s.Clients.Store(post.Id, post)
-		if post.Id > int(s.ClientIncreaseId) {
-			s.ClientIncreaseId = int32(post.Id)
-		}
-	})
-}
-
-func (s *JsonDb) LoadHostFromJsonFile() {
-	loadSyncMapFromFile(s.HostFilePath, func(v string) {
-		var err error
-		post := new(Host)
-		if json.Unmarshal([]byte(v), &post) != nil {
-			return
+	}
+	for _, post := range snap.Hosts {
+		if post.Client == nil {
+			continue
 		}
 		if post.Client, err = s.GetClient(post.Client.Id); err != nil {
-			return
+			continue
 		}
 		s.Hosts.Store(post.Id, post)
 		if post.Id > int(s.HostIncreaseId) {
 			s.HostIncreaseId = int32(post.Id)
 		}
-	})
-}
-
-func (s *JsonDb) LoadGlobalFromJsonFile() {
-	loadSyncMapFromFileWithSingleJson(s.GlobalFilePath, func(v string) {
-		post := new(Glob)
-		if json.Unmarshal([]byte(v), &post) != nil {
-			return
+	}
+	for _, post := range snap.Tokens {
+		s.Tokens.Store(post.Id, post)
+		if post.Id > int(s.TokenIncreaseId) {
+			s.TokenIncreaseId = int32(post.Id)
 		}
-		s.Global = post
-	})
+	}
+	for _, post := range snap.Users {
+		s.Users.Store(post.Id, post)
+		if post.Id > int(s.UserIncreaseId) {
+			s.UserIncreaseId = int32(post.Id)
+		}
+	}
+	if snap.Global != nil {
+		s.Global = snap.Global
+	}
+	s.RebuildHostIndex()
+	iplist.Invalidate()
+	return nil
 }
 
 func (s *JsonDb) GetClient(id int) (c *Client, err error) {
@@ -113,148 +120,147 @@ func (s *JsonDb) GetClient(id int) (c *Client, err error) {
 	return
 }
 
-var hostLock sync.Mutex
-
 func (s *JsonDb) StoreHostToJsonFile() {
-	hostLock.Lock()
-	storeSyncMapToFile(s.Hosts, s.HostFilePath)
-	hostLock.Unlock()
+	s.RebuildHostIndex()
+	s.Flush()
 }
 
-var taskLock sync.Mutex
+// RebuildHostIndex 重新编译域名路由索引，域名的 host、location 修改后需要调用
+func (s *JsonDb) RebuildHostIndex() {
+	var hosts []*Host
+	s.Hosts.Range(func(key, value interface{}) bool {
+		hosts = append(hosts, value.(*Host))
+		return true
+	})
+	s.hostIndex.Store(newHostIndex(hosts))
+}
 
-func (s *JsonDb) StoreTasksToJsonFile() {
-	taskLock.Lock()
-	storeSyncMapToFile(s.Tasks, s.TaskFilePath)
-	taskLock.Unlock()
+func (s *JsonDb) getHostIndex() *hostIndex {
+	if idx, ok := s.hostIndex.Load().(*hostIndex); ok {
+		return idx
+	}
+	s.RebuildHostIndex()
+	return s.hostIndex.Load().(*hostIndex)
 }
 
-var clientLock sync.Mutex
+func (s *JsonDb) StoreTasksToJsonFile() {
+	s.Flush()
+}
 
 func (s *JsonDb) StoreClientsToJsonFile() {
-	clientLock.Lock()
-	storeSyncMapToFile(s.Clients, s.ClientFilePath)
-	clientLock.Unlock()
+	s.Flush()
 }
 
-var globalLock sync.Mutex
-
 func (s *JsonDb) StoreGlobalToJsonFile() {
-	globalLock.Lock()
-	storeGlobalToFile(s.Global, s.GlobalFilePath)
-	globalLock.Unlock()
+	s.Flush()
+}
+
+// Flush write clients, tasks, hosts and global config to the store in one transaction
+func (s *JsonDb) Flush() {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+	// 保存前名单可能已经被原地修改
+	iplist.Invalidate()
+	if ss, ok := s.Store.(SharedStore); ok {
+		if err := ss.Lock(); err != nil {
+			logs.Error(err, "lock shared store err, data will lost")
+			return
+		}
+		defer ss.Unlock()
+		// 其他节点已经提交了新数据，先合并再写入
+		if ss.Changed() {
+			if err := s.reload(ss); err != nil {
+				logs.Error(err, "reload shared store err")
+			}
+		}
+	}
+	snap := s.snapshot()
+	if err := s.Store.Save(snap); err != nil {
+		logs.Error(err, "store to file err, data will lost")
+		return
+	}
+	s.markSynced(snap)
+}
+
+func (s *JsonDb) snapshot() *Snapshot {
+	snap := &Snapshot{Global: s.Global}
+	s.Clients.Range(func(key, value interface{}) bool {
+		if v := value.(*Client); !v.NoStore {
+			snap.Clients = append(snap.Clients, v)
+		}
+		return true
+	})
+	s.Tasks.Range(func(key, value interface{}) bool {
+		if v := value.(*Tunnel); !v.NoStore {
+			snap.Tasks = append(snap.Tasks, v)
+		}
+		return true
+	})
+	s.Hosts.Range(func(key, value interface{}) bool {
+		if v := value.(*Host); !v.NoStore {
+			snap.Hosts = append(snap.Hosts, v)
+		}
+		return true
+	})
+	s.Tokens.Range(func(key, value interface{}) bool {
+		snap.Tokens = append(snap.Tokens, value.(*ApiToken))
+		return true
+	})
+	s.Users.Range(func(key, value interface{}) bool {
+		snap.Users = append(snap.Users, value.(*User))
+		return true
+	})
+	sort.Slice(snap.Clients, func(i, j int) bool { return snap.Clients[i].Id < snap.Clients[j].Id })
+	sort.Slice(snap.Tasks, func(i, j int) bool { return snap.Tasks[i].Id < snap.Tasks[j].Id })
+	sort.Slice(snap.Hosts, func(i, j int) bool { return snap.Hosts[i].Id < snap.Hosts[j].Id })
+	sort.Slice(snap.Tokens, func(i, j int) bool { return snap.Tokens[i].Id < snap.Tokens[j].Id })
+	sort.Slice(snap.Users, func(i, j int) bool { return snap.Users[i].Id < snap.Users[j].Id })
+	return snap
 }
 
 func (s *JsonDb) GetClientId() int32 {
-	return atomic.AddInt32(&s.ClientIncreaseId, 1)
+	return s.nextId("client", &s.ClientIncreaseId)
 }
 
 func (s *JsonDb) GetTaskId() int32 {
-	return atomic.AddInt32(&s.TaskIncreaseId, 1)
+	return s.nextId("task", &s.TaskIncreaseId)
 }
 
 func (s *JsonDb) GetHostId() int32 {
-	return atomic.AddInt32(&s.HostIncreaseId, 1)
+	return s.nextId("host", &s.HostIncreaseId)
 }
 
-func loadSyncMapFromFile(filePath string, f func(value string)) {
-	b, err := common.ReadAllFromFile(filePath)
-	if err != nil {
-		panic(err)
-	}
-	for _, v := range strings.Split(string(b), "\n"+common.CONN_DATA_SEQ) {
-		f(v)
-	}
+func (s *JsonDb) GetTokenId() int32 {
+	return s.nextId("token", &s.TokenIncreaseId)
 }
 
-func loadSyncMapFromFileWithSingleJson(filePath string, f func(value string)) {
-	if !common.FileExists(filePath) {
-		return
-	}
-
-	b, err := common.ReadAllFromFile(filePath)
-	if err != nil {
-		panic(err)
-	}
-
-	f(string(b))
+func (s *JsonDb) GetUserId() int32 {
+	return s.nextId("user", &s.UserIncreaseId)
 }
 
-func storeSyncMapToFile(m sync.Map, filePath string) {
-	file, err := os.Create(filePath + ".tmp")
-	// first create a temporary file to store
-	if err != nil {
-		panic(err)
+// nextId 集群模式下在持有存储锁时分配 id 并写入共享存储，避免两个节点分配到相同的 id
+func (s *JsonDb) nextId(kind string, counter *int32) int32 {
+	ss, ok := s.Store.(SharedStore)
+	if !ok {
+		return atomic.AddInt32(counter, 1)
 	}
-	m.Range(func(key, value interface{}) bool {
-		var b []byte
-		var err error
-		switch value.(type) {
-		case *Tunnel:
-			obj := value.(*Tunnel)
-			if obj.NoStore {
-				return true
-			}
-			b, err = json.Marshal(obj)
-		case *Host:
-			obj := value.(*Host)
-			if obj.NoStore {
-				return true
-			}
-			b, err = json.Marshal(obj)
-		case *Client:
-			obj := value.(*Client)
-			if obj.NoStore {
-				return true
-			}
-			b, err = json.Marshal(obj)
-		//case *Glob:
-		//	obj := value.(*Glob)
-		//	b, err = json.Marshal(obj)
-		default:
-			return true
-		}
-		if err != nil {
-			return true
-		}
-		_, err = file.Write(b)
-		if err != nil {
-			panic(err)
-		}
-		_, err = file.Write([]byte("\n" + common.CONN_DATA_SEQ))
-		if err != nil {
-			panic(err)
-		}
-		return true
-	})
-	_ = file.Sync()
-	_ = file.Close()
-	// must close file first, then rename it
-	err = os.Rename(filePath+".tmp", filePath)
-	if err != nil {
-		logs.Error(err, "store to file err, data will lost")
-	}
-	// replace the file, maybe provides atomic operation
-}
-
-func storeGlobalToFile(m *Glob, filePath string) {
-	file, err := os.Create(filePath + ".tmp")
-	// first create a temporary file to store
-	if err != nil {
-		panic(err)
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+	if err := ss.Lock(); err != nil {
+		logs.Error("lock store to allocate %s id error %s", kind, err)
+		return atomic.AddInt32(counter, 1)
 	}
-
-	var b []byte
-	b, err = json.Marshal(m)
-	_, err = file.Write(b)
-	if err != nil {
-		panic(err)
+	defer ss.Unlock()
+	if ss.Changed() {
+		if err := s.reload(ss); err != nil {
+			logs.Warn("sync store error %s", err)
+		}
 	}
-	_ = file.Sync()
-	_ = file.Close()
-	// must close file first, then rename it
-	err = os.Rename(filePath+".tmp", filePath)
+	id, err := ss.ReserveId(kind, atomic.LoadInt32(counter))
 	if err != nil {
-		logs.Error(err, "store to file err, data will lost")
+		logs.Error("reserve %s id error %s", kind, err)
+		return atomic.AddInt32(counter, 1)
 	}
+	atomic.StoreInt32(counter, id)
+	return id
 }
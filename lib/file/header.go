@@ -0,0 +1,167 @@
+package file
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 头部规则作用的阶段
+const (
+	HeaderRequest  = "request"
+	HeaderResponse = "response"
+)
+
+// 头部规则的操作
+const (
+	HeaderAdd    = "add"
+	HeaderSet    = "set"
+	HeaderRemove = "remove"
+	HeaderAppend = "append"
+)
+
+// HeaderRule 是域名的一条请求头或者响应头规则，每行一条，格式为
+//
+//	request|response add|set|remove|append 名称 [值]
+//
+// 值中可以使用 ${remote_ip}、${host}、${scheme}、${client_id}
+type HeaderRule struct {
+	Phase string
+	Op    string
+	Name  string
+	Value string
+}
+
+// ParseHeaderRules 解析头部规则，空行和 # 开头的行会被忽略
+func ParseHeaderRules(str string) ([]*HeaderRule, error) {
+	var rules []*HeaderRule
+	for n, line := range strings.Split(str, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseHeaderRule(line)
+		if err != nil {
+			return nil, errors.Errorf("header rule line %d: %s", n+1, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseHeaderRule(line string) (*HeaderRule, error) {
+	idx := fieldRe.FindAllStringIndex(line, 4)
+	if len(idx) < 3 {
+		return nil, errors.New("missing operation or name")
+	}
+	r := &HeaderRule{Phase: line[idx[0][0]:idx[0][1]], Op: line[idx[1][0]:idx[1][1]],
+		Name: http.CanonicalHeaderKey(line[idx[2][0]:idx[2][1]])}
+	if r.Phase != HeaderRequest && r.Phase != HeaderResponse {
+		return nil, errors.New("unknown phase " + r.Phase)
+	}
+	if len(idx) > 3 {
+		// 值保留原来的空格
+		r.Value = line[idx[3][0]:]
+	}
+	switch r.Op {
+	case HeaderRemove:
+		if r.Value != "" {
+			return nil, errors.New("remove takes no value")
+		}
+	case HeaderAdd, HeaderSet, HeaderAppend:
+		if r.Value == "" {
+			return nil, errors.New("missing value of " + r.Name)
+		}
+	default:
+		return nil, errors.New("unknown operation " + r.Op)
+	}
+	if strings.ContainsAny(r.Name, ":\r\n") {
+		return nil, errors.New("invalid header name " + r.Name)
+	}
+	return r, nil
+}
+
+// HeaderVars 是头部规则中可以使用的变量
+type HeaderVars struct {
+	RemoteIp string
+	Host     string
+	Scheme   string
+	ClientId int
+}
+
+var headerVarRe = regexp.MustCompile(`\$\{(\w+)\}`)
+
+func (v *HeaderVars) expand(s string) string {
+	return headerVarRe.ReplaceAllStringFunc(s, func(m string) string {
+		switch m[2 : len(m)-1] {
+		case "remote_ip":
+			return v.RemoteIp
+		case "host":
+			return v.Host
+		case "scheme":
+			return v.Scheme
+		case "client_id":
+			return strconv.Itoa(v.ClientId)
+		}
+		// 未知的变量原样保留
+		return m
+	})
+}
+
+// Apply 按顺序对 h 执行规则，append 在已有的值后面用逗号追加，不存在时等同于 set
+func (r *HeaderRule) Apply(h http.Header, vars *HeaderVars) {
+	switch r.Op {
+	case HeaderRemove:
+		h.Del(r.Name)
+	case HeaderAdd:
+		h.Add(r.Name, vars.expand(r.Value))
+	case HeaderSet:
+		h.Set(r.Name, vars.expand(r.Value))
+	case HeaderAppend:
+		if old := h.Get(r.Name); old != "" {
+			h.Set(r.Name, old+", "+vars.expand(r.Value))
+		} else {
+			h.Set(r.Name, vars.expand(r.Value))
+		}
+	}
+}
+
+// HasHeaderRules 判断域名是否有某个阶段的头部规则
+func (s *Host) HasHeaderRules(phase string) bool {
+	for _, r := range s.getHeaderRules() {
+		if r.Phase == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyHeaderRules 对请求头或者响应头执行域名中对应阶段的规则
+func (s *Host) ApplyHeaderRules(phase string, h http.Header, vars *HeaderVars) {
+	for _, r := range s.getHeaderRules() {
+		if r.Phase == phase {
+			r.Apply(h, vars)
+		}
+	}
+}
+
+func (s *Host) getHeaderRules() []*HeaderRule {
+	s.RLock()
+	rules, str := s.headerRules, s.HeaderRules
+	ok := s.headerRulesStr == str
+	s.RUnlock()
+	if str == "" {
+		return nil
+	}
+	if ok {
+		return rules
+	}
+	rules, _ = ParseHeaderRules(str)
+	s.Lock()
+	s.headerRules, s.headerRulesStr = rules, str
+	s.Unlock()
+	return rules
+}
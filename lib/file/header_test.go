@@ -0,0 +1,40 @@
+package file
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	h := &Host{Client: &Client{Id: 3}, HeaderRules: `
+# 注释
+request set X-Real-IP ${remote_ip}
+request append x-forwarded-proto ${scheme}
+request remove Cookie
+response set Content-Security-Policy default-src 'self'  'unsafe-inline'
+response add X-Client ${client_id}-${host}-${unknown}
+`}
+	vars := &HeaderVars{RemoteIp: "10.0.0.1", Host: "a.com", Scheme: "https", ClientId: 3}
+	req := http.Header{"Cookie": {"a=1"}, "X-Forwarded-Proto": {"http"}}
+	h.ApplyHeaderRules(HeaderRequest, req, vars)
+	if req.Get("X-Real-Ip") != "10.0.0.1" || req.Get("X-Forwarded-Proto") != "http, https" || req.Get("Cookie") != "" {
+		t.Fatalf("unexpected request header %v", req)
+	}
+	resp := http.Header{}
+	h.ApplyHeaderRules(HeaderResponse, resp, vars)
+	if resp.Get("Content-Security-Policy") != "default-src 'self'  'unsafe-inline'" || resp.Get("X-Client") != "3-a.com-${unknown}" {
+		t.Fatalf("unexpected response header %v", resp)
+	}
+	if !h.HasHeaderRules(HeaderResponse) {
+		t.Fatal("response rules not found")
+	}
+	h.HeaderRules = ""
+	if h.HasHeaderRules(HeaderRequest) {
+		t.Fatal("rules cleared")
+	}
+	for _, s := range []string{"request set X-A", "request remove X-A 1", "both set X-A 1", "request put X-A 1", "request set X-A:b 1"} {
+		if _, err := ParseHeaderRules(s); err == nil {
+			t.Fatalf("%s should be invalid", s)
+		}
+	}
+}
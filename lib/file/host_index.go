@@ -0,0 +1,153 @@
+package file
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// hostIndex 是按域名编译好的路由索引，域名增删改后整体重建并原子替换
+//
+// 精确域名使用 map，*.a.com 这样的泛域名按标签倒序放进后缀树，其他带 * 的写法按通配符逐个匹配
+type hostIndex struct {
+	exact    map[string][]hostLocation
+	wildcard *hostNode
+	patterns []hostPattern
+}
+
+// hostLocation 是同一域名下的一条记录，按 location 从长到短排序
+type hostLocation struct {
+	location string
+	host     *Host
+}
+
+type hostNode struct {
+	children map[string]*hostNode
+	hosts    []hostLocation // 以当前节点为后缀的泛域名记录
+}
+
+type hostPattern struct {
+	pattern string
+	hosts   []hostLocation
+}
+
+// normalizeHost 域名不区分大小写，并去掉末尾的点
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func newHostIndex(hosts []*Host) *hostIndex {
+	idx := &hostIndex{exact: make(map[string][]hostLocation), wildcard: &hostNode{}}
+	patterns := make(map[string]int)
+	for _, v := range hosts {
+		loc := hostLocation{location: v.Location, host: v}
+		if loc.location == "" {
+			loc.location = "/"
+		}
+		name := normalizeHost(v.Host)
+		switch {
+		case name == "*":
+			idx.wildcard.hosts = append(idx.wildcard.hosts, loc)
+		case strings.HasPrefix(name, "*.") && !strings.Contains(name[2:], "*"):
+			node := idx.wildcard
+			labels := strings.Split(name[2:], ".")
+			for i := len(labels) - 1; i >= 0; i-- {
+				if node.children == nil {
+					node.children = make(map[string]*hostNode)
+				}
+				next, ok := node.children[labels[i]]
+				if !ok {
+					next = &hostNode{}
+					node.children[labels[i]] = next
+				}
+				node = next
+			}
+			node.hosts = append(node.hosts, loc)
+		case strings.Contains(name, "*"):
+			i, ok := patterns[name]
+			if !ok {
+				i = len(idx.patterns)
+				patterns[name] = i
+				idx.patterns = append(idx.patterns, hostPattern{pattern: name})
+			}
+			idx.patterns[i].hosts = append(idx.patterns[i].hosts, loc)
+		default:
+			idx.exact[name] = append(idx.exact[name], loc)
+		}
+	}
+	for _, list := range idx.exact {
+		sortLocations(list)
+	}
+	idx.wildcard.sort()
+	for _, p := range idx.patterns {
+		sortLocations(p.hosts)
+	}
+	return idx
+}
+
+func (n *hostNode) sort() {
+	sortLocations(n.hosts)
+	for _, c := range n.children {
+		c.sort()
+	}
+}
+
+func sortLocations(list []hostLocation) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if len(list[i].location) != len(list[j].location) {
+			return len(list[i].location) > len(list[j].location)
+		}
+		return list[i].host.Id < list[j].host.Id
+	})
+}
+
+// lookup 返回 location 最长的匹配记录，长度相同时精确域名优先，其次是更具体的泛域名
+func (idx *hostIndex) lookup(host, scheme, uri string) *Host {
+	host = normalizeHost(host)
+	var best *hostLocation
+	match := func(list []hostLocation) {
+		for i := range list {
+			v := &list[i]
+			if best != nil && len(v.location) <= len(best.location) {
+				return
+			}
+			if v.host.IsClose || (v.host.Scheme != "all" && v.host.Scheme != scheme) {
+				continue
+			}
+			if strings.HasPrefix(uri, v.location) {
+				best = v
+				return
+			}
+		}
+	}
+	match(idx.exact[host])
+	// *.a.com 只匹配 a.com 下至少多一级的域名，不匹配 a.com 本身
+	nodes := []*hostNode{idx.wildcard}
+	node := idx.wildcard
+	for rest := host; rest != "" && node != nil; {
+		label := rest
+		if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+			label, rest = rest[i+1:], rest[:i]
+		} else {
+			rest = ""
+		}
+		if rest == "" {
+			break
+		}
+		if node = node.children[label]; node != nil {
+			nodes = append(nodes, node)
+		}
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		match(nodes[i].hosts)
+	}
+	for _, p := range idx.patterns {
+		if ok, _ := path.Match(p.pattern, host); ok {
+			match(p.hosts)
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.host
+}
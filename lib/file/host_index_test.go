@@ -0,0 +1,38 @@
+package file
+
+import "testing"
+
+func TestHostIndex(t *testing.T) {
+	hosts := []*Host{
+		{Id: 1, Host: "a.com", Location: "/", Scheme: "all"},
+		{Id: 2, Host: "a.com", Location: "/api", Scheme: "all"},
+		{Id: 3, Host: "*.a.com", Location: "/", Scheme: "all"},
+		{Id: 4, Host: "*.b.a.com", Location: "/", Scheme: "https"},
+		{Id: 5, Host: "*.a.com", Location: "/static", Scheme: "all"},
+		{Id: 6, Host: "x.*.c.com", Location: "", Scheme: "all"},
+		{Id: 7, Host: "closed.com", Scheme: "all", IsClose: true},
+	}
+	idx := newHostIndex(hosts)
+	cases := []struct {
+		host, scheme, uri string
+		id                int
+	}{
+		{"a.com", "http", "/", 1},
+		{"A.com.", "http", "/api/v1", 2},
+		{"x.a.com", "http", "/", 3},
+		{"y.x.a.com", "http", "/static/1.js", 5},
+		{"x.b.a.com", "https", "/", 4},
+		{"x.b.a.com", "http", "/", 3},
+		{"b.a.com", "https", "/", 3},
+		{"x.y.c.com", "http", "/", 6},
+		{"evil-a.com.example", "http", "/", 0},
+		{"evila.com", "http", "/", 0},
+		{"closed.com", "http", "/", 0},
+	}
+	for _, c := range cases {
+		h := idx.lookup(c.host, c.scheme, c.uri)
+		if (h == nil && c.id != 0) || (h != nil && h.Id != c.id) {
+			t.Fatalf("lookup %s%s want %d got %+v", c.host, c.uri, c.id, h)
+		}
+	}
+}
@@ -1,8 +1,23 @@
 package file
 
+import "ehang.io/nps/lib/iplist"
+
 // global settings
 type Glob struct {
-	BlackIpList    []string `json:"black_ip_list"`   // 全局黑名单IP列表
-	WhiteIpList    []string `json:"white_ip_list"`   // 全局白名单IP列表
-	GlobalPassword string   `json:"global_password"` // 全局访问密码
+	BlackIpList    []string `json:"black_ip_list"`        // 全局黑名单IP列表
+	WhiteIpList    []string `json:"white_ip_list"`        // 全局白名单IP列表
+	GlobalPassword string   `json:"global_password"`      // 全局访问密码
+	AdminTotp      *Totp    `json:"admin_totp,omitempty"` // 管理员的两步验证
+	blackIps       iplist.Cache
+	whiteIps       iplist.Cache
+}
+
+// BlackIp 返回全局黑名单中包含 addr 的记录
+func (g *Glob) BlackIp(addr string) *iplist.Entry {
+	return g.blackIps.Get(g.BlackIpList).Lookup(addr)
+}
+
+// WhiteIp 返回全局白名单中包含 addr 的记录
+func (g *Glob) WhiteIp(addr string) *iplist.Entry {
+	return g.whiteIps.Get(g.WhiteIpList).Lookup(addr)
 }
@@ -1,11 +1,11 @@
 package file
 
 import (
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"ehang.io/nps/lib/iplist"
 	"ehang.io/nps/lib/rate"
 	"github.com/pkg/errors"
 )
@@ -48,12 +48,14 @@ type Client struct {
 	NowConn         int32      //the connection num of now
 	WebUserName     string     //the username of web login
 	WebPassword     string     //the password of web login
+	Totp            *Totp      //two-factor authentication of web login, nil when disabled
 	ConfigConnAllow bool       //is allow connected by config file
 	MaxTunnelNum    int
 	Version         string
 	BlackIpList     []string
 	CreateTime      string
 	LastOnlineTime  string
+	blackIps        iplist.Cache
 	sync.RWMutex
 }
 
@@ -75,6 +77,11 @@ func NewClient(vKey string, noStore bool, noDisplay bool) *Client {
 	}
 }
 
+// BlackIp 返回客户端黑名单中包含 addr 的记录
+func (s *Client) BlackIp(addr string) *iplist.Entry {
+	return s.blackIps.Get(s.BlackIpList).Lookup(addr)
+}
+
 func (s *Client) CutConn() {
 	atomic.AddInt32(&s.NowConn, 1)
 }
@@ -156,6 +163,7 @@ type Tunnel struct {
 	MultiAccount *MultiAccount
 	Health
 	BypassGlobalPassword bool `json:"bypass_global_password"` // 是否绕过全局密码验证
+	Acl
 	sync.RWMutex
 }
 
@@ -169,6 +177,7 @@ type Health struct {
 	HealthRemoveArr     []string
 	HealthCheckType     string
 	HealthCheckTarget   string
+	HealthGrpcService   string // grpc 健康检查的服务名，为空时检查整个服务
 	sync.RWMutex
 }
 
@@ -184,42 +193,57 @@ type Host struct {
 	KeyFilePath          string
 	NoStore              bool
 	IsClose              bool
-	AutoHttps            bool // 自动https
+	AutoHttps            bool   // 自动https
+	AutoCert             bool   // 通过 ACME 自动申请证书
+	CertExpire           int64  // 自动证书的到期时间
+	CertStatus           string // 自动证书的申请状态
 	Flow                 *Flow
 	Client               *Client
 	Target               *Target //目标
+	Routes               string  // 路由表，每行一条
+	routes               []*Route
+	routesStr            string // 解析 routes 时的路由表和目标，修改后重新解析
+	routesTarget         *Target
+	HeaderRules          string // 请求头和响应头规则，每行一条
+	TargetProto          string // 到目标使用的协议，grpc 需要 h2c 或者 h2
+	headerRules          []*HeaderRule
+	headerRulesStr       string
 	Health               `json:"-"`
 	BypassGlobalPassword bool `json:"bypass_global_password"` // 是否绕过全局密码验证
+	Acl
 	sync.RWMutex
 }
 
+// 域名到目标使用的协议
+const (
+	TargetProtoHttp = ""    // http/1.1
+	TargetProtoH2c  = "h2c" // 明文的 http/2
+	TargetProtoH2   = "h2"  // tls 上的 http/2，不校验目标的证书
+)
+
+// CheckTargetProto 检查域名到目标使用的协议
+func CheckTargetProto(proto string) error {
+	switch proto {
+	case TargetProtoHttp, TargetProtoH2c, TargetProtoH2:
+		return nil
+	}
+	return errors.New("unknown target proto " + proto)
+}
+
 type Target struct {
 	nowIndex   int
-	TargetStr  string
-	TargetArr  []string
+	TargetStr  string   // 每行一个目标，可以用 addr@weight 指定权重
+	TargetArr  []string // 当前可用的目标地址，健康检查失败的目标会被移除
+	Balance    string   // 负载均衡策略，为空时轮询
 	LocalProxy bool
+	weights    map[string]int
+	current    map[string]int   // 平滑加权轮询的当前权重
+	conns      map[string]int64 // 各目标正在处理的连接数
+	outliers   map[string]*outlier
+	down       map[string]bool // 主动健康检查失败的目标
 	sync.RWMutex
 }
 
 type MultiAccount struct {
 	AccountMap map[string]string // multi account and pwd
 }
-
-func (s *Target) GetRandomTarget() (string, error) {
-	if s.TargetArr == nil {
-		s.TargetArr = strings.Split(s.TargetStr, "\n")
-	}
-	if len(s.TargetArr) == 1 {
-		return s.TargetArr[0], nil
-	}
-	if len(s.TargetArr) == 0 {
-		return "", errors.New("all inward-bending targets are offline")
-	}
-	s.Lock()
-	defer s.Unlock()
-	if s.nowIndex >= len(s.TargetArr)-1 {
-		s.nowIndex = -1
-	}
-	s.nowIndex++
-	return s.TargetArr[s.nowIndex], nil
-}
@@ -0,0 +1,160 @@
+package file
+
+import (
+	"sort"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// 被动健康检查：目标连续失败达到 OutlierMaxFails 次后从 TargetArr 中移除，最后一个可用的目标不会被移除。
+// 移除时间到期后重新加入并处于半开放状态，半开放时成功一次即恢复，失败一次则再次移除，移除时间加倍
+var (
+	OutlierMaxFails     = 5 // 为 0 时关闭
+	OutlierEjectTime    = 30 * time.Second
+	OutlierMaxEjectTime = 5 * time.Minute
+)
+
+type outlier struct {
+	fails     int       // 连续失败次数
+	ejections int       // 连续被移除的次数，用于计算移除时间
+	until     time.Time // 移除到期时间，为零表示未被移除
+	halfOpen  bool
+}
+
+// Ejection 是被被动健康检查移除的目标
+type Ejection struct {
+	Addr      string `json:"addr"`
+	Until     int64  `json:"until"` // 重新加入的时间，unix 秒
+	Ejections int    `json:"ejections"`
+}
+
+func (s *Target) outlier(addr string) *outlier {
+	if s.outliers == nil {
+		s.outliers = make(map[string]*outlier)
+	}
+	o, ok := s.outliers[addr]
+	if !ok {
+		o = new(outlier)
+		s.outliers[addr] = o
+	}
+	return o
+}
+
+func (s *Target) removeAddr(addr string) {
+	if s.TargetArr == nil {
+		s.TargetArr = s.Addrs()
+	}
+	for i, v := range s.TargetArr {
+		if v == addr {
+			s.TargetArr = append(s.TargetArr[:i:i], s.TargetArr[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Target) addAddr(addr string) {
+	for _, v := range s.TargetArr {
+		if v == addr {
+			return
+		}
+	}
+	s.TargetArr = append(s.TargetArr, addr)
+}
+
+// Report 记录一次连接目标的结果，ok 为 false 表示连接失败或者返回了 5xx
+func (s *Target) Report(addr string, ok bool) {
+	if OutlierMaxFails <= 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.weight(addr); s.weights[addr] == 0 {
+		return
+	}
+	o := s.outlier(addr)
+	if !o.until.IsZero() {
+		return
+	}
+	if ok {
+		if o.halfOpen {
+			logs.Info("target %s recovered", addr)
+		}
+		o.fails, o.ejections, o.halfOpen = 0, 0, false
+		return
+	}
+	o.fails++
+	if !o.halfOpen && o.fails < OutlierMaxFails {
+		return
+	}
+	if s.TargetArr == nil {
+		s.TargetArr = s.Addrs()
+	}
+	if len(s.TargetArr) == 1 && s.TargetArr[0] == addr {
+		// 不移除最后一个可用的目标
+		o.fails = 0
+		return
+	}
+	eject := OutlierEjectTime << uint(o.ejections)
+	if eject > OutlierMaxEjectTime || eject <= 0 {
+		eject = OutlierMaxEjectTime
+	}
+	o.ejections++
+	o.fails, o.halfOpen = 0, false
+	o.until = time.Now().Add(eject)
+	s.removeAddr(addr)
+	logs.Warn("target %s failed %d times, ejected for %s", addr, OutlierMaxFails, eject)
+}
+
+// restoreEjected 将到期的目标以半开放状态重新加入，主动健康检查失败的目标除外
+func (s *Target) restoreEjected() {
+	now := time.Now()
+	for addr, o := range s.outliers {
+		if o.until.IsZero() || now.Before(o.until) {
+			continue
+		}
+		o.until, o.halfOpen = time.Time{}, true
+		if !s.down[addr] {
+			s.addAddr(addr)
+		}
+	}
+}
+
+// HealthDown 主动健康检查失败时移除目标
+func (s *Target) HealthDown(addr string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.down == nil {
+		s.down = make(map[string]bool)
+	}
+	s.down[addr] = true
+	s.removeAddr(addr)
+}
+
+// HealthUp 主动健康检查恢复时重新加入目标，被动健康检查移除的目标到期后再加入
+func (s *Target) HealthUp(addr string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.down, addr)
+	if o, ok := s.outliers[addr]; ok && !o.until.IsZero() {
+		return
+	}
+	if s.TargetArr != nil {
+		s.addAddr(addr)
+	}
+}
+
+// Ejections 返回当前被被动健康检查移除的目标
+func (s *Target) Ejections() []*Ejection {
+	s.RLock()
+	defer s.RUnlock()
+	list := make([]*Ejection, 0)
+	now := time.Now()
+	for addr, o := range s.outliers {
+		if now.Before(o.until) {
+			list = append(list, &Ejection{Addr: addr, Until: o.until.Unix(), Ejections: o.ejections})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
@@ -0,0 +1,60 @@
+package file
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutlierEject(t *testing.T) {
+	defer func(n int, e, m time.Duration) {
+		OutlierMaxFails, OutlierEjectTime, OutlierMaxEjectTime = n, e, m
+	}(OutlierMaxFails, OutlierEjectTime, OutlierMaxEjectTime)
+	OutlierMaxFails, OutlierEjectTime, OutlierMaxEjectTime = 2, time.Minute, 3*time.Minute
+	target := &Target{TargetStr: "a\nb"}
+	target.Report("a", false)
+	target.Report("a", true)
+	target.Report("a", false)
+	if len(target.Ejections()) != 0 {
+		t.Fatal("success should reset the failures")
+	}
+	target.Report("a", false)
+	if e := target.Ejections(); len(e) != 1 || e[0].Addr != "a" {
+		t.Fatalf("a should be ejected, got %v", e)
+	}
+	for i := 0; i < 3; i++ {
+		if addr, _, _ := target.GetTarget(""); addr != "b" {
+			t.Fatalf("ejected target %s picked", addr)
+		}
+	}
+	// 最后一个可用的目标不会被移除
+	target.Report("b", false)
+	target.Report("b", false)
+	if len(target.TargetArr) != 1 {
+		t.Fatalf("last target removed, got %v", target.TargetArr)
+	}
+
+	// 到期后半开放，失败一次即再次移除，时间加倍
+	target.outliers["a"].until = time.Now().Add(-time.Second)
+	target.GetTarget("")
+	if len(target.TargetArr) != 2 || len(target.Ejections()) != 0 {
+		t.Fatalf("a should be restored, got %v", target.TargetArr)
+	}
+	target.Report("a", false)
+	e := target.Ejections()
+	if len(e) != 1 || e[0].Ejections != 2 || time.Until(time.Unix(e[0].Until, 0)) < time.Minute {
+		t.Fatalf("a should be ejected for two minutes, got %+v", e)
+	}
+
+	// 主动健康检查失败的目标到期后也不会加入
+	target.HealthDown("a")
+	target.outliers["a"].until = time.Now().Add(-time.Second)
+	target.GetTarget("")
+	if len(target.TargetArr) != 1 {
+		t.Fatalf("a is down, got %v", target.TargetArr)
+	}
+	target.HealthUp("a")
+	target.Report("a", true)
+	if len(target.TargetArr) != 2 || target.outliers["a"].ejections != 0 {
+		t.Fatalf("a should be recovered, got %v", target.TargetArr)
+	}
+}
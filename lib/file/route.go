@@ -0,0 +1,300 @@
+package file
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 路由的匹配方式
+const (
+	RouteExact  = "exact"
+	RoutePrefix = "prefix"
+	RouteRegex  = "regex"
+)
+
+// 路由的动作
+const (
+	RouteProxy    = "proxy"
+	RouteRedirect = "redirect"
+	RouteResponse = "response"
+)
+
+// Route 是域名路由表中的一条路由，每行一条，格式为
+//
+//	匹配方式 路径 [method=GET,POST] [header=名称:值] [priority=10] 动作 [参数]
+//
+// 动作为 proxy [目标,目标] [strip=前缀] [rewrite=路径]、redirect 地址 [code=302] 或者 response 状态码 [内容]
+type Route struct {
+	Match    string
+	Path     string
+	Priority int               // 大的优先，相同时 exact、regex、prefix 依次优先，前缀长的优先
+	Methods  []string          // 为空时不限制
+	Headers  map[string]string // 请求头条件，值为空时只要求存在
+	Action   string
+	Target   *Target // proxy 的目标，为 nil 时使用域名的目标
+	Strip    string
+	Rewrite  string // regex 时可以用 $1 引用分组，prefix 时替换匹配的前缀
+	Redirect string
+	Code     int // redirect、response 的状态码
+	Body     string
+	re       *regexp.Regexp
+}
+
+func (r *Route) rank() int {
+	switch r.Match {
+	case RouteExact:
+		return 2
+	case RouteRegex:
+		return 1
+	}
+	return 0
+}
+
+// ParseRoutes 解析路由表，base 为域名的目标，路由的目标使用相同的负载均衡策略
+func ParseRoutes(str string, base *Target) ([]*Route, error) {
+	var routes []*Route
+	for n, line := range strings.Split(str, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRoute(line, base)
+		if err != nil {
+			return nil, errors.Errorf("route line %d: %s", n+1, err)
+		}
+		routes = append(routes, r)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if a.rank() != b.rank() {
+			return a.rank() > b.rank()
+		}
+		return a.Match == RoutePrefix && len(a.Path) > len(b.Path)
+	})
+	return routes, nil
+}
+
+var fieldRe = regexp.MustCompile(`\S+`)
+
+func parseRoute(line string, base *Target) (*Route, error) {
+	idx := fieldRe.FindAllStringIndex(line, -1)
+	f := make([]string, len(idx))
+	for i, v := range idx {
+		f[i] = line[v[0]:v[1]]
+	}
+	if len(f) < 3 {
+		return nil, errors.New("missing path or action")
+	}
+	r := &Route{Match: f[0], Path: f[1]}
+	switch r.Match {
+	case RouteExact, RoutePrefix:
+		if !strings.HasPrefix(r.Path, "/") {
+			return nil, errors.New("path must start with /")
+		}
+	case RouteRegex:
+		var err error
+		if r.re, err = regexp.Compile(r.Path); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown match " + r.Match)
+	}
+	i := 2
+	for ; i < len(f) && strings.Contains(f[i], "="); i++ {
+		k, v, _ := strings.Cut(f[i], "=")
+		switch k {
+		case "method":
+			for _, m := range strings.Split(v, ",") {
+				r.Methods = append(r.Methods, strings.ToUpper(m))
+			}
+		case "header":
+			name, value, _ := strings.Cut(v, ":")
+			if name == "" {
+				return nil, errors.New("invalid header condition " + v)
+			}
+			if r.Headers == nil {
+				r.Headers = make(map[string]string)
+			}
+			r.Headers[http.CanonicalHeaderKey(name)] = value
+		case "priority":
+			var err error
+			if r.Priority, err = strconv.Atoi(v); err != nil {
+				return nil, errors.New("invalid priority " + v)
+			}
+		default:
+			return nil, errors.New("unknown condition " + k)
+		}
+	}
+	if i >= len(f) {
+		return nil, errors.New("missing action")
+	}
+	r.Action = f[i]
+	args := f[i+1:]
+	switch r.Action {
+	case RouteProxy:
+		var targets []string
+		for _, a := range args {
+			k, v, _ := strings.Cut(a, "=")
+			switch {
+			case !strings.Contains(a, "="):
+				targets = append(targets, strings.Split(a, ",")...)
+			case k == "strip":
+				r.Strip = v
+			case k == "rewrite":
+				r.Rewrite = v
+			default:
+				return nil, errors.New("unknown proxy option " + k)
+			}
+		}
+		if len(targets) > 0 {
+			r.Target = &Target{TargetStr: strings.Join(targets, "\n")}
+			if base != nil {
+				r.Target.Balance, r.Target.LocalProxy = base.Balance, base.LocalProxy
+			}
+			if err := r.Target.Check(); err != nil {
+				return nil, err
+			}
+		}
+	case RouteRedirect:
+		if len(args) == 0 {
+			return nil, errors.New("missing redirect url")
+		}
+		r.Redirect, r.Code = args[0], http.StatusFound
+		for _, a := range args[1:] {
+			k, v, _ := strings.Cut(a, "=")
+			c, err := strconv.Atoi(v)
+			if k != "code" || err != nil || c < 300 || c > 399 {
+				return nil, errors.New("invalid redirect option " + a)
+			}
+			r.Code = c
+		}
+	case RouteResponse:
+		var err error
+		if len(args) == 0 {
+			return nil, errors.New("missing response status")
+		}
+		if r.Code, err = strconv.Atoi(args[0]); err != nil || r.Code < 100 || r.Code > 599 {
+			return nil, errors.New("invalid response status " + args[0])
+		}
+		if len(args) > 1 {
+			// 内容保留原来的空格
+			r.Body = line[idx[i+2][0]:]
+		}
+	default:
+		return nil, errors.New("unknown action " + r.Action)
+	}
+	return r, nil
+}
+
+// Matches 判断请求是否符合路由的路径、方法和请求头条件
+func (r *Route) Matches(req *http.Request) bool {
+	if len(r.Methods) > 0 {
+		ok := false
+		for _, m := range r.Methods {
+			if m == req.Method {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for k, v := range r.Headers {
+		if values, ok := req.Header[k]; !ok || v != "" && (len(values) == 0 || values[0] != v) {
+			return false
+		}
+	}
+	switch r.Match {
+	case RouteExact:
+		return req.URL.Path == r.Path
+	case RoutePrefix:
+		return strings.HasPrefix(req.URL.Path, r.Path)
+	default:
+		return r.re.MatchString(req.URL.Path)
+	}
+}
+
+func (r *Route) expand(template, path string) string {
+	if r.re == nil {
+		return template
+	}
+	m := r.re.FindStringSubmatchIndex(path)
+	if m == nil {
+		return template
+	}
+	return string(r.re.ExpandString(nil, template, path, m))
+}
+
+// RewriteURL 按 rewrite、strip 修改转发给目标的路径
+func (r *Route) RewriteURL(u *url.URL) {
+	path := u.Path
+	if r.Rewrite != "" {
+		switch r.Match {
+		case RouteExact:
+			path = r.Rewrite
+		case RoutePrefix:
+			path = r.Rewrite + strings.TrimPrefix(path, r.Path)
+		default:
+			path = r.expand(r.Rewrite, path)
+		}
+	}
+	if r.Strip != "" && strings.HasPrefix(path, r.Strip) {
+		path = path[len(r.Strip):]
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if path != u.Path {
+		u.Path, u.RawPath = path, ""
+	}
+}
+
+// RedirectURL 返回重定向的地址，regex 时可以用 $1 引用分组，原请求的参数会保留
+func (r *Route) RedirectURL(u *url.URL) string {
+	location := r.expand(r.Redirect, u.Path)
+	if u.RawQuery != "" && !strings.Contains(location, "?") {
+		location += "?" + u.RawQuery
+	}
+	return location
+}
+
+// MatchRoute 返回请求匹配的第一条路由，没有配置路由或者都不匹配时返回 nil
+func (s *Host) MatchRoute(req *http.Request) *Route {
+	s.RLock()
+	routes, str, target := s.routes, s.Routes, s.Target
+	ok := s.routesStr == str && s.routesTarget == target
+	s.RUnlock()
+	if str == "" {
+		return nil
+	}
+	if !ok {
+		routes, _ = ParseRoutes(str, target)
+		s.Lock()
+		s.routes, s.routesStr, s.routesTarget = routes, str, target
+		s.Unlock()
+	}
+	for _, r := range routes {
+		if r.Matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// RouteTarget 返回路由的目标，route 为 nil 或者没有指定目标时使用域名的目标
+func (s *Host) RouteTarget(route *Route) *Target {
+	if route != nil && route.Target != nil {
+		return route.Target
+	}
+	return s.Target
+}
@@ -0,0 +1,63 @@
+package file
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	h := &Host{Target: &Target{TargetStr: "10.0.0.1:80", Balance: BalanceWeightedRoundRobin}, Routes: `
+# 注释
+prefix /api/ proxy
+prefix /api/v2/ proxy 10.0.0.2:80,10.0.0.3:80@2 rewrite=/api/
+regex ^/old/(.*)$ redirect /new/$1 code=301
+exact /healthz method=GET response 200 all  ok
+prefix / header=X-Env:beta priority=10 proxy 10.0.0.4:80 strip=/app
+`}
+	route := func(method, path string, header ...string) *Route {
+		r := httptest.NewRequest(method, path, nil)
+		if len(header) == 2 {
+			r.Header.Set(header[0], header[1])
+		}
+		return h.MatchRoute(r)
+	}
+
+	r := route("GET", "/api/v2/users?a=1")
+	if r == nil || r.Target == nil || r.Target.Balance != BalanceWeightedRoundRobin {
+		t.Fatalf("longest prefix not matched: %+v", r)
+	}
+	req := httptest.NewRequest("GET", "/api/v2/users?a=1", nil)
+	r.RewriteURL(req.URL)
+	if req.URL.RequestURI() != "/api/users?a=1" {
+		t.Fatalf("rewrite got %s", req.URL.RequestURI())
+	}
+	if r := route("GET", "/api/v1"); r == nil || h.RouteTarget(r) != h.Target {
+		t.Fatal("route without targets should use the host target")
+	}
+	r = route("GET", "/old/a/b?x=1")
+	if r == nil || r.Code != http.StatusMovedPermanently || r.RedirectURL(httptest.NewRequest("GET", "/old/a/b?x=1", nil).URL) != "/new/a/b?x=1" {
+		t.Fatalf("unexpected redirect %+v", r)
+	}
+	if r := route("GET", "/healthz"); r == nil || r.Action != RouteResponse || r.Body != "all  ok" {
+		t.Fatalf("unexpected response %+v", r)
+	}
+	if r := route("POST", "/healthz"); r != nil {
+		t.Fatalf("method condition not checked: %+v", r)
+	}
+	r = route("GET", "/app/api/v2/x", "X-Env", "beta")
+	if r == nil || r.Priority != 10 {
+		t.Fatalf("priority not respected: %+v", r)
+	}
+	req = httptest.NewRequest("GET", "/app/x", nil)
+	r.RewriteURL(req.URL)
+	if req.URL.Path != "/x" {
+		t.Fatalf("strip got %s", req.URL.Path)
+	}
+
+	for _, s := range []string{"prefix api proxy", "regex ( proxy", "exact /a", "exact /a forward", "exact /a redirect /b code=200", "prefix /a proxy 10.0.0.1:80@x"} {
+		if _, err := ParseRoutes(s, nil); err == nil {
+			t.Fatalf("%s should be invalid", s)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package file
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ehang.io/nps/lib/cluster"
+	"ehang.io/nps/lib/common"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	"github.com/pkg/errors"
+)
+
+// Store 负责客户端、隧道、域名解析以及全局配置的持久化
+// Save 必须是原子的：要么整个快照落盘，要么保持上一次的快照
+type Store interface {
+	Load() (*Snapshot, error)
+	Save(snap *Snapshot) error
+	Close() error
+}
+
+// SharedStore 是可以被多个 nps 节点同时使用的存储，读写期间需要持有锁，
+// 其他节点提交新的数据后 Changed 返回 true
+type SharedStore interface {
+	Store
+	Lock() error
+	Unlock()
+	Changed() bool
+	// ReserveId 分配 kind 类型的下一个 id，返回值大于 min 以及所有节点分配过的 id，需要持有锁
+	ReserveId(kind string, min int32) (int32, error)
+}
+
+// Snapshot 是一次完整的持久化数据
+type Snapshot struct {
+	Clients []*Client
+	Tasks   []*Tunnel
+	Hosts   []*Host
+	Tokens  []*ApiToken
+	Users   []*User
+	Global  *Glob
+}
+
+func (s *Snapshot) empty() bool {
+	return len(s.Clients) == 0 && len(s.Tasks) == 0 && len(s.Hosts) == 0 && len(s.Tokens) == 0 && len(s.Users) == 0 && s.Global == nil
+}
+
+// NewStore 根据 nps.conf 中的 db_type 创建存储，默认为 json
+func NewStore(runPath string) (Store, error) {
+	confPath := filepath.Join(runPath, "conf")
+	if beego.AppConfig.DefaultBool("cluster_enable", false) {
+		// 集群模式下所有节点共用 cluster_shared_path 中的 json 数据
+		dir := beego.AppConfig.String("cluster_shared_path")
+		if dir == "" {
+			return nil, errors.New("cluster_shared_path is required when cluster_enable is true")
+		}
+		store := NewJsonStore(dir)
+		store.SetBackup(beego.AppConfig.DefaultInt("db_backup_num", 5), time.Duration(beego.AppConfig.DefaultInt("db_backup_interval", 60))*time.Minute)
+		store.SetShared(filepath.Join(dir, "db.lock"))
+		return store, nil
+	}
+	switch beego.AppConfig.DefaultString("db_type", "json") {
+	case "json", "":
+		store := NewJsonStore(confPath)
+		store.SetBackup(beego.AppConfig.DefaultInt("db_backup_num", 5), time.Duration(beego.AppConfig.DefaultInt("db_backup_interval", 60))*time.Minute)
+		return store, nil
+	case "bolt":
+		dbPath := beego.AppConfig.DefaultString("db_path", filepath.Join("conf", "nps.db"))
+		if !filepath.IsAbs(dbPath) {
+			dbPath = filepath.Join(runPath, dbPath)
+		}
+		store, err := NewBoltStore(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		if err = migrateFromJson(store, NewJsonStore(confPath)); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, errors.Errorf("unknown db_type %s", beego.AppConfig.String("db_type"))
+	}
+}
+
+// migrateFromJson 首次使用嵌入式数据库时导入已有的 json 配置
+func migrateFromJson(dst Store, src Store) error {
+	snap, err := dst.Load()
+	if err != nil || !snap.empty() {
+		return err
+	}
+	if snap, err = src.Load(); err != nil || snap.empty() {
+		return err
+	}
+	logs.Info("import %d clients, %d tasks, %d hosts from json files", len(snap.Clients), len(snap.Tasks), len(snap.Hosts))
+	return dst.Save(snap)
+}
+
+const (
+	clientFileName   = "clients.json"
+	taskFileName     = "tasks.json"
+	hostFileName     = "hosts.json"
+	tokenFileName    = "tokens.json"
+	userFileName     = "users.json"
+	globalFileName   = "global.json"
+	manifestFileName = "db.manifest"
+	journalName      = "db.journal"
+	idsFileName      = "ids.json" // 集群模式下各类记录已经分配的最大 id
+)
+
+// dataFileNames 是一次提交写入的全部文件，清理临时文件和保留损坏的文件都以此为准
+var dataFileNames = []string{clientFileName, taskFileName, hostFileName, tokenFileName, userFileName, globalFileName, manifestFileName}
+
+// JsonStore 以 json 文件保存数据，兼容原有的 conf/*.json 格式
+// 多个文件的替换通过 journal 实现原子提交：所有临时文件落盘后才写 journal，
+// 启动时如果发现 journal 则继续完成未完成的重命名
+type JsonStore struct {
+	dir            string
+	version        int64
+	backupNum      int
+	backupInterval time.Duration
+	lastBackup     time.Time
+	lock           *cluster.FileLock
+}
+
+func NewJsonStore(dir string) *JsonStore {
+	return &JsonStore{dir: dir}
+}
+
+// SetBackup keep num timestamped backups under conf/backup, at most one every interval
+func (s *JsonStore) SetBackup(num int, interval time.Duration) {
+	s.backupNum = num
+	s.backupInterval = interval
+}
+
+// SetShared 与其他节点共用数据目录，lockPath 为跨进程锁文件
+func (s *JsonStore) SetShared(lockPath string) {
+	s.lock = cluster.NewFileLock(lockPath)
+}
+
+func (s *JsonStore) Lock() error {
+	if s.lock == nil {
+		return nil
+	}
+	return s.lock.Lock()
+}
+
+func (s *JsonStore) Unlock() {
+	if s.lock != nil {
+		s.lock.Unlock()
+	}
+}
+
+// Changed 判断其他节点是否在本节点上次读写之后提交过数据
+func (s *JsonStore) Changed() bool {
+	if s.lock == nil {
+		return false
+	}
+	b, err := os.ReadFile(s.path(manifestFileName))
+	if err != nil {
+		return false
+	}
+	m := new(manifest)
+	return json.Unmarshal(b, m) == nil && m.Version != s.version
+}
+
+// ReserveId 在共享目录中记录分配过的最大 id，没有与其他节点共用时直接返回 min+1
+func (s *JsonStore) ReserveId(kind string, min int32) (int32, error) {
+	if s.lock == nil {
+		return min + 1, nil
+	}
+	ids := make(map[string]int32)
+	if b, err := os.ReadFile(s.path(idsFileName)); err == nil {
+		if err = json.Unmarshal(b, &ids); err != nil {
+			return 0, errors.Wrap(err, "broken "+idsFileName)
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	if ids[kind] > min {
+		min = ids[kind]
+	}
+	ids[kind] = min + 1
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return 0, err
+	}
+	// 先写临时文件再重命名，中断时保留原来的记录
+	if err = writeFileSync(s.path(idsFileName)+".tmp", b); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(s.path(idsFileName)+".tmp", s.path(idsFileName)); err != nil {
+		return 0, err
+	}
+	syncDir(s.dir)
+	return ids[kind], nil
+}
+
+func (s *JsonStore) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *JsonStore) Load() (*Snapshot, error) {
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	snap, report, err := loadSnapshot(s.dir, false)
+	if err != nil {
+		return nil, err
+	}
+	s.version = report.version
+	if report.ok() {
+		return snap, nil
+	}
+	logs.Error("db files in %s are damaged: %s", s.dir, strings.Join(report.problems, "; "))
+	s.quarantine()
+	for _, dir := range s.backups() {
+		backup, backupReport, err := loadSnapshot(dir, true)
+		if err != nil || !backupReport.ok() {
+			logs.Warn("skip backup %s: %v %s", dir, err, strings.Join(backupReport.problems, "; "))
+			continue
+		}
+		logs.Warn("fall back to backup %s, dropped records: %s", dir, dropped(snap, report, backup))
+		s.version = backupReport.version
+		return backup, nil
+	}
+	logs.Error("no usable backup found, load the readable records, dropped records: %s", dropped(snap, report, nil))
+	return snap, nil
+}
+
+func (s *JsonStore) Save(snap *Snapshot) error {
+	files := make(map[string][]byte)
+	var err error
+	if files[clientFileName], err = encodeRecords(len(snap.Clients), func(i int) interface{} { return snap.Clients[i] }); err != nil {
+		return err
+	}
+	if files[taskFileName], err = encodeRecords(len(snap.Tasks), func(i int) interface{} { return snap.Tasks[i] }); err != nil {
+		return err
+	}
+	if files[hostFileName], err = encodeRecords(len(snap.Hosts), func(i int) interface{} { return snap.Hosts[i] }); err != nil {
+		return err
+	}
+	if files[tokenFileName], err = encodeRecords(len(snap.Tokens), func(i int) interface{} { return snap.Tokens[i] }); err != nil {
+		return err
+	}
+	if files[userFileName], err = encodeRecords(len(snap.Users), func(i int) interface{} { return snap.Users[i] }); err != nil {
+		return err
+	}
+	if snap.Global != nil {
+		if files[globalFileName], err = json.Marshal(snap.Global); err != nil {
+			return err
+		}
+	}
+	s.version++
+	if files[manifestFileName], err = newManifest(s.version, files, snap); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for name, b := range files {
+		if err = writeFileSync(s.path(name)+".tmp", b); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	// journal 写入成功即视为提交
+	b, _ := json.Marshal(names)
+	if err = writeFileSync(s.path(journalName)+".tmp", b); err != nil {
+		return err
+	}
+	if err = os.Rename(s.path(journalName)+".tmp", s.path(journalName)); err != nil {
+		return err
+	}
+	syncDir(s.dir)
+	if err = s.commit(names); err != nil {
+		return err
+	}
+	s.backup(files)
+	return nil
+}
+
+func (s *JsonStore) Close() error {
+	return nil
+}
+
+func (s *JsonStore) commit(names []string) error {
+	for _, name := range names {
+		if err := os.Rename(s.path(name)+".tmp", s.path(name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	syncDir(s.dir)
+	return os.Remove(s.path(journalName))
+}
+
+// recover 完成上次中断的提交，或丢弃未提交的临时文件
+func (s *JsonStore) recover() error {
+	b, err := os.ReadFile(s.path(journalName))
+	if err == nil {
+		var names []string
+		if err = json.Unmarshal(b, &names); err != nil {
+			return errors.Wrap(err, "broken db journal")
+		}
+		logs.Warn("found unfinished db commit, replay it")
+		return s.commit(names)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range append(dataFileNames, journalName) {
+		os.Remove(s.path(name) + ".tmp")
+	}
+	return nil
+}
+
+func encodeRecords(n int, get func(i int) interface{}) ([]byte, error) {
+	var buf []byte
+	for i := 0; i < n; i++ {
+		b, err := json.Marshal(get(i))
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b...)
+		buf = append(buf, "\n"+common.CONN_DATA_SEQ...)
+	}
+	return buf, nil
+}
+
+func writeFileSync(filePath string, b []byte) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,305 @@
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"github.com/astaxie/beego/logs"
+)
+
+const backupTimeFormat = "20060102-150405"
+
+// manifest 记录一次提交的版本号以及每个文件的校验和，用于启动时检查文件是否完整
+type manifest struct {
+	Version int64                    `json:"version"`
+	Time    int64                    `json:"time"`
+	Files   map[string]*manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Sha256  string `json:"sha256"`
+	Records int    `json:"records"`
+}
+
+func newManifest(version int64, files map[string][]byte, snap *Snapshot) ([]byte, error) {
+	m := &manifest{Version: version, Time: time.Now().Unix(), Files: make(map[string]*manifestFile)}
+	records := map[string]int{
+		clientFileName: len(snap.Clients),
+		taskFileName:   len(snap.Tasks),
+		hostFileName:   len(snap.Hosts),
+		tokenFileName:  len(snap.Tokens),
+		userFileName:   len(snap.Users),
+		globalFileName: 1,
+	}
+	for name, b := range files {
+		sum := sha256.Sum256(b)
+		m.Files[name] = &manifestFile{Sha256: hex.EncodeToString(sum[:]), Records: records[name]}
+	}
+	return json.Marshal(m)
+}
+
+// loadReport 记录加载过程中发现的问题
+type loadReport struct {
+	version  int64
+	problems []string
+	broken   []string // records which could not be parsed, like "task 5"
+}
+
+func (r *loadReport) ok() bool {
+	return len(r.problems) == 0
+}
+
+func (r *loadReport) add(format string, a ...interface{}) {
+	r.problems = append(r.problems, fmt.Sprintf(format, a...))
+}
+
+// loadSnapshot 读取目录下的数据文件并根据 manifest 校验，
+// requireManifest 为 true 时没有 manifest 也算损坏，用于备份目录，旧版本的数据目录没有 manifest
+func loadSnapshot(dir string, requireManifest bool) (*Snapshot, *loadReport, error) {
+	snap := new(Snapshot)
+	report := new(loadReport)
+	m := new(manifest)
+	if b, err := os.ReadFile(filepath.Join(dir, manifestFileName)); err == nil {
+		if err = json.Unmarshal(b, m); err != nil {
+			report.add("%s: %s", manifestFileName, err)
+			m = new(manifest)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	} else if requireManifest {
+		report.add("%s: missing", manifestFileName)
+	}
+	report.version = m.Version
+	read := func(name string) ([]byte, error) {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			if _, ok := m.Files[name]; ok {
+				report.add("%s: missing", name)
+			}
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if f, ok := m.Files[name]; ok {
+			if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != f.Sha256 {
+				report.add("%s: checksum mismatch", name)
+			}
+		}
+		return b, nil
+	}
+	records := []struct {
+		name string
+		kind string
+		f    func(b []byte) error
+	}{
+		{clientFileName, "client", func(b []byte) error {
+			c := new(Client)
+			if err := json.Unmarshal(b, c); err != nil {
+				return err
+			}
+			snap.Clients = append(snap.Clients, c)
+			return nil
+		}},
+		{taskFileName, "task", func(b []byte) error {
+			t := new(Tunnel)
+			if err := json.Unmarshal(b, t); err != nil {
+				return err
+			}
+			snap.Tasks = append(snap.Tasks, t)
+			return nil
+		}},
+		{hostFileName, "host", func(b []byte) error {
+			h := new(Host)
+			if err := json.Unmarshal(b, h); err != nil {
+				return err
+			}
+			snap.Hosts = append(snap.Hosts, h)
+			return nil
+		}},
+		{tokenFileName, "token", func(b []byte) error {
+			t := new(ApiToken)
+			if err := json.Unmarshal(b, t); err != nil {
+				return err
+			}
+			snap.Tokens = append(snap.Tokens, t)
+			return nil
+		}},
+		{userFileName, "user", func(b []byte) error {
+			u := new(User)
+			if err := json.Unmarshal(b, u); err != nil {
+				return err
+			}
+			snap.Users = append(snap.Users, u)
+			return nil
+		}},
+	}
+	for _, r := range records {
+		b, err := read(r.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		n, broken := parseRecords(b, r.f)
+		for _, id := range broken {
+			report.broken = append(report.broken, r.kind+" "+id)
+		}
+		if len(broken) > 0 {
+			report.add("%s: %d unreadable records", r.name, len(broken))
+		}
+		if f, ok := m.Files[r.name]; ok && f.Records != n+len(broken) {
+			report.add("%s: expect %d records, found %d", r.name, f.Records, n+len(broken))
+		}
+	}
+	b, err := read(globalFileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(strings.TrimSpace(string(b))) > 0 {
+		g := new(Glob)
+		if err := json.Unmarshal(b, g); err != nil {
+			report.add("%s: %s", globalFileName, err)
+			report.broken = append(report.broken, "global config")
+		} else {
+			snap.Global = g
+		}
+	}
+	return snap, report, nil
+}
+
+var recordIdReg = regexp.MustCompile(`"Id":(-?\d+)`)
+
+// parseRecords 解析以 CONN_DATA_SEQ 分隔的记录，返回成功的数量以及无法解析的记录 id
+func parseRecords(b []byte, f func(b []byte) error) (n int, broken []string) {
+	for _, v := range strings.Split(string(b), "\n"+common.CONN_DATA_SEQ) {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		if err := f([]byte(v)); err != nil {
+			id := "unknown"
+			if m := recordIdReg.FindStringSubmatch(v); m != nil {
+				id = m[1]
+			}
+			broken = append(broken, id)
+			continue
+		}
+		n++
+	}
+	return
+}
+
+func snapshotKeys(snap *Snapshot) map[string]bool {
+	keys := make(map[string]bool)
+	for _, v := range snap.Clients {
+		keys[fmt.Sprintf("client %d", v.Id)] = true
+	}
+	for _, v := range snap.Tasks {
+		keys[fmt.Sprintf("task %d", v.Id)] = true
+	}
+	for _, v := range snap.Hosts {
+		keys[fmt.Sprintf("host %d", v.Id)] = true
+	}
+	for _, v := range snap.Tokens {
+		keys[fmt.Sprintf("token %d", v.Id)] = true
+	}
+	for _, v := range snap.Users {
+		keys[fmt.Sprintf("user %d", v.Id)] = true
+	}
+	if snap.Global != nil {
+		keys["global config"] = true
+	}
+	return keys
+}
+
+// dropped 列出损坏的数据中在最终使用的快照里不存在的记录
+func dropped(current *Snapshot, report *loadReport, used *Snapshot) string {
+	keys := snapshotKeys(current)
+	for _, v := range report.broken {
+		keys[v] = true
+	}
+	if used != nil {
+		for k := range snapshotKeys(used) {
+			delete(keys, k)
+		}
+	} else {
+		keys = make(map[string]bool)
+		for _, v := range report.broken {
+			keys[v] = true
+		}
+	}
+	list := make([]string, 0, len(keys))
+	for k := range keys {
+		list = append(list, k)
+	}
+	if len(list) == 0 {
+		return "none"
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// backups 返回所有备份目录，最新的在前
+func (s *JsonStore) backups() []string {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "backup"))
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for _, e := range entries {
+		if _, err := time.Parse(backupTimeFormat, e.Name()); e.IsDir() && err == nil {
+			dirs = append(dirs, filepath.Join(s.dir, "backup", e.Name()))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	return dirs
+}
+
+// backup 保存刚提交的文件，并删除超出数量的旧备份
+func (s *JsonStore) backup(files map[string][]byte) {
+	if s.backupNum <= 0 || time.Since(s.lastBackup) < s.backupInterval {
+		return
+	}
+	now := time.Now()
+	dir := filepath.Join(s.dir, "backup", now.Format(backupTimeFormat))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logs.Error("create backup dir error: %s", err)
+		return
+	}
+	// manifest 最后写入，没有 manifest 的备份不完整
+	for name, b := range files {
+		if name == manifestFileName {
+			continue
+		}
+		if err := writeFileSync(filepath.Join(dir, name), b); err != nil {
+			logs.Error("write backup %s error: %s", dir, err)
+			return
+		}
+	}
+	if err := writeFileSync(filepath.Join(dir, manifestFileName), files[manifestFileName]); err != nil {
+		logs.Error("write backup %s error: %s", dir, err)
+		return
+	}
+	s.lastBackup = now
+	for i, old := range s.backups() {
+		if i >= s.backupNum {
+			os.RemoveAll(old)
+		}
+	}
+}
+
+// quarantine 保留损坏的文件，避免下一次保存时被覆盖
+func (s *JsonStore) quarantine() {
+	suffix := ".damaged-" + time.Now().Format(backupTimeFormat)
+	for _, name := range dataFileNames {
+		if b, err := os.ReadFile(s.path(name)); err == nil {
+			writeFileSync(s.path(name)+suffix, b)
+		}
+	}
+}
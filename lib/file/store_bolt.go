@@ -0,0 +1,166 @@
+package file
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	clientBucket = []byte("clients")
+	taskBucket   = []byte("tasks")
+	hostBucket   = []byte("hosts")
+	tokenBucket  = []byte("tokens")
+	userBucket   = []byte("users")
+	globalBucket = []byte("global")
+	globalKey    = []byte("global")
+)
+
+// BoltStore 使用嵌入式 bolt 数据库保存数据，每次保存在一个事务内完成
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() (*Snapshot, error) {
+	snap := new(Snapshot)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		forEachRecord(tx, clientBucket, func(v []byte) error {
+			c := new(Client)
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			snap.Clients = append(snap.Clients, c)
+			return nil
+		})
+		forEachRecord(tx, taskBucket, func(v []byte) error {
+			t := new(Tunnel)
+			if err := json.Unmarshal(v, t); err != nil {
+				return err
+			}
+			snap.Tasks = append(snap.Tasks, t)
+			return nil
+		})
+		forEachRecord(tx, hostBucket, func(v []byte) error {
+			h := new(Host)
+			if err := json.Unmarshal(v, h); err != nil {
+				return err
+			}
+			snap.Hosts = append(snap.Hosts, h)
+			return nil
+		})
+		forEachRecord(tx, tokenBucket, func(v []byte) error {
+			t := new(ApiToken)
+			if err := json.Unmarshal(v, t); err != nil {
+				return err
+			}
+			snap.Tokens = append(snap.Tokens, t)
+			return nil
+		})
+		forEachRecord(tx, userBucket, func(v []byte) error {
+			u := new(User)
+			if err := json.Unmarshal(v, u); err != nil {
+				return err
+			}
+			snap.Users = append(snap.Users, u)
+			return nil
+		})
+		if b := tx.Bucket(globalBucket); b != nil {
+			if v := b.Get(globalKey); v != nil {
+				g := new(Glob)
+				if err := json.Unmarshal(v, g); err != nil {
+					logs.Error("parse global config error: %s", err)
+				} else {
+					snap.Global = g
+				}
+			}
+		}
+		return nil
+	})
+	return snap, err
+}
+
+func (s *BoltStore) Save(snap *Snapshot) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{clientBucket, taskBucket, hostBucket, tokenBucket, userBucket, globalBucket} {
+			if tx.Bucket(name) != nil {
+				if err := tx.DeleteBucket(name); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for _, c := range snap.Clients {
+			if err := putRecord(tx.Bucket(clientBucket), c.Id, c); err != nil {
+				return err
+			}
+		}
+		for _, t := range snap.Tasks {
+			if err := putRecord(tx.Bucket(taskBucket), t.Id, t); err != nil {
+				return err
+			}
+		}
+		for _, h := range snap.Hosts {
+			if err := putRecord(tx.Bucket(hostBucket), h.Id, h); err != nil {
+				return err
+			}
+		}
+		for _, t := range snap.Tokens {
+			if err := putRecord(tx.Bucket(tokenBucket), t.Id, t); err != nil {
+				return err
+			}
+		}
+		for _, u := range snap.Users {
+			if err := putRecord(tx.Bucket(userBucket), u.Id, u); err != nil {
+				return err
+			}
+		}
+		if snap.Global != nil {
+			b, err := json.Marshal(snap.Global)
+			if err != nil {
+				return err
+			}
+			return tx.Bucket(globalBucket).Put(globalKey, b)
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func putRecord(b *bolt.Bucket, id int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return b.Put(key, data)
+}
+
+func forEachRecord(tx *bolt.Tx, name []byte, f func(v []byte) error) {
+	b := tx.Bucket(name)
+	if b == nil {
+		return
+	}
+	b.ForEach(func(k, v []byte) error {
+		if err := f(v); err != nil {
+			logs.Error("parse record %x in bucket %s error: %s", k, name, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,262 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testSnapshot() *Snapshot {
+	c := &Client{Id: 1, VerifyKey: "abc", Status: true, Cnf: new(Config), Flow: &Flow{InletFlow: 10}}
+	return &Snapshot{
+		Clients: []*Client{c},
+		Tasks:   []*Tunnel{{Id: 2, Port: 9001, Mode: "tcp", Client: c, Flow: new(Flow), Target: &Target{TargetStr: "127.0.0.1:80"}}},
+		Hosts:   []*Host{{Id: 3, Host: "a.com", Location: "/", Client: c, Flow: new(Flow), Target: &Target{TargetStr: "127.0.0.1:81"}}},
+		Global:  &Glob{BlackIpList: []string{"1.1.1.1"}},
+	}
+}
+
+func checkSnapshot(t *testing.T, snap *Snapshot) {
+	if len(snap.Clients) != 1 || snap.Clients[0].VerifyKey != "abc" || snap.Clients[0].Flow.InletFlow != 10 {
+		t.Fatalf("unexpected clients %+v", snap.Clients)
+	}
+	if len(snap.Tasks) != 1 || snap.Tasks[0].Port != 9001 || snap.Tasks[0].Client.Id != 1 {
+		t.Fatalf("unexpected tasks %+v", snap.Tasks)
+	}
+	if len(snap.Hosts) != 1 || snap.Hosts[0].Host != "a.com" {
+		t.Fatalf("unexpected hosts %+v", snap.Hosts)
+	}
+	if snap.Global == nil || len(snap.Global.BlackIpList) != 1 {
+		t.Fatalf("unexpected global %+v", snap.Global)
+	}
+}
+
+func TestJsonStore(t *testing.T) {
+	store := NewJsonStore(t.TempDir())
+	if err := store.Save(testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshot(t, snap)
+}
+
+func TestJsonStoreRecover(t *testing.T) {
+	dir := t.TempDir()
+	store := NewJsonStore(dir)
+	if err := store.Save(testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	// crash before the journal was written: temporary files are discarded
+	if err := os.WriteFile(filepath.Join(dir, clientFileName+".tmp"), []byte("{broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshot(t, snap)
+	if _, err := os.Stat(filepath.Join(dir, clientFileName+".tmp")); !os.IsNotExist(err) {
+		t.Fatal("uncommitted temporary file should be removed")
+	}
+
+	// crash after the journal was written: the commit is replayed
+	next := testSnapshot()
+	next.Tasks[0].Port = 9002
+	files := make(map[string][]byte)
+	files[taskFileName], _ = encodeRecords(1, func(i int) interface{} { return next.Tasks[i] })
+	files[clientFileName], _ = encodeRecords(1, func(i int) interface{} { return next.Clients[i] })
+	files[hostFileName], _ = encodeRecords(1, func(i int) interface{} { return next.Hosts[i] })
+	files[manifestFileName], _ = newManifest(2, files, next)
+	for name, b := range files {
+		if err := writeFileSync(filepath.Join(dir, name+".tmp"), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeFileSync(filepath.Join(dir, journalName), []byte(`["tasks.json","clients.json","hosts.json","db.manifest"]`)); err != nil {
+		t.Fatal(err)
+	}
+	if snap, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Tasks[0].Port != 9002 {
+		t.Fatalf("journal not replayed, port %d", snap.Tasks[0].Port)
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalName)); !os.IsNotExist(err) {
+		t.Fatal("journal should be removed after replay")
+	}
+}
+
+func TestJsonStoreBackup(t *testing.T) {
+	dir := t.TempDir()
+	store := NewJsonStore(dir)
+	store.SetBackup(2, 0)
+	snap := testSnapshot()
+	if err := store.Save(snap); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.backups()) != 1 {
+		t.Fatalf("expect 1 backup, got %v", store.backups())
+	}
+	// a truncated write leaves half a record behind
+	b, err := os.ReadFile(filepath.Join(dir, taskFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, taskFileName), b[:len(b)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a backup interrupted before its manifest was written must be skipped
+	partial := filepath.Join(dir, "backup", time.Now().Add(time.Hour).Format(backupTimeFormat))
+	if err := os.MkdirAll(partial, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(partial, clientFileName), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	snap, report, err := loadSnapshot(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ok() || len(report.broken) != 1 || report.broken[0] != "task 2" {
+		t.Fatalf("damage not detected: %+v", report)
+	}
+	if snap, err = NewJsonStore(dir).Load(); err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshot(t, snap)
+	// every data file is kept before the backup replaces it
+	for _, name := range dataFileNames {
+		if m, _ := filepath.Glob(filepath.Join(dir, name+".damaged-*")); len(m) != 1 {
+			t.Fatalf("%s is not quarantined", name)
+		}
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewBoltStore(filepath.Join(dir, "nps.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	json := NewJsonStore(dir)
+	if err := json.Save(testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateFromJson(store, json); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshot(t, snap)
+
+	snap.Tasks = nil
+	if err := store.Save(snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Tasks) != 0 || len(snap.Clients) != 1 {
+		t.Fatalf("unexpected snapshot %+v", snap)
+	}
+}
+
+func TestSharedStoreMerge(t *testing.T) {
+	dir := t.TempDir()
+	newNode := func() *JsonDb {
+		db := NewJsonDb(dir)
+		store := NewJsonStore(dir)
+		store.SetShared(filepath.Join(dir, "db.lock"))
+		db.Store = store
+		if err := db.LoadFromStore(); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	getTask := func(db *JsonDb, id int) (*Tunnel, bool) {
+		v, ok := db.Tasks.Load(id)
+		if !ok {
+			return nil, false
+		}
+		return v.(*Tunnel), true
+	}
+	a := newNode()
+	c := &Client{Id: int(a.GetClientId()), VerifyKey: "abc", Status: true, Cnf: new(Config), Flow: new(Flow)}
+	a.Clients.Store(c.Id, c)
+	task := &Tunnel{Id: int(a.GetTaskId()), Port: 9001, Mode: "tcp", Status: true, Client: c, Flow: new(Flow), Target: &Target{TargetStr: "127.0.0.1:80"}}
+	a.Tasks.Store(task.Id, task)
+	a.Flush()
+
+	b := newNode()
+	bt, ok := getTask(b, task.Id)
+	if !ok {
+		t.Fatal("task not shared with the second node")
+	}
+	// b edits the task, a only counts flow: both changes survive
+	bt.Status = false
+	b.Flush()
+	task.Flow.Add(100, 200)
+	a.Flush()
+	changed, err := a.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	at, _ := getTask(a, task.Id)
+	if at.Status {
+		t.Fatalf("edit from the other node was lost, changed %v", changed)
+	}
+	if at.Flow.InletFlow != 100 {
+		t.Fatalf("flow was lost: %d", at.Flow.InletFlow)
+	}
+	if _, err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if bt, _ = getTask(b, task.Id); bt.Flow.InletFlow != 100 || bt.Status {
+		t.Fatalf("unexpected task on second node %+v", bt)
+	}
+	// delete on a, b drops it after sync
+	a.Tasks.Delete(task.Id)
+	a.Flush()
+	if changed, _ = b.Sync(); len(changed) != 1 || changed[0] != task.Id {
+		t.Fatalf("expect task %d changed, got %v", task.Id, changed)
+	}
+	if _, ok := getTask(b, task.Id); ok {
+		t.Fatal("deleted task still exists on second node")
+	}
+}
+
+func TestSharedStoreIds(t *testing.T) {
+	dir := t.TempDir()
+	newNode := func() *JsonDb {
+		db := NewJsonDb(dir)
+		store := NewJsonStore(dir)
+		store.SetShared(filepath.Join(dir, "db.lock"))
+		db.Store = store
+		if err := db.LoadFromStore(); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	a, b := newNode(), newNode()
+	// neither node has flushed, the ids must still be unique
+	seen := make(map[int32]bool)
+	for i := 0; i < 5; i++ {
+		for _, db := range []*JsonDb{a, b} {
+			id := db.GetClientId()
+			if seen[id] {
+				t.Fatalf("client id %d allocated twice", id)
+			}
+			seen[id] = true
+		}
+	}
+	if a.GetTaskId() != 1 || b.GetTaskId() != 2 {
+		t.Fatal("ids of each kind should be counted separately")
+	}
+}
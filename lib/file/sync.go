@@ -0,0 +1,343 @@
+package file
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"ehang.io/nps/lib/iplist"
+	"ehang.io/nps/lib/rate"
+)
+
+// 集群模式下多个节点共用一个存储，每个节点记录上一次同步时各条记录的配置摘要，
+// 合并时本节点未修改过的记录以存储中的为准，本节点修改过的记录保留本地版本，
+// 流量统计取两者中的较大值
+
+// volatileKeys 是运行时状态，不参与配置比较
+var volatileKeys = []string{"Flow", "Rate", "NowConn", "IsConnect", "Addr", "Version", "LastOnlineTime",
+	"RunStatus", "HealthNextTime", "HealthMap", "HealthRemoveArr", "CertExpire", "CertStatus", "LastUsedTime"}
+
+func configHash(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	m := make(map[string]interface{})
+	if json.Unmarshal(b, &m) != nil {
+		return ""
+	}
+	for _, k := range volatileKeys {
+		delete(m, k)
+	}
+	if c, ok := m["Client"].(map[string]interface{}); ok {
+		m["Client"] = c["Id"]
+	}
+	if t, ok := m["Target"].(map[string]interface{}); ok {
+		delete(t, "TargetArr")
+	}
+	b, _ = json.Marshal(m)
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func clientKey(id int) string { return fmt.Sprintf("client %d", id) }
+func taskKey(id int) string   { return fmt.Sprintf("task %d", id) }
+func hostKey(id int) string   { return fmt.Sprintf("host %d", id) }
+func tokenKey(id int) string  { return fmt.Sprintf("token %d", id) }
+func userKey(id int) string   { return fmt.Sprintf("user %d", id) }
+
+const globalKeyName = "global config"
+
+// markSynced 记录与存储一致时各条记录的配置摘要
+func (s *JsonDb) markSynced(snap *Snapshot) {
+	synced := make(map[string]string)
+	for _, v := range snap.Clients {
+		synced[clientKey(v.Id)] = configHash(v)
+	}
+	for _, v := range snap.Tasks {
+		synced[taskKey(v.Id)] = configHash(v)
+	}
+	for _, v := range snap.Hosts {
+		synced[hostKey(v.Id)] = configHash(v)
+	}
+	for _, v := range snap.Tokens {
+		synced[tokenKey(v.Id)] = configHash(v)
+	}
+	for _, v := range snap.Users {
+		synced[userKey(v.Id)] = configHash(v)
+	}
+	if snap.Global != nil {
+		synced[globalKeyName] = configHash(snap.Global)
+	}
+	s.synced = synced
+}
+
+// Sync 在其他节点修改共享存储后重新加载，返回配置发生变化或已被删除的隧道 id
+func (s *JsonDb) Sync() ([]int, error) {
+	ss, ok := s.Store.(SharedStore)
+	if !ok {
+		return nil, nil
+	}
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+	if err := ss.Lock(); err != nil {
+		return nil, err
+	}
+	defer ss.Unlock()
+	if !ss.Changed() {
+		changed := s.changedTasks
+		s.changedTasks = nil
+		return changed, nil
+	}
+	if err := s.reload(ss); err != nil {
+		return nil, err
+	}
+	changed := s.changedTasks
+	s.changedTasks = nil
+	return changed, nil
+}
+
+// reload 需要在持有 storeLock 和存储锁的情况下调用
+func (s *JsonDb) reload(ss SharedStore) error {
+	snap, err := ss.Load()
+	if err != nil {
+		return err
+	}
+	global := s.Global
+	s.changedTasks = append(s.changedTasks, s.merge(snap)...)
+	s.markSynced(snap)
+	s.RebuildHostIndex()
+	iplist.Invalidate()
+	if s.Global != global {
+		go notifyGlobalConfigUpdate()
+	}
+	return nil
+}
+
+func maxFlow(dst, src *Flow) {
+	if dst == nil || src == nil {
+		return
+	}
+	dst.Lock()
+	defer dst.Unlock()
+	if src.InletFlow > dst.InletFlow {
+		dst.InletFlow = src.InletFlow
+	}
+	if src.ExportFlow > dst.ExportFlow {
+		dst.ExportFlow = src.ExportFlow
+	}
+}
+
+// merge 将存储中的数据合并到内存
+func (s *JsonDb) merge(snap *Snapshot) (changedTasks []int) {
+	clients := make(map[int]*Client)
+	for _, d := range snap.Clients {
+		key := clientKey(d.Id)
+		clients[d.Id] = d
+		if d.Id > int(s.ClientIncreaseId) {
+			s.ClientIncreaseId = int32(d.Id)
+		}
+		v, ok := s.Clients.Load(d.Id)
+		if !ok {
+			if _, known := s.synced[key]; !known {
+				initClientRate(d)
+				s.Clients.Store(d.Id, d)
+			}
+			continue
+		}
+		m := v.(*Client)
+		maxFlow(m.Flow, d.Flow)
+		if h := configHash(m); h != s.synced[key] || h == configHash(d) {
+			continue
+		}
+		d.Flow = m.Flow
+		d.NowConn = m.NowConn
+		d.IsConnect = m.IsConnect
+		d.Addr = m.Addr
+		d.Version = m.Version
+		if d.RateLimit == m.RateLimit && m.Rate != nil {
+			d.Rate = m.Rate
+		} else {
+			initClientRate(d)
+		}
+		s.Clients.Store(d.Id, d)
+	}
+	s.Clients.Range(func(key, value interface{}) bool {
+		m := value.(*Client)
+		if _, ok := clients[m.Id]; !ok && !m.NoStore && s.synced[clientKey(m.Id)] == configHash(m) {
+			s.Clients.Delete(key)
+		}
+		return true
+	})
+
+	tasks := make(map[int]bool)
+	for _, d := range snap.Tasks {
+		key := taskKey(d.Id)
+		tasks[d.Id] = true
+		if d.Id > int(s.TaskIncreaseId) {
+			s.TaskIncreaseId = int32(d.Id)
+		}
+		if d.Client == nil {
+			continue
+		}
+		v, ok := s.Tasks.Load(d.Id)
+		if !ok {
+			if _, known := s.synced[key]; !known {
+				if c, err := s.GetClient(d.Client.Id); err == nil {
+					d.Client = c
+					s.Tasks.Store(d.Id, d)
+					changedTasks = append(changedTasks, d.Id)
+				}
+			}
+			continue
+		}
+		m := v.(*Tunnel)
+		maxFlow(m.Flow, d.Flow)
+		if h := configHash(m); h != s.synced[key] || h == configHash(d) {
+			continue
+		}
+		c, err := s.GetClient(d.Client.Id)
+		if err != nil {
+			continue
+		}
+		d.Client = c
+		d.Flow = m.Flow
+		s.Tasks.Store(d.Id, d)
+		changedTasks = append(changedTasks, d.Id)
+	}
+	s.Tasks.Range(func(key, value interface{}) bool {
+		m := value.(*Tunnel)
+		if !tasks[m.Id] && !m.NoStore && s.synced[taskKey(m.Id)] == configHash(m) {
+			s.Tasks.Delete(key)
+			changedTasks = append(changedTasks, m.Id)
+		}
+		return true
+	})
+
+	hosts := make(map[int]bool)
+	for _, d := range snap.Hosts {
+		key := hostKey(d.Id)
+		hosts[d.Id] = true
+		if d.Id > int(s.HostIncreaseId) {
+			s.HostIncreaseId = int32(d.Id)
+		}
+		if d.Client == nil {
+			continue
+		}
+		v, ok := s.Hosts.Load(d.Id)
+		if !ok {
+			if _, known := s.synced[key]; !known {
+				if c, err := s.GetClient(d.Client.Id); err == nil {
+					d.Client = c
+					s.Hosts.Store(d.Id, d)
+				}
+			}
+			continue
+		}
+		m := v.(*Host)
+		maxFlow(m.Flow, d.Flow)
+		if h := configHash(m); h != s.synced[key] || h == configHash(d) {
+			continue
+		}
+		if c, err := s.GetClient(d.Client.Id); err == nil {
+			d.Client = c
+			d.Flow = m.Flow
+			s.Hosts.Store(d.Id, d)
+		}
+	}
+	s.Hosts.Range(func(key, value interface{}) bool {
+		m := value.(*Host)
+		if !hosts[m.Id] && !m.NoStore && s.synced[hostKey(m.Id)] == configHash(m) {
+			s.Hosts.Delete(key)
+		}
+		return true
+	})
+
+	tokens := make(map[int]bool)
+	for _, d := range snap.Tokens {
+		key := tokenKey(d.Id)
+		tokens[d.Id] = true
+		if d.Id > int(s.TokenIncreaseId) {
+			s.TokenIncreaseId = int32(d.Id)
+		}
+		v, ok := s.Tokens.Load(d.Id)
+		if !ok {
+			if _, known := s.synced[key]; !known {
+				s.Tokens.Store(d.Id, d)
+			}
+			continue
+		}
+		m := v.(*ApiToken)
+		if h := configHash(m); h != s.synced[key] || h == configHash(d) {
+			continue
+		}
+		d.LastUsedTime = m.LastUsedTime
+		s.Tokens.Store(d.Id, d)
+	}
+	s.Tokens.Range(func(key, value interface{}) bool {
+		m := value.(*ApiToken)
+		if !tokens[m.Id] && s.synced[tokenKey(m.Id)] == configHash(m) {
+			s.Tokens.Delete(key)
+		}
+		return true
+	})
+
+	users := make(map[int]bool)
+	for _, d := range snap.Users {
+		key := userKey(d.Id)
+		users[d.Id] = true
+		if d.Id > int(s.UserIncreaseId) {
+			s.UserIncreaseId = int32(d.Id)
+		}
+		v, ok := s.Users.Load(d.Id)
+		if !ok {
+			if _, known := s.synced[key]; !known {
+				s.Users.Store(d.Id, d)
+			}
+			continue
+		}
+		if h := configHash(v); h != s.synced[key] || h == configHash(d) {
+			continue
+		}
+		s.Users.Store(d.Id, d)
+	}
+	s.Users.Range(func(key, value interface{}) bool {
+		m := value.(*User)
+		if !users[m.Id] && s.synced[userKey(m.Id)] == configHash(m) {
+			s.Users.Delete(key)
+		}
+		return true
+	})
+
+	if snap.Global != nil && (s.Global == nil || configHash(s.Global) == s.synced[globalKeyName] && configHash(snap.Global) != s.synced[globalKeyName]) {
+		s.Global = snap.Global
+	}
+
+	// 客户端对象被替换后重新关联隧道和域名
+	s.Tasks.Range(func(key, value interface{}) bool {
+		t := value.(*Tunnel)
+		if c, err := s.GetClient(t.Client.Id); err == nil && c != t.Client {
+			t.Client = c
+		}
+		return true
+	})
+	s.Hosts.Range(func(key, value interface{}) bool {
+		h := value.(*Host)
+		if c, err := s.GetClient(h.Client.Id); err == nil && c != h.Client {
+			h.Client = c
+		}
+		return true
+	})
+	return
+}
+
+func initClientRate(c *Client) {
+	if c.RateLimit > 0 {
+		c.Rate = rate.NewRate(int64(c.RateLimit * 1024))
+	} else {
+		c.Rate = rate.NewRate(int64(2 << 23))
+	}
+	c.Rate.Start()
+	c.NowConn = 0
+}
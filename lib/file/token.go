@@ -0,0 +1,144 @@
+package file
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/crypt"
+)
+
+// api 令牌的权限范围，格式为 资源:read 或 资源:write，write 包含 read，* 表示全部权限
+var ApiScopeResources = []string{"clients", "tunnels", "hosts", "global", "tokens", "audit", "bans"}
+
+const ApiTokenPrefix = "nps_"
+
+// ApiToken 是 /api/v1 使用的令牌，只保存令牌的 sha256
+type ApiToken struct {
+	Id           int
+	Name         string
+	Hash         string   // 令牌的 sha256
+	Hint         string   // 令牌的前几位，用于在列表中区分
+	Scopes       []string // 权限范围
+	ExpireTime   int64    // 过期时间，0 表示永不过期
+	CreateTime   string
+	LastUsedTime int64
+}
+
+func hashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Expired 判断令牌是否已经过期
+func (t *ApiToken) Expired() bool {
+	return t.ExpireTime != 0 && time.Now().Unix() > t.ExpireTime
+}
+
+// Allow 判断令牌是否有访问资源的权限
+func (t *ApiToken) Allow(resource string, write bool) bool {
+	for _, s := range t.Scopes {
+		if s == "*" || s == resource+":write" || (!write && s == resource+":read") {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers 判断令牌是否拥有 scope 的全部权限，令牌只能创建不超过自身权限的令牌
+func (t *ApiToken) Covers(scope string) bool {
+	if scope == "*" {
+		for _, s := range t.Scopes {
+			if s == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	resource, level, _ := strings.Cut(scope, ":")
+	return t.Allow(resource, level == "write")
+}
+
+// ValidApiScope 判断权限范围是否合法
+func ValidApiScope(scope string) bool {
+	if scope == "*" {
+		return true
+	}
+	for _, r := range ApiScopeResources {
+		if scope == r+":read" || scope == r+":write" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewApiToken 创建令牌，返回的明文令牌只在创建时可见
+func (s *DbUtils) NewApiToken(t *ApiToken) (token string, err error) {
+	for _, scope := range t.Scopes {
+		if !ValidApiScope(scope) {
+			return "", errors.New("invalid scope " + scope)
+		}
+	}
+	token = ApiTokenPrefix + crypt.GetSecretString(40)
+	t.Hash = hashApiToken(token)
+	t.Hint = token[:len(ApiTokenPrefix)+4]
+	if t.Id == 0 {
+		t.Id = int(s.JsonDb.GetTokenId())
+	}
+	t.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+	s.JsonDb.Tokens.Store(t.Id, t)
+	s.JsonDb.Flush()
+	return token, nil
+}
+
+func (s *DbUtils) DelApiToken(id int) error {
+	if _, ok := s.JsonDb.Tokens.Load(id); !ok {
+		return errors.New("the token is not exist")
+	}
+	s.JsonDb.Tokens.Delete(id)
+	s.JsonDb.Flush()
+	return nil
+}
+
+func (s *DbUtils) GetApiTokens() []*ApiToken {
+	list := make([]*ApiToken, 0)
+	s.JsonDb.Tokens.Range(func(key, value interface{}) bool {
+		list = append(list, value.(*ApiToken))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+func (s *DbUtils) GetApiTokenById(id int) (*ApiToken, error) {
+	if v, ok := s.JsonDb.Tokens.Load(id); ok {
+		return v.(*ApiToken), nil
+	}
+	return nil, errors.New("the token is not exist")
+}
+
+// GetApiToken 根据明文令牌查找，过期的令牌返回错误
+func (s *DbUtils) GetApiToken(token string) (t *ApiToken, err error) {
+	hash := hashApiToken(token)
+	s.JsonDb.Tokens.Range(func(key, value interface{}) bool {
+		v := value.(*ApiToken)
+		if subtle.ConstantTimeCompare([]byte(v.Hash), []byte(hash)) == 1 {
+			t = v
+			return false
+		}
+		return true
+	})
+	if t == nil {
+		return nil, errors.New("invalid token")
+	}
+	if t.Expired() {
+		return nil, errors.New("the token has expired")
+	}
+	atomic.StoreInt64(&t.LastUsedTime, time.Now().Unix())
+	return t, nil
+}
@@ -0,0 +1,22 @@
+package file
+
+import "testing"
+
+func TestApiTokenCovers(t *testing.T) {
+	tk := &ApiToken{Scopes: []string{"tokens:write", "clients:read"}}
+	for scope, want := range map[string]bool{
+		"tokens:write":  true,
+		"tokens:read":   true,
+		"clients:read":  true,
+		"clients:write": false,
+		"hosts:read":    false,
+		"*":             false,
+	} {
+		if tk.Covers(scope) != want {
+			t.Fatalf("covers %s want %v", scope, want)
+		}
+	}
+	if !(&ApiToken{Scopes: []string{"*"}}).Covers("*") {
+		t.Fatal("* should cover *")
+	}
+}
@@ -0,0 +1,123 @@
+package file
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/crypt"
+)
+
+const recoveryCodeNum = 10
+
+// Totp 是管理员、web 用户或客户端 web 登录的两步验证配置
+type Totp struct {
+	Secret        string
+	RecoveryCodes []string // 未使用的恢复码的 sha256
+}
+
+// 每个密钥最后一次通过验证的周期，同一个动态码不能重复使用
+var totpLastStep sync.Map
+
+func (t *Totp) Enabled() bool {
+	return t != nil && t.Secret != ""
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewTotp 使用已验证的密钥创建配置，返回只显示一次的恢复码
+func NewTotp(secret string) (*Totp, []string) {
+	t := &Totp{Secret: secret}
+	codes := make([]string, recoveryCodeNum)
+	for i := range codes {
+		c := crypt.GetSecretString(10)
+		codes[i] = c[:5] + "-" + c[5:]
+		t.RecoveryCodes = append(t.RecoveryCodes, hashRecoveryCode(c))
+	}
+	return t, codes
+}
+
+// verify 验证动态码或恢复码，使用了恢复码时 recovery 为 true，恢复码的作废需要持有 storeLock
+func (t *Totp) verify(code string) (ok, recovery bool) {
+	if !t.Enabled() {
+		return false, false
+	}
+	if step, ok := crypt.VerifyTotp(t.Secret, code, time.Now()); ok {
+		return acceptStep(t.Secret, step), false
+	}
+	hash := hashRecoveryCode(code)
+	for i, v := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(v), []byte(hash)) == 1 {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i:i], t.RecoveryCodes[i+1:]...)
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// acceptStep 记录密钥通过验证的周期，并发的请求中同一个周期只有一个可以通过
+func acceptStep(secret string, step int64) bool {
+	for {
+		last, loaded := totpLastStep.LoadOrStore(secret, step)
+		if !loaded {
+			return true
+		}
+		if step <= last.(int64) {
+			return false
+		}
+		if totpLastStep.CompareAndSwap(secret, last, step) {
+			return true
+		}
+	}
+}
+
+// VerifyTotp 验证两步验证码，恢复码使用后立即作废。
+// 验证与保存数据互斥，同一个恢复码不会被并发的请求重复使用，也不会在序列化时被修改
+func (s *DbUtils) VerifyTotp(t *Totp, code string) bool {
+	s.JsonDb.storeLock.Lock()
+	ok, recovery := t.verify(code)
+	s.JsonDb.storeLock.Unlock()
+	if recovery {
+		s.JsonDb.Flush()
+	}
+	return ok
+}
+
+// SetAdminTotp 设置管理员的两步验证，t 为 nil 时关闭
+func (s *DbUtils) SetAdminTotp(t *Totp) error {
+	g := new(Glob)
+	if s.JsonDb.Global != nil {
+		*g = *s.JsonDb.Global
+	}
+	g.AdminTotp = t
+	s.JsonDb.Global = g
+	s.JsonDb.Flush()
+	return nil
+}
+
+// SetUserTotp 设置 web 用户的两步验证，t 为 nil 时关闭
+func (s *DbUtils) SetUserTotp(u *User, t *Totp) error {
+	v := new(User)
+	*v = *u
+	v.Totp = t
+	return s.UpdateUser(v)
+}
+
+// SetClientTotp 设置客户端 web 登录的两步验证，t 为 nil 时关闭
+func (s *DbUtils) SetClientTotp(c *Client, t *Totp) error {
+	c.Lock()
+	c.Totp = t
+	c.Unlock()
+	s.JsonDb.StoreClientsToJsonFile()
+	return nil
+}
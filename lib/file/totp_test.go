@@ -0,0 +1,39 @@
+package file
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/crypt"
+)
+
+func TestVerifyTotpOnce(t *testing.T) {
+	db := &DbUtils{JsonDb: &JsonDb{Store: NewJsonStore(t.TempDir())}}
+	totp, codes := NewTotp(crypt.NewTotpSecret())
+	code, err := crypt.TotpCode(totp.Secret, crypt.TotpStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{code, codes[0]} {
+		var passed int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if db.VerifyTotp(totp, c) {
+					atomic.AddInt32(&passed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if passed != 1 {
+			t.Fatalf("code %s passed %d times", c, passed)
+		}
+	}
+	if len(totp.RecoveryCodes) != len(codes)-1 {
+		t.Fatal("used recovery code should be removed")
+	}
+}
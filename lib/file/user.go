@@ -0,0 +1,238 @@
+package file
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// web 用户的角色，角色绑定到一组客户端，只对这些客户端的隧道和域名生效
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// 权限
+const (
+	PermView          = "view"
+	PermTunnelCreate  = "tunnel:create"
+	PermTunnelEdit    = "tunnel:edit"
+	PermTunnelDelete  = "tunnel:delete"
+	PermTunnelControl = "tunnel:control" // 启动、停止
+	PermClientManage  = "client:manage"
+	PermGlobal        = "global:settings"
+	PermGlobalIpList  = "global:iplist" // 全局黑白名单
+)
+
+// RolePermissions 是各角色拥有的权限，global 开头的权限只有绑定到所有客户端时才生效
+var RolePermissions = map[string][]string{
+	RoleViewer:   {PermView},
+	RoleOperator: {PermView, PermTunnelCreate, PermTunnelEdit, PermTunnelControl, PermGlobalIpList},
+	RoleAdmin: {PermView, PermTunnelCreate, PermTunnelEdit, PermTunnelDelete, PermTunnelControl,
+		PermClientManage, PermGlobal, PermGlobalIpList},
+}
+
+// RoleBinding 将角色绑定到一组客户端，ClientIds 为空表示所有客户端
+type RoleBinding struct {
+	Role      string
+	ClientIds []int
+}
+
+func (b *RoleBinding) has(perm string) bool {
+	for _, p := range RolePermissions[b.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *RoleBinding) covers(clientId int) bool {
+	if len(b.ClientIds) == 0 {
+		return true
+	}
+	if clientId == 0 {
+		return false
+	}
+	for _, id := range b.ClientIds {
+		if id == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+// String 格式为 角色:客户端id,客户端id，绑定所有客户端时只有角色
+func (b *RoleBinding) String() string {
+	if len(b.ClientIds) == 0 {
+		return b.Role
+	}
+	ids := make([]string, len(b.ClientIds))
+	for i, id := range b.ClientIds {
+		ids[i] = strconv.Itoa(id)
+	}
+	return b.Role + ":" + strings.Join(ids, ",")
+}
+
+// ParseRoleBindings 解析每行一个的角色绑定，如 operator:2,3
+func ParseRoleBindings(s string) ([]*RoleBinding, error) {
+	list := make([]*RoleBinding, 0)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		b := new(RoleBinding)
+		role := line
+		if i := strings.Index(line, ":"); i >= 0 {
+			role = strings.TrimSpace(line[:i])
+			for _, v := range strings.Split(line[i+1:], ",") {
+				if v = strings.TrimSpace(v); v == "" {
+					continue
+				}
+				id, err := strconv.Atoi(v)
+				if err != nil || id <= 0 {
+					return nil, errors.New("invalid client id " + v)
+				}
+				b.ClientIds = append(b.ClientIds, id)
+			}
+			if len(b.ClientIds) == 0 {
+				return nil, errors.New("no client id in " + line)
+			}
+		}
+		if _, ok := RolePermissions[role]; !ok {
+			return nil, errors.New("invalid role " + role)
+		}
+		b.Role = role
+		list = append(list, b)
+	}
+	return list, nil
+}
+
+// User 是 web 管理端的用户，与客户端的 WebUserName 无关
+type User struct {
+	Id         int
+	Username   string
+	Password   string // bcrypt
+	Status     bool
+	Remark     string
+	Bindings   []*RoleBinding
+	Totp       *Totp // 两步验证，未开启时为 nil
+	CreateTime string
+}
+
+func (u *User) SetPassword(password string) error {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.Password = string(b)
+	return nil
+}
+
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+}
+
+// Can 判断用户对客户端是否有权限，clientId 为 0 时要求角色绑定到所有客户端
+func (u *User) Can(perm string, clientId int) bool {
+	for _, b := range u.Bindings {
+		if b.has(perm) && b.covers(clientId) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAny 判断用户是否对某个客户端有权限，用于显示菜单和按钮
+func (u *User) CanAny(perm string) bool {
+	for _, b := range u.Bindings {
+		if b.has(perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions 返回用户在任一客户端上拥有的权限
+func (u *User) Permissions() map[string]bool {
+	m := make(map[string]bool)
+	for _, b := range u.Bindings {
+		for _, p := range RolePermissions[b.Role] {
+			if len(b.ClientIds) == 0 || !strings.HasPrefix(p, "global:") {
+				m[p] = true
+			}
+		}
+	}
+	return m
+}
+
+func (s *DbUtils) NewUser(u *User) error {
+	if u.Username == "" {
+		return errors.New("username is required")
+	}
+	if _, err := s.GetUserByName(u.Username); err == nil {
+		return errors.New("web login username duplicate, please reset")
+	}
+	if u.Id == 0 {
+		u.Id = int(s.JsonDb.GetUserId())
+	}
+	u.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+	s.JsonDb.Users.Store(u.Id, u)
+	s.JsonDb.Flush()
+	return nil
+}
+
+func (s *DbUtils) UpdateUser(u *User) error {
+	if v, err := s.GetUserByName(u.Username); err == nil && v.Id != u.Id {
+		return errors.New("web login username duplicate, please reset")
+	}
+	s.JsonDb.Users.Store(u.Id, u)
+	s.JsonDb.Flush()
+	return nil
+}
+
+func (s *DbUtils) DelUser(id int) error {
+	if _, ok := s.JsonDb.Users.Load(id); !ok {
+		return errors.New("the user is not exist")
+	}
+	s.JsonDb.Users.Delete(id)
+	s.JsonDb.Flush()
+	return nil
+}
+
+func (s *DbUtils) GetUsers() []*User {
+	list := make([]*User, 0)
+	s.JsonDb.Users.Range(func(key, value interface{}) bool {
+		list = append(list, value.(*User))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+func (s *DbUtils) GetUserById(id int) (*User, error) {
+	if v, ok := s.JsonDb.Users.Load(id); ok {
+		return v.(*User), nil
+	}
+	return nil, errors.New("the user is not exist")
+}
+
+func (s *DbUtils) GetUserByName(username string) (u *User, err error) {
+	s.JsonDb.Users.Range(func(key, value interface{}) bool {
+		if v := value.(*User); v.Username == username {
+			u = v
+			return false
+		}
+		return true
+	})
+	if u == nil {
+		err = errors.New("the user is not exist")
+	}
+	return
+}
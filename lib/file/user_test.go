@@ -0,0 +1,29 @@
+package file
+
+import "testing"
+
+func TestUserCan(t *testing.T) {
+	bindings, err := ParseRoleBindings("viewer\noperator: 2, 3\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{Bindings: bindings}
+	if !u.Can(PermView, 5) || u.Can(PermTunnelEdit, 5) {
+		t.Fatal("viewer of all clients should only view client 5")
+	}
+	if !u.Can(PermTunnelEdit, 2) || u.Can(PermTunnelDelete, 2) {
+		t.Fatal("operator of client 2 should edit but not delete")
+	}
+	if u.Can(PermGlobalIpList, 0) {
+		t.Fatal("operator of some clients should not change global lists")
+	}
+	if _, err := ParseRoleBindings("owner:1"); err == nil {
+		t.Fatal("unknown role should be rejected")
+	}
+	if _, err := ParseRoleBindings("admin:x"); err == nil {
+		t.Fatal("invalid client id should be rejected")
+	}
+	if s := bindings[1].String(); s != "operator:2,3" {
+		t.Fatalf("unexpected binding %s", s)
+	}
+}
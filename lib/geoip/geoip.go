@@ -0,0 +1,94 @@
+// Package geoip 从本地 MaxMind 格式（mmdb）的数据库查询 ip 所在的国家和 ASN
+package geoip
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info 是 ip 的查询结果，数据库中没有该 ip 时为零值
+type Info struct {
+	Country string // ISO 3166 国家代码，大写
+	Asn     uint
+	AsnOrg  string
+}
+
+// GeoLite2-Country、GeoLite2-City 以及 GeoLite2-ASN 中使用的字段
+type record struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Asn    uint   `maxminddb:"autonomous_system_number"`
+	AsnOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+var countryDb, asnDb atomic.Pointer[maxminddb.Reader]
+
+// Open 打开国家和 ASN 数据库，路径为空表示不使用，两个路径可以是同一个文件
+func Open(countryPath, asnPath string) error {
+	for _, v := range []struct {
+		path string
+		db   *atomic.Pointer[maxminddb.Reader]
+	}{{countryPath, &countryDb}, {asnPath, &asnDb}} {
+		if v.path == "" {
+			continue
+		}
+		r, err := maxminddb.Open(v.path)
+		if err != nil {
+			return err
+		}
+		if old := v.db.Swap(r); old != nil {
+			old.Close()
+		}
+	}
+	return nil
+}
+
+// Enabled 判断是否打开了数据库
+func Enabled() bool {
+	return countryDb.Load() != nil || asnDb.Load() != nil
+}
+
+// Lookup 查询 ip 的国家和 ASN，没有打开数据库时返回零值
+func Lookup(ip netip.Addr) Info {
+	var info Info
+	if r := countryDb.Load(); r != nil {
+		var rec record
+		if r.Lookup(net.IP(ip.Unmap().AsSlice()), &rec) == nil {
+			info.Country = rec.Country.IsoCode
+			// 只有注册国家的网段，例如 anycast 地址
+			if info.Country == "" {
+				info.Country = rec.RegisteredCountry.IsoCode
+			}
+			info.Country = strings.ToUpper(info.Country)
+		}
+	}
+	if r := asnDb.Load(); r != nil {
+		var rec record
+		if r.Lookup(net.IP(ip.Unmap().AsSlice()), &rec) == nil {
+			info.Asn, info.AsnOrg = rec.Asn, rec.AsnOrg
+		}
+	}
+	return info
+}
+
+// Country 返回地址所在的国家代码，addr 可以带端口，查不到时返回空
+func Country(addr string) string {
+	if countryDb.Load() == nil {
+		return ""
+	}
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return Lookup(ap.Addr()).Country
+	}
+	if ip, err := netip.ParseAddr(strings.Trim(addr, "[]")); err == nil {
+		return Lookup(ip).Country
+	}
+	return ""
+}
@@ -0,0 +1,34 @@
+package geoip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	if Country("1.2.3.4") != "" || Enabled() {
+		t.Fatal("should return nothing before the database is opened")
+	}
+	if err := Open("testdata/test.mmdb", "testdata/test.mmdb"); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ip   string
+		want Info
+	}{
+		{"1.2.3.4", Info{"CN", 4134, "CHINANET"}},
+		{"::ffff:5.6.7.8", Info{"HK", 0, ""}},
+		{"8.8.8.8", Info{"US", 15169, "GOOGLE"}},
+		{"9.9.9.9", Info{"CH", 0, ""}},
+		{"2001:db8::1", Info{"JP", 2497, ""}},
+		{"10.0.0.1", Info{}},
+	}
+	for _, c := range cases {
+		if got := Lookup(netip.MustParseAddr(c.ip)); got != c.want {
+			t.Fatalf("lookup %s want %+v got %+v", c.ip, c.want, got)
+		}
+	}
+	if Country("[2001:db8::1]:443") != "JP" || Country("1.2.3.4:80") != "CN" || Country("bad") != "" {
+		t.Fatal("country error")
+	}
+}
@@ -0,0 +1,382 @@
+// Package iplist 解析和匹配 ip 黑白名单
+//
+// 名单每行一条，格式为
+//
+//	地址 [expires=过期时间] [# 注释]
+//
+// 地址可以是单个 ip（1.2.3.4、2001:db8::1）、CIDR（10.0.0.0/8、2001:db8::/32）或者范围（1.2.3.4-1.2.3.90），
+// 过期时间格式为 2006-01-02、2006-01-02T15:04:05（本地时间）或 RFC3339，过期后该条目不再生效。
+//
+// 地址也可以是 country:CN,HK 或者 asn:13335,AS16509，通过 geoip 数据库匹配，
+// 前面加 ! 表示不在其中时命中，数据库中查不到的 ip 不会命中这两种条目
+package iplist
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/geoip"
+	"github.com/astaxie/beego/logs"
+)
+
+// Entry 是名单中的一条记录
+type Entry struct {
+	Value   string    // 地址，不含过期时间和注释
+	Comment string    // # 后面的注释
+	Expires time.Time // 为零值时永不过期
+	ranges  []netip.Prefix
+	geo     *geoRule
+}
+
+// geoRule 是 country: 和 asn: 条目
+type geoRule struct {
+	not       bool
+	countries map[string]bool
+	asns      map[uint]bool
+}
+
+func (g *geoRule) match(info geoip.Info) bool {
+	var hit bool
+	if g.countries != nil {
+		if info.Country == "" {
+			return false
+		}
+		hit = g.countries[info.Country]
+	} else {
+		if info.Asn == 0 {
+			return false
+		}
+		hit = g.asns[info.Asn]
+	}
+	return hit != g.not
+}
+
+// 测试时替换
+var geoLookup = geoip.Lookup
+
+// Expired 判断条目在 now 时是否已经过期
+func (e *Entry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+func (e *Entry) String() string {
+	if e.Comment == "" {
+		return e.Value
+	}
+	return e.Value + " # " + e.Comment
+}
+
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// ParseEntry 解析一行，空行和只有注释的行返回 nil
+func ParseEntry(line string) (*Entry, error) {
+	e := new(Entry)
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		e.Comment = strings.TrimSpace(line[i+1:])
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	e.Value = fields[0]
+	for _, f := range fields[1:] {
+		v := strings.TrimPrefix(f, "expires=")
+		if v == f {
+			return nil, fmt.Errorf("%s: unknown option %s", e.Value, f)
+		}
+		var err error
+		for _, layout := range timeLayouts {
+			if e.Expires, err = time.ParseInLocation(layout, v, time.Local); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid expires %s", e.Value, v)
+		}
+	}
+	var err error
+	if isGeo(e.Value) {
+		e.geo, err = parseGeo(e.Value)
+	} else {
+		e.ranges, err = parseRanges(e.Value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func isGeo(s string) bool {
+	s = strings.ToLower(strings.TrimPrefix(s, "!"))
+	return strings.HasPrefix(s, "country:") || strings.HasPrefix(s, "asn:")
+}
+
+// parseGeo 解析 [!]country:CN,HK 和 [!]asn:13335,AS16509
+func parseGeo(s string) (*geoRule, error) {
+	g := &geoRule{not: strings.HasPrefix(s, "!")}
+	kind, values, _ := strings.Cut(strings.TrimPrefix(s, "!"), ":")
+	country := strings.EqualFold(kind, "country")
+	if country {
+		g.countries = make(map[string]bool)
+	} else {
+		g.asns = make(map[uint]bool)
+	}
+	for _, v := range strings.Split(values, ",") {
+		if country {
+			v = strings.ToUpper(v)
+			if len(v) != 2 || v[0] < 'A' || v[0] > 'Z' || v[1] < 'A' || v[1] > 'Z' {
+				return nil, fmt.Errorf("invalid country code %s in %s", v, s)
+			}
+			g.countries[v] = true
+			continue
+		}
+		if len(v) > 2 && strings.EqualFold(v[:2], "as") {
+			v = v[2:]
+		}
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid asn %s in %s", v, s)
+		}
+		g.asns[uint(n)] = true
+	}
+	return g, nil
+}
+
+// parseRanges 把地址转换成前缀，范围会拆成若干个 CIDR
+func parseRanges(s string) ([]netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s", s)
+		}
+		return []netip.Prefix{unmapPrefix(p).Masked()}, nil
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, err1 := netip.ParseAddr(s[:i])
+		to, err2 := netip.ParseAddr(s[i+1:])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid ip range %s", s)
+		}
+		from, to = from.Unmap(), to.Unmap()
+		if from.Is4() != to.Is4() || from.Compare(to) > 0 {
+			return nil, fmt.Errorf("invalid ip range %s", s)
+		}
+		return rangePrefixes(from, to), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip %s", s)
+	}
+	a = a.Unmap().WithZone("")
+	return []netip.Prefix{netip.PrefixFrom(a, a.BitLen())}, nil
+}
+
+func unmapPrefix(p netip.Prefix) netip.Prefix {
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p
+}
+
+// rangePrefixes 把 from-to 拆成最少的 CIDR
+func rangePrefixes(from, to netip.Addr) []netip.Prefix {
+	var out []netip.Prefix
+	for {
+		bits := from.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(from, bits-1).Masked()
+			if p.Addr() != from || lastAddr(p).Compare(to) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(from, bits)
+		out = append(out, p)
+		last := lastAddr(p)
+		if last.Compare(to) >= 0 {
+			return out
+		}
+		from = last.Next()
+	}
+}
+
+// lastAddr 返回前缀中最后一个地址
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// List 是编译好的名单，ipv4 按 ipv4-mapped 地址和 ipv6 放在同一棵前缀树中
+type List struct {
+	root node
+	geo  []*Entry // 前缀树中没有命中时按顺序检查
+	size int
+}
+
+type node struct {
+	children [2]*node
+	entries  []*Entry
+}
+
+// Parse 编译名单，遇到无法解析的行时返回错误
+func Parse(lines []string) (*List, error) {
+	l := new(List)
+	for _, line := range lines {
+		e, err := ParseEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		l.Add(e)
+	}
+	return l, nil
+}
+
+// New 编译名单，跳过无法解析的行
+func New(lines []string) *List {
+	l := new(List)
+	for _, line := range lines {
+		e, err := ParseEntry(line)
+		if err != nil {
+			logs.Warn("ignore ip list entry %s", err)
+			continue
+		}
+		l.Add(e)
+	}
+	return l
+}
+
+// Check 检查名单的每一行是否可以解析
+func Check(lines []string) error {
+	_, err := Parse(lines)
+	return err
+}
+
+// Add 添加一条记录，e 为 nil 时忽略
+func (l *List) Add(e *Entry) {
+	if e == nil {
+		return
+	}
+	if e.geo != nil {
+		l.geo = append(l.geo, e)
+	}
+	for _, p := range e.ranges {
+		a := p.Addr().As16()
+		bits := p.Bits()
+		if p.Addr().Is4() {
+			bits += 96
+		}
+		n := &l.root
+		for i := 0; i < bits; i++ {
+			bit := a[i/8] >> (7 - i%8) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = new(node)
+			}
+			n = n.children[bit]
+		}
+		n.entries = append(n.entries, e)
+	}
+	l.size++
+}
+
+// Len 返回记录的条数
+func (l *List) Len() int {
+	if l == nil {
+		return 0
+	}
+	return l.size
+}
+
+// Lookup 查找包含 addr 的未过期记录，有多条时返回范围最小的，都没有命中时再检查 country 和 asn 条目。addr 可以带端口
+func (l *List) Lookup(addr string) *Entry {
+	if l.Len() == 0 {
+		return nil
+	}
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	a := ip.As16()
+	var found *Entry
+	n := &l.root
+	for i := 0; n != nil; i++ {
+		for _, e := range n.entries {
+			if !e.Expired(now) {
+				found = e
+				break
+			}
+		}
+		if i == 128 {
+			break
+		}
+		n = n.children[a[i/8]>>(7-i%8)&1]
+	}
+	if found == nil && len(l.geo) > 0 {
+		info := geoLookup(ip)
+		for _, e := range l.geo {
+			if !e.Expired(now) && e.geo.match(info) {
+				return e
+			}
+		}
+	}
+	return found
+}
+
+// Contains 判断 addr 是否在名单中
+func (l *List) Contains(addr string) bool {
+	return l.Lookup(addr) != nil
+}
+
+func parseAddr(addr string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return ap.Addr().Unmap().WithZone(""), nil
+	}
+	a, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+	if err != nil {
+		return a, err
+	}
+	return a.Unmap().WithZone(""), nil
+}
+
+// 名单的版本，保存或重新加载配置后增加，之前缓存的名单在下一次使用时重新编译
+var generation int64
+
+// Invalidate 使所有缓存的名单失效，名单被原地修改后需要调用，名单较多时只在保存配置时调用
+func Invalidate() {
+	atomic.AddInt64(&generation, 1)
+}
+
+// Cache 缓存由字符串列表编译的名单，列表被整体替换或者调用 Invalidate 后重新编译
+type Cache struct {
+	v atomic.Value
+}
+
+type cached struct {
+	lines []string
+	gen   int64
+	list  *List
+}
+
+// Get 返回 lines 编译后的名单
+func (c *Cache) Get(lines []string) *List {
+	gen := atomic.LoadInt64(&generation)
+	if v, ok := c.v.Load().(*cached); ok && v.gen == gen && sameSlice(v.lines, lines) {
+		return v.list
+	}
+	l := New(lines)
+	c.v.Store(&cached{lines: lines, gen: gen, list: l})
+	return l
+}
+
+func sameSlice(a, b []string) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
@@ -0,0 +1,125 @@
+package iplist
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/geoip"
+)
+
+func TestList(t *testing.T) {
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	l, err := Parse([]string{
+		"",
+		"# 注释",
+		"10.0.0.0/8 # office",
+		"10.1.2.0/24 # lab",
+		"1.2.3.4-1.2.3.90",
+		"2001:db8::/32",
+		"8.8.8.8 expires=" + yesterday,
+		"9.9.9.9 expires=2999-01-01T00:00:00",
+		"::ffff:7.7.7.7",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		addr    string
+		comment string
+		match   bool
+	}{
+		{"10.9.9.9:80", "office", true},
+		{"10.1.2.3", "lab", true},
+		{"[::ffff:10.1.3.1]:443", "office", true},
+		{"11.0.0.1", "", false},
+		{"1.2.3.3", "", false},
+		{"1.2.3.4", "", true},
+		{"1.2.3.90", "", true},
+		{"1.2.3.91", "", false},
+		{"[2001:db8:1::1]:80", "", true},
+		{"2001:db9::1", "", false},
+		{"8.8.8.8", "", false},
+		{"9.9.9.9", "", true},
+		{"7.7.7.7", "", true},
+		{"bad", "", false},
+	}
+	for _, c := range cases {
+		e := l.Lookup(c.addr)
+		if (e != nil) != c.match || (e != nil && e.Comment != c.comment) {
+			t.Fatalf("lookup %s want %v %q got %+v", c.addr, c.match, c.comment, e)
+		}
+	}
+	for _, bad := range []string{"1.2.3", "1.2.3.4/33", "1.2.3.90-1.2.3.4", "1.2.3.4-::1", "1.2.3.4 expires=tomorrow", "1.2.3.4 foo"} {
+		if err := Check([]string{bad}); err == nil {
+			t.Fatalf("%s should be invalid", bad)
+		}
+	}
+}
+
+func TestRangePrefixes(t *testing.T) {
+	got := rangePrefixes(netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("1.2.3.90"))
+	want := []string{"1.2.3.4/30", "1.2.3.8/29", "1.2.3.16/28", "1.2.3.32/27", "1.2.3.64/28", "1.2.3.80/29", "1.2.3.88/31", "1.2.3.90/32"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v", got)
+	}
+	for i := range got {
+		if got[i].String() != want[i] {
+			t.Fatalf("got %v", got)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	var c Cache
+	lines := []string{"1.1.1.1"}
+	if c.Get(lines) != c.Get(lines) {
+		t.Fatal("list should be cached")
+	}
+	if !c.Get([]string{"2.2.2.2"}).Contains("2.2.2.2") {
+		t.Fatal("list should be rebuilt after replaced")
+	}
+	lines = []string{"1.1.1.1"}
+	c.Get(lines)
+	lines[0] = "3.3.3.3"
+	Invalidate()
+	if !c.Get(lines).Contains("3.3.3.3") {
+		t.Fatal("list should be rebuilt after invalidated")
+	}
+}
+
+func TestGeo(t *testing.T) {
+	defer func(f func(netip.Addr) geoip.Info) { geoLookup = f }(geoLookup)
+	geoLookup = func(ip netip.Addr) geoip.Info {
+		switch ip.String() {
+		case "1.1.1.1":
+			return geoip.Info{Country: "CN", Asn: 4134}
+		case "2.2.2.2":
+			return geoip.Info{Country: "HK", Asn: 13335}
+		case "3.3.3.3":
+			return geoip.Info{Country: "US", Asn: 16509}
+		}
+		return geoip.Info{}
+	}
+	l, err := Parse([]string{"3.3.3.0/24 # office", "asn:AS13335,16509 # cloud", "country:cn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, comment := range map[string]string{"1.1.1.1:80": "", "2.2.2.2": "cloud", "3.3.3.3": "office"} {
+		if e := l.Lookup(addr); e == nil || e.Comment != comment {
+			t.Fatalf("lookup %s want %q got %+v", addr, comment, e)
+		}
+	}
+	if l.Contains("4.4.4.4") {
+		t.Fatal("unknown ip should not match")
+	}
+	l, _ = Parse([]string{"!country:CN,HK"})
+	if l.Contains("1.1.1.1") || l.Contains("2.2.2.2") || !l.Contains("3.3.3.3") || l.Contains("4.4.4.4") {
+		t.Fatal("negated country error")
+	}
+	for _, bad := range []string{"country:CHN", "country:", "asn:ASX", "asn:0", "!1.2.3.4"} {
+		if err := Check([]string{bad}); err == nil {
+			t.Fatalf("%s should be invalid", bad)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 连接统计，按客户端、隧道、域名分别记录，由 /metrics 接口导出
+
+const (
+	Client = "client"
+	Tunnel = "tunnel"
+	Host   = "host"
+)
+
+// 全局密码认证的结果
+const (
+	ChallengeIssued  = "issued"
+	ChallengeSuccess = "success"
+	ChallengeFailure = "failure"
+)
+
+type key struct {
+	kind string
+	id   int
+}
+
+type counter struct {
+	attempts uint64
+	failures uint64
+	conns    int64
+}
+
+// Stats 是某个对象的连接统计
+type Stats struct {
+	Attempts uint64
+	Failures uint64
+	Conns    int64
+}
+
+var (
+	counters   sync.Map // key -> *counter
+	challenges sync.Map // result -> *uint64
+)
+
+func get(kind string, id int) *counter {
+	if v, ok := counters.Load(key{kind, id}); ok {
+		return v.(*counter)
+	}
+	v, _ := counters.LoadOrStore(key{kind, id}, new(counter))
+	return v.(*counter)
+}
+
+// Dial 记录一次向客户端发起的连接，err 不为空时同时记录失败
+func Dial(kind string, id int, err error) {
+	c := get(kind, id)
+	atomic.AddUint64(&c.attempts, 1)
+	if err != nil {
+		atomic.AddUint64(&c.failures, 1)
+	}
+}
+
+// Open 记录一个正在转发的连接，连接结束时调用返回的函数
+func Open(kind string, id int) (done func()) {
+	c := get(kind, id)
+	atomic.AddInt64(&c.conns, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&c.conns, -1)
+		})
+	}
+}
+
+// Get 返回对象的连接统计
+func Get(kind string, id int) Stats {
+	v, ok := counters.Load(key{kind, id})
+	if !ok {
+		return Stats{}
+	}
+	c := v.(*counter)
+	return Stats{
+		Attempts: atomic.LoadUint64(&c.attempts),
+		Failures: atomic.LoadUint64(&c.failures),
+		Conns:    atomic.LoadInt64(&c.conns),
+	}
+}
+
+// Challenge 记录一次全局密码认证
+func Challenge(result string) {
+	v, ok := challenges.Load(result)
+	if !ok {
+		v, _ = challenges.LoadOrStore(result, new(uint64))
+	}
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+// Challenges 返回全局密码认证的次数
+func Challenges(result string) uint64 {
+	if v, ok := challenges.Load(result); ok {
+		return atomic.LoadUint64(v.(*uint64))
+	}
+	return 0
+}
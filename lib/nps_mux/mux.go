@@ -86,6 +86,33 @@ func NewMux(c net.Conn, connType string, pingCheckThreshold int) *Mux {
 	return m
 }
 
+// Stats is a snapshot of the mux state, used by the server metrics
+type Stats struct {
+	Latency       float64 // seconds, smoothed by the latency counter
+	Bandwidth     float64 // bytes per second read from the underlying conn
+	Conns         int
+	ReceiveWindow uint64 // sum of the receive window size of all conns
+	SendWindow    uint64 // sum of the send window remaining of all conns
+}
+
+func (s *Mux) Stats() (st Stats) {
+	st.Latency = math.Float64frombits(atomic.LoadUint64(&s.latency))
+	st.Bandwidth = s.bw.Get()
+	s.connMap.RLock()
+	defer s.connMap.RUnlock()
+	st.Conns = len(s.connMap.cMap)
+	for _, c := range s.connMap.cMap {
+		if c == nil {
+			continue
+		}
+		maxSize, _, _ := c.receiveWindow.unpack(atomic.LoadUint64(&c.receiveWindow.maxSizeDone))
+		st.ReceiveWindow += uint64(maxSize)
+		maxSize, done, _ := c.sendWindow.unpack(atomic.LoadUint64(&c.sendWindow.maxSizeDone))
+		st.SendWindow += uint64(c.sendWindow.remainingSize(maxSize, done))
+	}
+	return
+}
+
 func (s *Mux) NewConn() (*conn, error) {
 	if s.IsClose {
 		return nil, errors.New("the mux has closed")
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/common"
 	"github.com/astaxie/beego/logs"
 	"github.com/pkg/errors"
@@ -72,6 +73,11 @@ func (pMux *PortMux) Start() error {
 				logs.Warn(err)
 				//close
 				pMux.Close()
+				return
+			}
+			if ban.IsBanned(conn.RemoteAddr().String()) {
+				conn.Close()
+				continue
 			}
 			go pMux.process(conn)
 		}
@@ -1,8 +1,31 @@
 package version
 
-const VERSION = "0.26.22"
+import (
+	"strconv"
+	"strings"
+)
+
+const VERSION = "0.26.23"
+
+// 从这个版本开始，客户端连接目标后会把连接结果回复给服务端
+const DialReportVersion = "0.26.23"
 
 // Compulsory minimum version, Minimum downward compatibility to this version
 func GetVersion() string {
 	return "0.26.0"
 }
+
+// AtLeast 判断版本号 v 是否不低于 min，版本号格式为 x.y.z
+func AtLeast(v, min string) bool {
+	a, b := strings.Split(v, "."), strings.Split(min, ".")
+	for i := range b {
+		var x int
+		if i < len(a) {
+			x, _ = strconv.Atoi(a[i])
+		}
+		if y, _ := strconv.Atoi(b[i]); x != y {
+			return x > y
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/cluster"
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/server/proxy"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// 集群模式：多个 nps 节点共用 cluster_shared_path 中的数据，
+// 每个隧道端口通过租约选出一个负责监听的节点，优先选择客户端当前连接的节点
+
+var clusterNode *clusterManager
+
+type clusterManager struct {
+	leases *cluster.Leases
+	ttl    time.Duration
+	owned  sync.Map // task id -> lease key
+}
+
+func initCluster() {
+	if !beego.AppConfig.DefaultBool("cluster_enable", false) {
+		return
+	}
+	node := beego.AppConfig.String("cluster_node_id")
+	if node == "" {
+		hostname, _ := os.Hostname()
+		node = hostname + ":" + beego.AppConfig.String("bridge_port")
+	}
+	ttl := time.Duration(beego.AppConfig.DefaultInt("cluster_lease_ttl", 15)) * time.Second
+	clusterNode = &clusterManager{
+		leases: cluster.NewLeases(beego.AppConfig.String("cluster_shared_path"), node, ttl),
+		ttl:    ttl,
+	}
+	logs.Info("cluster mode enabled, node %s", node)
+	go clusterNode.run()
+}
+
+func leaseKey(t *file.Tunnel) string {
+	proto := common.CONN_TCP
+	if t.Mode == "udp" {
+		proto = common.CONN_UDP
+	}
+	return fmt.Sprintf("%s/%s:%d", proto, t.ServerIp, t.Port)
+}
+
+// elected 判断隧道是否需要参与选举，密钥、p2p 以及配置文件模式产生的临时隧道只在本节点运行
+func elected(t *file.Tunnel) bool {
+	return !t.NoStore && t.Port > 0 && t.Mode != "secret" && t.Mode != "p2p" && t.Mode != "httpHostServer" && t.Mode != "webServer"
+}
+
+// candidate 判断本节点能否承载该隧道：客户端连接在本节点，或者隧道由服务端直接代理
+func candidate(t *file.Tunnel) bool {
+	if (t.Target != nil && t.Target.LocalProxy) || t.Client.Id == common.LOCALHOST_CLIENT_ID {
+		return true
+	}
+	_, ok := Bridge.Client.Load(t.Client.Id)
+	return ok
+}
+
+// accept 在启动隧道前检查本节点是否持有端口租约
+func (s *clusterManager) accept(t *file.Tunnel) bool {
+	if !elected(t) {
+		return true
+	}
+	if _, ok := s.owned.Load(t.Id); ok {
+		return true
+	}
+	if !candidate(t) {
+		return false
+	}
+	owned, err := s.leases.Update(append(s.ownedKeys(), leaseKey(t)))
+	if err != nil {
+		logs.Error("update cluster lease error %s", err)
+		return false
+	}
+	if owned[leaseKey(t)] {
+		s.owned.Store(t.Id, leaseKey(t))
+		return true
+	}
+	return false
+}
+
+func (s *clusterManager) ownedKeys() (keys []string) {
+	s.owned.Range(func(key, value interface{}) bool {
+		keys = append(keys, value.(string))
+		return true
+	})
+	return
+}
+
+func (s *clusterManager) run() {
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reconcile()
+	}
+}
+
+// reconcile 同步其他节点的修改，续约并根据租约启动或停止隧道
+func (s *clusterManager) reconcile() {
+	changed, err := file.GetDb().JsonDb.Sync()
+	if err != nil {
+		logs.Error("sync cluster db error %s", err)
+	}
+	for _, id := range changed {
+		// 配置被其他节点修改，停止后按新的配置重新启动
+		if _, ok := s.owned.Load(id); ok {
+			stopService(id)
+			s.owned.Delete(id)
+		}
+	}
+	want := make(map[string]int)
+	var keys []string
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		t := value.(*file.Tunnel)
+		if elected(t) && t.Status && candidate(t) {
+			want[leaseKey(t)] = t.Id
+			keys = append(keys, leaseKey(t))
+		}
+		return true
+	})
+	owned, err := s.leases.Update(keys)
+	if err != nil {
+		logs.Error("update cluster lease error %s", err)
+		return
+	}
+	s.owned.Range(func(key, value interface{}) bool {
+		if id, ok := want[value.(string)]; !ok || id != key.(int) || !owned[value.(string)] {
+			logs.Info("task %d %s is released by node %s", key.(int), value.(string), s.leases.Node())
+			stopService(key.(int))
+			s.owned.Delete(key)
+		}
+		return true
+	})
+	for key, id := range want {
+		if !owned[key] {
+			continue
+		}
+		if _, ok := RunList.Load(id); ok {
+			continue
+		}
+		if t, err := file.GetDb().GetTask(id); err == nil {
+			if _, ok := s.owned.LoadOrStore(id, key); !ok {
+				logs.Info("task %d %s is taken over by node %s", id, key, s.leases.Node())
+			}
+			if err := AddTask(t); err != nil {
+				s.owned.Delete(id)
+			}
+		}
+	}
+}
+
+// stopService 关闭本节点上运行的隧道，不修改隧道状态
+func stopService(id int) {
+	if v, ok := RunList.Load(id); ok {
+		if svr, ok := v.(proxy.Service); ok {
+			svr.Close()
+		}
+		RunList.Delete(id)
+	}
+}
+
+// ReleaseCluster 节点退出时释放持有的租约，其他节点可以立即接管
+func ReleaseCluster() {
+	if clusterNode != nil {
+		clusterNode.owned.Range(func(key, value interface{}) bool {
+			clusterNode.owned.Delete(key)
+			return true
+		})
+		clusterNode.leases.Release()
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/metrics"
+	"ehang.io/nps/lib/nps_mux"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// /metrics 接口，以 Prometheus 文本格式输出客户端、隧道、域名以及多路复用连接的运行数据
+
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples bytes.Buffer
+}
+
+type metricWriter struct {
+	families []*metricFamily
+	index    map[string]*metricFamily
+}
+
+func (s *metricWriter) add(name, typ, help, labels string, v float64) {
+	f, ok := s.index[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, typ: typ}
+		s.families = append(s.families, f)
+		s.index[name] = f
+	}
+	f.samples.WriteString(name)
+	if labels != "" {
+		f.samples.WriteString("{" + labels + "}")
+	}
+	f.samples.WriteString(" " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+}
+
+func (s *metricWriter) writeTo(b *bytes.Buffer) {
+	for _, f := range s.families {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		b.Write(f.samples.Bytes())
+	}
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels 按 key, value 的顺序生成标签
+func labels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(kv[i] + `="` + labelReplacer.Replace(kv[i+1]) + `"`)
+	}
+	return b.String()
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s *metricWriter) conns(kind, prefix, l string, id int) {
+	st := metrics.Get(kind, id)
+	s.add(prefix+"_connection_attempts_total", "counter", "Connections opened through the client.", l, float64(st.Attempts))
+	s.add(prefix+"_connection_failures_total", "counter", "Connections which could not be opened through the client.", l, float64(st.Failures))
+}
+
+func (s *metricWriter) mux(l, channel string, st *nps_mux.Stats) {
+	l += "," + labels("channel", channel)
+	s.add("nps_mux_latency_seconds", "gauge", "Smoothed ping latency of the client mux.", l, st.Latency)
+	s.add("nps_mux_bandwidth_bytes", "gauge", "Estimated read bandwidth of the client mux in bytes per second.", l, st.Bandwidth)
+	s.add("nps_mux_conns", "gauge", "Streams currently open in the client mux.", l, float64(st.Conns))
+	s.add("nps_mux_receive_window_bytes", "gauge", "Sum of the receive window size of all streams.", l, float64(st.ReceiveWindow))
+	s.add("nps_mux_send_window_bytes", "gauge", "Sum of the remaining send window of all streams.", l, float64(st.SendWindow))
+}
+
+func collectMetrics() *bytes.Buffer {
+	w := &metricWriter{index: make(map[string]*metricFamily)}
+	db := file.GetDb().JsonDb
+
+	var clients []*file.Client
+	db.Clients.Range(func(key, value interface{}) bool {
+		clients = append(clients, value.(*file.Client))
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Id < clients[j].Id })
+	var online int
+	for _, c := range clients {
+		id := strconv.Itoa(c.Id)
+		l := labels("client_id", id, "remark", c.Remark)
+		tunnel, fileMux, ok := Bridge.MuxStats(c.Id)
+		if ok {
+			online++
+		}
+		w.add("nps_client_online", "gauge", "Whether the client is connected to the bridge.", l, boolValue(ok))
+		w.add("nps_client_inlet_bytes_total", "counter", "Inlet bytes of the client.", l, float64(c.Flow.InletFlow))
+		w.add("nps_client_export_bytes_total", "counter", "Export bytes of the client.", l, float64(c.Flow.ExportFlow))
+		w.add("nps_client_conns", "gauge", "Connections currently open through the client.", l, float64(c.NowConn))
+		w.conns(metrics.Client, "nps_client", l, c.Id)
+		if tunnel != nil {
+			w.mux(labels("client_id", id), "tunnel", tunnel)
+		}
+		if fileMux != nil {
+			w.mux(labels("client_id", id), "file", fileMux)
+		}
+	}
+	w.add("nps_bridge_clients_online", "gauge", "Clients connected to the bridge.", "", float64(online))
+
+	var tasks []*file.Tunnel
+	db.Tasks.Range(func(key, value interface{}) bool {
+		tasks = append(tasks, value.(*file.Tunnel))
+		return true
+	})
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Id < tasks[j].Id })
+	for _, t := range tasks {
+		l := labels("tunnel_id", strconv.Itoa(t.Id), "client_id", strconv.Itoa(t.Client.Id), "mode", t.Mode, "port", strconv.Itoa(t.Port))
+		_, running := RunList.Load(t.Id)
+		w.add("nps_tunnel_running", "gauge", "Whether the tunnel is listening on this node.", l, boolValue(running))
+		w.add("nps_tunnel_inlet_bytes_total", "counter", "Inlet bytes of the tunnel.", l, float64(t.Flow.InletFlow))
+		w.add("nps_tunnel_export_bytes_total", "counter", "Export bytes of the tunnel.", l, float64(t.Flow.ExportFlow))
+		w.add("nps_tunnel_conns", "gauge", "Connections currently open through the tunnel.", l, float64(metrics.Get(metrics.Tunnel, t.Id).Conns))
+		w.conns(metrics.Tunnel, "nps_tunnel", l, t.Id)
+	}
+
+	var hosts []*file.Host
+	db.Hosts.Range(func(key, value interface{}) bool {
+		hosts = append(hosts, value.(*file.Host))
+		return true
+	})
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Id < hosts[j].Id })
+	for _, h := range hosts {
+		l := labels("host_id", strconv.Itoa(h.Id), "client_id", strconv.Itoa(h.Client.Id), "host", h.Host, "location", h.Location)
+		w.add("nps_host_inlet_bytes_total", "counter", "Inlet bytes of the host.", l, float64(h.Flow.InletFlow))
+		w.add("nps_host_export_bytes_total", "counter", "Export bytes of the host.", l, float64(h.Flow.ExportFlow))
+		w.add("nps_host_conns", "gauge", "Connections currently open through the host.", l, float64(metrics.Get(metrics.Host, h.Id).Conns))
+		w.conns(metrics.Host, "nps_host", l, h.Id)
+	}
+
+	for _, r := range []string{metrics.ChallengeIssued, metrics.ChallengeSuccess, metrics.ChallengeFailure} {
+		w.add("nps_global_password_challenges_total", "counter", "Global password challenges by result.", labels("result", r), float64(metrics.Challenges(r)))
+	}
+
+	b := new(bytes.Buffer)
+	w.writeTo(b)
+	return b
+}
+
+func checkMetricsToken(r *http.Request, token string) bool {
+	got := r.URL.Query().Get("token")
+	if v := r.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		got = strings.TrimPrefix(v, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// MetricsHandler 输出 Prometheus 格式的运行数据，配置了 metrics_token 时需要携带令牌
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if token := beego.AppConfig.String("metrics_token"); token != "" && !checkMetricsToken(r, token) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	collectMetrics().WriteTo(w)
+}
+
+// StartMetricsServer 配置了 metrics_port 时在单独的端口上提供 /metrics
+func StartMetricsServer() {
+	if !beego.AppConfig.DefaultBool("metrics_enable", false) {
+		return
+	}
+	port := beego.AppConfig.DefaultInt("metrics_port", 0)
+	if port == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", MetricsHandler)
+	addr := beego.AppConfig.String("metrics_ip") + ":" + strconv.Itoa(port)
+	logs.Info("metrics server start, listen on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logs.Error("metrics server error %s", err)
+		}
+	}()
+}
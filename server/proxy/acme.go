@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// 通过 ACME 为开启了自动证书的域名申请、保存和续期证书，
+// HTTP-01 验证由 http 代理端口处理，TLS-ALPN-01 验证由 https 代理端口处理
+
+// 自动证书的状态
+const (
+	CertPending  = "pending"
+	CertValid    = "valid"
+	CertRenewing = "renewing"
+	CertError    = "error"
+)
+
+var acmeManager *autocert.Manager
+
+// InitAcme 根据配置创建 ACME 客户端，证书保存在 acme_cache_path 中
+func InitAcme() {
+	if !beego.AppConfig.DefaultBool("acme_enable", false) {
+		return
+	}
+	client := &acme.Client{DirectoryURL: beego.AppConfig.DefaultString("acme_directory_url", acme.LetsEncryptURL)}
+	if caFile := beego.AppConfig.String("acme_ca_file"); caFile != "" {
+		// 测试环境（如 Pebble）的 ACME 服务端使用自签名证书
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if b, err := os.ReadFile(caFile); err != nil || !pool.AppendCertsFromPEM(b) {
+			logs.Error("load acme ca file %s error %v", caFile, err)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+	cachePath := beego.AppConfig.String("acme_cache_path")
+	if cachePath == "" {
+		cachePath = filepath.Join(common.GetRunPath(), "conf", "acme")
+	}
+	acmeManager = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cachePath),
+		HostPolicy:  acmeHostPolicy,
+		Email:       beego.AppConfig.String("acme_email"),
+		Client:      client,
+		RenewBefore: time.Duration(beego.AppConfig.DefaultInt("acme_renew_before", 30)) * 24 * time.Hour,
+	}
+	logs.Info("acme enabled, directory %s, cache %s", client.DirectoryURL, cachePath)
+	go acmeRenew()
+}
+
+// autoCertHost 返回开启了自动证书的域名
+func autoCertHost(name string) (h *file.Host) {
+	name = strings.ToLower(common.GetIpByAddr(name))
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		v := value.(*file.Host)
+		if v.AutoCert && !v.IsClose && strings.ToLower(v.Host) == name {
+			h = v
+			return false
+		}
+		return true
+	})
+	return
+}
+
+func acmeHostPolicy(ctx context.Context, host string) error {
+	if autoCertHost(host) == nil {
+		return fmt.Errorf("acme: host %s is not configured for automatic certificate", host)
+	}
+	return nil
+}
+
+// isAcmeChallenge 判断 http 请求是否为需要由 nps 处理的 HTTP-01 验证
+func isAcmeChallenge(r *http.Request) bool {
+	return acmeManager != nil && strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") && autoCertHost(r.Host) != nil
+}
+
+func serveAcmeChallenge(w http.ResponseWriter, r *http.Request) {
+	acmeManager.HTTPHandler(nil).ServeHTTP(w, r)
+}
+
+// serveAcmeAlpn 完成 TLS-ALPN-01 验证的握手
+func serveAcmeAlpn(c net.Conn, rb []byte) {
+	defer c.Close()
+	cc := conn.NewConn(c)
+	cc.Rb = rb
+	tlsConn := tls.Server(cc, acmeManager.TLSConfig())
+	if err := tlsConn.Handshake(); err != nil {
+		logs.Warn("acme tls-alpn-01 handshake error %s", err)
+	}
+}
+
+func getAcmeCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := acmeManager.GetCertificate(hello)
+	if h := autoCertHost(hello.ServerName); h != nil {
+		setCertStatus(h, cert, err)
+	}
+	return cert, err
+}
+
+func setCertStatus(h *file.Host, cert *tls.Certificate, err error) {
+	h.Lock()
+	defer h.Unlock()
+	if err != nil {
+		h.CertStatus = CertError + ": " + err.Error()
+		return
+	}
+	if cert != nil && cert.Leaf != nil {
+		h.CertExpire = cert.Leaf.NotAfter.Unix()
+	}
+	if time.Until(time.Unix(h.CertExpire, 0)) < acmeManager.RenewBefore {
+		h.CertStatus = CertRenewing
+	} else {
+		h.CertStatus = CertValid
+	}
+}
+
+// RequestCert 在后台为域名申请证书，添加或修改域名后调用
+func RequestCert(h *file.Host) {
+	if acmeManager == nil || !h.AutoCert {
+		return
+	}
+	go func() {
+		// 与浏览器一样声明支持 ECDSA，避免申请额外的 RSA 证书
+		hello := &tls.ClientHelloInfo{
+			ServerName:       h.Host,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		}
+		if _, err := getAcmeCertificate(hello); err != nil {
+			logs.Error("acme certificate for %s error %s", h.Host, err)
+		}
+	}()
+}
+
+// acmeRenew 定时检查所有自动证书，autocert 会在到期前 RenewBefore 自动续期
+func acmeRenew() {
+	for {
+		file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+			if h := value.(*file.Host); h.AutoCert && !h.IsClose {
+				RequestCert(h)
+			}
+			return true
+		})
+		time.Sleep(time.Hour)
+	}
+}
+
+var errAcmeDisabled = errors.New("acme is not enabled, set acme_enable=true in nps.conf")
+
+// CheckAutoCert 检查域名能否开启自动证书
+func CheckAutoCert(h *file.Host) error {
+	if !h.AutoCert {
+		return nil
+	}
+	if acmeManager == nil {
+		return errAcmeDisabled
+	}
+	if strings.Contains(h.Host, "*") {
+		return errors.New("wildcard host is not supported by automatic certificate")
+	}
+	return nil
+}
@@ -4,14 +4,17 @@ import (
 	"errors"
 	"net"
 	"net/http"
-	"sort"
 	"sync"
 	"time"
 
 	"ehang.io/nps/bridge"
+	"ehang.io/nps/lib/accesslog"
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/geoip"
+	"ehang.io/nps/lib/metrics"
 	"github.com/astaxie/beego/logs"
 )
 
@@ -183,6 +186,7 @@ func CheckGlobalPasswordAuth(remoteAddr string) bool {
 	}
 
 	// Authentication is required but not met
+	metrics.Challenge(metrics.ChallengeIssued)
 	logs.Notice("Global password authentication required but not met for IP: %s", ip)
 	return true
 }
@@ -221,6 +225,7 @@ func (s *BaseServer) writeConnFail(c net.Conn) {
 // auth check
 func (s *BaseServer) auth(r *http.Request, c *conn.Conn, u, p string) error {
 	if u != "" && p != "" && !common.CheckAuth(r, u, p) {
+		authFailed(r, c.RemoteAddr().String())
 		c.Write([]byte(common.UnauthorizedBytes))
 		c.Close()
 		return errors.New("401 Unauthorized")
@@ -228,6 +233,13 @@ func (s *BaseServer) auth(r *http.Request, c *conn.Conn, u, p string) error {
 	return nil
 }
 
+// authFailed 记录 basic 认证失败，没有携带认证信息的请求只是质询，不计入失败次数
+func authFailed(r *http.Request, addr string) {
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Proxy-Authorization") != "" {
+		ban.Fail(addr, ban.ReasonBasicAuth)
+	}
+}
+
 // check flow limit of the client ,and decrease the allow num of client
 func (s *BaseServer) CheckFlowAndConnNum(client *file.Client) error {
 	if client.Flow.FlowLimit > 0 && (client.Flow.FlowLimit<<20) < (client.Flow.ExportFlow+client.Flow.InletFlow) {
@@ -239,70 +251,146 @@ func (s *BaseServer) CheckFlowAndConnNum(client *file.Client) error {
 	return nil
 }
 
-func in(target string, str_array []string) bool {
-	sort.Strings(str_array)
-	index := sort.SearchStrings(str_array, target)
-	if index < len(str_array) && str_array[index] == target {
-		return true
-	}
-	return false
-}
-
 // create a new connection and start bytes copying
+// e 为 nil 时创建一条新的访问记录并在结束时写入，否则由调用方写入
 func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string,
-	rb []byte, tp string, f func(), flow *file.Flow, localProxy bool, task *file.Tunnel) error {
-
-	// 优先检查访问地址是否在全局白名单内，如果在白名单内则跳过所有验证
-	if IsGlobalWhiteIp(c.RemoteAddr().String()) {
-		// 白名单内的IP直接通过，不需要任何验证
+	rb []byte, tp string, f func(), flow *file.Flow, localProxy bool, task *file.Tunnel, e *accesslog.Entry) error {
+	return s.dealClient(c, client, rb, tp, f, flow, task, e, func() (net.Conn, *conn.Link, error) {
 		link := conn.NewLink(tp, addr, client.Cnf.Crypt, client.Cnf.Compress, c.Conn.RemoteAddr().String(), localProxy)
-		if target, err := s.bridge.SendLinkInfo(client.Id, link, s.task); err != nil {
-			logs.Warn("get connection from client id %d  error %s", client.Id, err.Error())
-			c.Close()
-			return err
-		} else {
-			if f != nil {
-				f()
-			}
-			conn.CopyWaitGroup(target, c.Conn, link.Crypt, link.Compress, client.Rate, flow, true, rb, task)
+		target, err := s.bridge.SendLinkInfo(client.Id, link, s.task)
+		return target, link, err
+	})
+}
+
+// dealClient 与 DealClient 相同，由 dial 连接目标
+func (s *BaseServer) dealClient(c *conn.Conn, client *file.Client, rb []byte, tp string, f func(), flow *file.Flow,
+	task *file.Tunnel, e *accesslog.Entry, dial func() (net.Conn, *conn.Link, error)) error {
+	if e == nil {
+		e = accesslog.New(tp, c.RemoteAddr().String())
+		if s.task != nil && s.task.Mode != "httpHostServer" {
+			e.TunnelId = s.task.Id
 		}
-		return nil
+		defer e.Write()
 	}
+	e.ClientId = client.Id
+	e.AddIn(int64(len(rb)))
 
-	// 判断访问地址是否在全局黑名单内
-	if IsGlobalBlackIp(c.RemoteAddr().String()) {
+	// 优先检查访问地址是否在全局白名单内，如果在白名单内则跳过所有验证
+	if IsGlobalWhiteIp(c.RemoteAddr().String()) {
+		// 白名单内的IP直接通过，不需要任何验证
+		e.Auth = accesslog.AuthWhiteList
+	} else if IsGlobalBlackIp(c.RemoteAddr().String()) {
+		// 判断访问地址是否在全局黑名单内
+		e.Deny(accesslog.AuthBlackList)
 		c.Close()
 		return nil
-	}
-
-	// 判断访问地址是否在黑名单内
-	if common.IsBlackIp(c.RemoteAddr().String(), client.VerifyKey, client.BlackIpList) {
+	} else if IsClientBlackIp(c.RemoteAddr().String(), client) {
+		// 判断访问地址是否在黑名单内
+		e.Deny(accesslog.AuthBlackList)
 		c.Close()
 		return nil
 	}
 
-	link := conn.NewLink(tp, addr, client.Cnf.Crypt, client.Cnf.Compress, c.Conn.RemoteAddr().String(), localProxy)
-	if target, err := s.bridge.SendLinkInfo(client.Id, link, s.task); err != nil {
+	target, link, err := dial()
+	if link != nil {
+		e.Target = link.Host
+	}
+	if err != nil {
 		logs.Warn("get connection from client id %d  error %s", client.Id, err.Error())
+		e.Close(accesslog.ReasonDialError)
 		c.Close()
 		return err
-	} else {
-		if f != nil {
-			f()
-		}
-		conn.CopyWaitGroup(target, c.Conn, link.Crypt, link.Compress, client.Rate, flow, true, rb, task)
 	}
+	if f != nil {
+		f()
+	}
+	conn.CopyWaitGroup(target, e.Wrap(c.Conn), link.Crypt, link.Compress, client.Rate, flow, true, rb, task)
 	return nil
 }
 
+// DialRetries 目标拒绝连接时换其他目标重试的次数，为 0 时不重试
+var DialRetries = 2
+
+// dialTarget 按负载均衡策略选择目标并由 dial 连接，目标拒绝连接时换一个没有试过的目标，最多重试 retries 次。
+// 连接结束后需要调用返回的 done
+func dialTarget(t *file.Target, ip string, retries int, dial func(addr string) (net.Conn, error)) (target net.Conn, done func(), err error) {
+	var addr string
+	if addr, done, err = retryTargets(t, ip, retries, func(addr string) (err error) {
+		target, err = dial(addr)
+		return
+	}); err == nil {
+		t.Report(addr, true)
+	}
+	return
+}
+
+// retryTargets 按负载均衡策略选择目标并调用 try，目标拒绝连接时换一个没有试过的目标，最多重试 retries 次。
+// 拒绝连接会计入被动健康检查，成功由调用方记录。结束后需要调用返回的 done
+func retryTargets(t *file.Target, ip string, retries int, try func(addr string) error) (addr string, done func(), err error) {
+	var tried []string
+	var lastErr error
+	for {
+		if addr, done, err = t.GetTarget(ip, tried...); err != nil {
+			if len(tried) > 0 {
+				// 没有其他目标可以重试，返回上一次连接的错误
+				err = lastErr
+			}
+			return
+		}
+		if err = try(addr); err == nil {
+			return
+		}
+		done()
+		reportDialError(t, err)
+		var e *bridge.TargetError
+		if len(tried) >= retries || !errors.As(err, &e) {
+			return addr, func() {}, err
+		}
+		tried, lastErr = append(tried, addr), err
+		logs.Info("%s, try another target", err)
+	}
+}
+
+// reportDialError 将目标拒绝连接的错误计入被动健康检查
+func reportDialError(t *file.Target, err error) {
+	var e *bridge.TargetError
+	if errors.As(err, &e) {
+		t.Report(e.Target, false)
+	}
+}
+
+// IsAclDenied 判断访问地址是否被隧道或域名的访问控制拒绝，name 用于日志。
+// 依次检查隧道或域名的拒绝列表、允许列表，之后才是全局白名单、全局黑名单和客户端黑名单，
+// 全局白名单不能绕过隧道和域名的访问控制，命中允许列表的地址仍然受全局黑名单和客户端黑名单限制
+func IsAclDenied(ipPort string, acl *file.Acl, name string) bool {
+	r, entry := acl.CheckIp(ipPort)
+	if r != file.AclDeny {
+		return false
+	}
+	if entry != nil {
+		logs.Warn("IP地址[%s]在%s的拒绝列表内[%s]", ipWithCountry(ipPort), name, entry)
+	} else {
+		logs.Warn("IP地址[%s]不在%s的允许列表内", ipWithCountry(ipPort), name)
+	}
+	return true
+}
+
+// ipWithCountry 返回日志中的 ip，配置了 geoip 数据库时带上国家代码
+func ipWithCountry(ipPort string) string {
+	ip := common.GetIpByAddr(ipPort)
+	if c := geoip.Country(ipPort); c != "" {
+		return ip + "(" + c + ")"
+	}
+	return ip
+}
+
 // 判断访问地址是否在全局黑名单内
 func IsGlobalBlackIp(ipPort string) bool {
 	// 判断访问地址是否在全局黑名单内
 	global := file.GetDb().GetGlobal()
 	if global != nil {
-		ip := common.GetIpByAddr(ipPort)
-		if in(ip, global.BlackIpList) {
-			logs.Error("IP地址[" + ip + "]在全局黑名单列表内")
+		if e := global.BlackIp(ipPort); e != nil {
+			logs.Error("IP地址[%s]在全局黑名单列表内[%s]", ipWithCountry(ipPort), e)
 			return true
 		}
 	}
@@ -315,12 +403,20 @@ func IsGlobalWhiteIp(ipPort string) bool {
 	// 判断访问地址是否在全局白名单内
 	global := file.GetDb().GetGlobal()
 	if global != nil {
-		ip := common.GetIpByAddr(ipPort)
-		if in(ip, global.WhiteIpList) {
-			logs.Info("IP地址[" + ip + "]在全局白名单列表内，跳过验证")
+		if e := global.WhiteIp(ipPort); e != nil {
+			logs.Info("IP地址[%s]在全局白名单列表内[%s]，跳过验证", ipWithCountry(ipPort), e)
 			return true
 		}
 	}
 
 	return false
 }
+
+// 判断访问地址是否在客户端黑名单内
+func IsClientBlackIp(ipPort string, client *file.Client) bool {
+	if e := client.BlackIp(ipPort); e != nil {
+		logs.Error("IP地址[%s]在客户端[%s]黑名单列表内[%s]", ipWithCountry(ipPort), client.VerifyKey, e)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	"github.com/pkg/errors"
+)
+
+// 所有上传了证书的域名共用一个 tls 监听，握手时根据 SNI 从缓存中选择证书
+
+type certEntry struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+// 域名 id -> *certEntry
+var certCache sync.Map
+
+// InvalidateCert 域名修改或删除后清除缓存的证书
+func InvalidateCert(id int) {
+	certCache.Delete(id)
+}
+
+// isPemContent 判断是路径还是证书，-----BEGIN 开头的为证书
+func isPemContent(certFile, keyFile string) bool {
+	return strings.Contains(certFile, "-----BEGIN") || strings.Contains(keyFile, "-----BEGIN")
+}
+
+// loadHostCert 返回域名的证书，证书路径或内容未变化时使用缓存
+func loadHostCert(h *file.Host) (*tls.Certificate, error) {
+	certFile, keyFile := h.CertFilePath, h.KeyFilePath
+	isPem := isPemContent(certFile, keyFile)
+	var modTime time.Time
+	if !isPem {
+		// 证书文件被替换后重新加载
+		if fi, err := os.Stat(certFile); err == nil {
+			modTime = fi.ModTime()
+		}
+	}
+	if v, ok := certCache.Load(h.Id); ok {
+		e := v.(*certEntry)
+		if e.certFile == certFile && e.keyFile == keyFile && e.modTime.Equal(modTime) {
+			return e.cert, nil
+		}
+	}
+	var cert tls.Certificate
+	var err error
+	if isPem {
+		cert, err = tls.X509KeyPair([]byte(certFile), []byte(keyFile))
+	} else {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	certCache.Store(h.Id, &certEntry{certFile: certFile, keyFile: keyFile, modTime: modTime, cert: &cert})
+	logs.Info("load certificate of host %s, expire at %s", h.Host, cert.Leaf.NotAfter.Format("2006-01-02"))
+	return &cert, nil
+}
+
+// loadDefaultCert 加载 https_default_cert_file，用于没有 SNI 或者域名证书不可用的连接
+func loadDefaultCert() *tls.Certificate {
+	certFile := beego.AppConfig.String("https_default_cert_file")
+	keyFile := beego.AppConfig.String("https_default_key_file")
+	if certFile == "" || keyFile == "" {
+		return nil
+	}
+	if !filepath.IsAbs(certFile) {
+		certFile = filepath.Join(common.GetRunPath(), certFile)
+	}
+	if !filepath.IsAbs(keyFile) {
+		keyFile = filepath.Join(common.GetRunPath(), keyFile)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		logs.Warn("load https default certificate error %s", err)
+		return nil
+	}
+	return &cert
+}
+
+// hasCert 判断域名是否由 nps 终止 tls，否则将 tls 连接原样转发给客户端
+func hasCert(h *file.Host) bool {
+	return (h.AutoCert && acmeManager != nil) || (h.CertFilePath != "" && h.KeyFilePath != "")
+}
+
+// getCertificate 是 tls 握手时选择证书的回调，支持泛域名证书
+func (https *HttpsServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName != "" {
+		if host, err := file.GetDb().GetInfoByHost(hello.ServerName, buildHttpsRequest(hello.ServerName)); err == nil {
+			if host.AutoCert && acmeManager != nil {
+				return getAcmeCertificate(hello)
+			}
+			if host.CertFilePath != "" && host.KeyFilePath != "" {
+				if cert, err := loadHostCert(host); err == nil {
+					return cert, nil
+				} else {
+					logs.Error("load certificate of host %s error %s", host.Host, err)
+				}
+			}
+		}
+	}
+	if https.defaultCert == nil {
+		return nil, errors.New("no certificate for server name " + hello.ServerName)
+	}
+	return https.defaultCert, nil
+}
@@ -0,0 +1,13 @@
+package proxy
+
+import (
+	"net/http"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+)
+
+// headerVars 返回请求对应的头部规则变量，需要在修改 host 之前调用
+func headerVars(r *http.Request, remoteAddr string, host *file.Host) *file.HeaderVars {
+	return &file.HeaderVars{RemoteIp: common.GetIpByAddr(remoteAddr), Host: r.Host, Scheme: r.URL.Scheme, ClientId: host.Client.Id}
+}
@@ -15,14 +15,16 @@ import (
 	"sync"
 
 	"ehang.io/nps/bridge"
-	"ehang.io/nps/lib/cache"
+	"ehang.io/nps/lib/accesslog"
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/common"
-	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
-	"ehang.io/nps/lib/goroutine"
 	"ehang.io/nps/server/connection"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type httpServer struct {
@@ -32,13 +34,12 @@ type httpServer struct {
 	httpServer    *http.Server
 	httpsServer   *http.Server
 	httpsListener net.Listener
-	useCache      bool
-	addOrigin     bool
-	cache         *cache.Cache
-	cacheLen      int
+	proxy         *hostProxy
+	https         *HttpsServer
+	http3         *http3.Server
 }
 
-func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, useCache bool, cacheLen int, addOrigin bool) *httpServer {
+func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int) *httpServer {
 	httpServer := &httpServer{
 		BaseServer: BaseServer{
 			task:   c,
@@ -47,13 +48,8 @@ func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, use
 		},
 		httpPort:  httpPort,
 		httpsPort: httpsPort,
-		useCache:  useCache,
-		cacheLen:  cacheLen,
-		addOrigin: addOrigin,
-	}
-	if useCache {
-		httpServer.cache = cache.New(cacheLen)
 	}
+	httpServer.proxy = newHostProxy(httpServer)
 	return httpServer
 }
 
@@ -70,7 +66,7 @@ func (s *httpServer) Start() error {
 				logs.Error(err)
 				os.Exit(0)
 			}
-			err = s.httpServer.Serve(l)
+			err = s.httpServer.Serve(&ban.Listener{Listener: l})
 			if err != nil {
 				logs.Error(err)
 				os.Exit(0)
@@ -85,14 +81,17 @@ func (s *httpServer) Start() error {
 				logs.Error(err)
 				os.Exit(0)
 			}
-			logs.Error(NewHttpsServer(s.httpsListener, s.bridge, s.useCache, s.cacheLen).Start())
+			s.https = NewHttpsServer(s.httpsListener, s.bridge)
+			logs.Error(s.https.Start())
 		}()
 	}
 	return nil
 }
 
 func (s *httpServer) Close() error {
-	if s.httpsListener != nil {
+	if s.https != nil {
+		s.https.Close()
+	} else if s.httpsListener != nil {
 		s.httpsListener.Close()
 	}
 	if s.httpsServer != nil {
@@ -107,12 +106,28 @@ func (s *httpServer) Close() error {
 func (s *httpServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
 	var host *file.Host
 	var err error
+	if isAcmeChallenge(r) {
+		serveAcmeChallenge(w, r)
+		return
+	}
+	s.setAltSvc(w, r)
 	host, err = file.GetDb().GetInfoByHost(r.Host, r)
 	if err != nil {
 		logs.Debug("the url %s %s %s can't be parsed!", r.URL.Scheme, r.Host, r.RequestURI)
 		return
 	}
 
+	// 域名的访问控制在所有跳转之前检查
+	if IsAclDenied(r.RemoteAddr, &host.Acl, "域名["+host.Host+"]") {
+		e := accesslog.New(r.URL.Scheme, r.RemoteAddr)
+		e.HostId, e.ClientId, e.Host, e.Method, e.Url = host.Id, host.Client.Id, r.Host, r.Method, r.RequestURI
+		e.Status = http.StatusForbidden
+		e.Deny(accesslog.AuthAcl)
+		e.Write()
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+
 	// 自动 http 301 https
 	if host.AutoHttps && r.TLS == nil {
 		http.Redirect(w, r, "https://"+r.Host+r.RequestURI, http.StatusMovedPermanently)
@@ -152,6 +167,12 @@ func (s *httpServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
 			// 构造重定向 URL，将完整的原始 URL 编码后放入 return_url
 			redirectURL := fmt.Sprintf("%s://%s:%d/nps_global_auth?return_url=%s", scheme, hostname, webPort, url.QueryEscape(originalURL))
 
+			e := accesslog.New(scheme, r.RemoteAddr)
+			e.HostId, e.ClientId, e.Host, e.Method, e.Url = host.Id, host.Client.Id, r.Host, r.Method, r.RequestURI
+			e.Status = http.StatusFound
+			e.Deny(accesslog.AuthGlobalPassword)
+			e.Write()
+
 			// 重定向到 web 管理端口
 			http.Redirect(w, r, redirectURL, http.StatusFound)
 			return
@@ -159,223 +180,89 @@ func (s *httpServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
 		// 如果是验证路径，则继续处理（下面会有专门处理验证请求的逻辑）
 	}
 
-	if r.Header.Get("Upgrade") != "" {
-		rProxy := NewHttpReverseProxy(s)
-		rProxy.ServeHTTP(w, r)
-	} else {
-		hijacker, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-			return
+	// 路由表中的重定向和固定响应直接返回
+	route := host.MatchRoute(r)
+	if route != nil && route.Action != file.RouteProxy {
+		e := accesslog.New(r.URL.Scheme, r.RemoteAddr)
+		e.HostId, e.ClientId, e.Host, e.Method, e.Url = host.Id, host.Client.Id, r.Host, r.Method, r.RequestURI
+		defer e.Write()
+		resp := routeResponse(r, route)
+		host.ApplyHeaderRules(file.HeaderResponse, resp.Header, headerVars(r, r.RemoteAddr, host))
+		for k, v := range resp.Header {
+			w.Header()[k] = v
 		}
-		c, _, err := hijacker.Hijack()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		}
-
-		s.handleHttp(conn.NewConn(c), r)
-	}
-}
-
-func (s *httpServer) handleHttp(c *conn.Conn, r *http.Request) {
-	var (
-		host       *file.Host
-		target     net.Conn
-		err        error
-		connClient io.ReadWriteCloser
-		scheme     = r.URL.Scheme
-		lk         *conn.Link
-		targetAddr string
-		lenConn    *conn.LenConn
-		isReset    bool
-		wg         sync.WaitGroup
-		remoteAddr string
-	)
-	defer func() {
-		if connClient != nil {
-			connClient.Close()
-		} else {
-			s.writeConnFail(c.Conn)
-		}
-		c.Close()
-	}()
-reset:
-	if isReset {
-		host.Client.AddConn()
-	}
-
-	remoteAddr = strings.TrimSpace(r.Header.Get("X-Forwarded-For"))
-	if len(remoteAddr) == 0 {
-		remoteAddr = c.RemoteAddr().String()
+		sw := &statusWriter{w, e}
+		sw.WriteHeader(resp.StatusCode)
+		io.Copy(sw, resp.Body)
+		return
 	}
 
-	// 优先检查访问地址是否在全局白名单内，如果在白名单内则跳过所有验证
-	isWhiteIp := IsGlobalWhiteIp(c.RemoteAddr().String())
+	s.proxy.ServeHTTP(w, r, host, route)
+}
 
-	if host, err = file.GetDb().GetInfoByHost(r.Host, r); err != nil {
-		logs.Notice("the url %s %s %s can't be parsed!, host %s, url %s, remote address %s", r.URL.Scheme, r.Host, r.RequestURI, r.Host, r.URL.Path, remoteAddr)
-		// 如果无法解析 host，且不在白名单内，则默认需要检查全局密码 (如果已设置)
-		if !isWhiteIp && CheckGlobalPasswordAuth(c.RemoteAddr().String()) {
-			logs.Warn("Global password authentication required (host not found) for HTTP connection from %s, closing.", c.RemoteAddr().String())
-			s.writeConnFail(c.Conn)
-			c.Close()
-			return
-		}
-		// 如果不需要全局密码，也关闭连接，因为 host 无法解析
-		c.Close()
-		return
-	}
+// statusWriter 记录响应的状态码和字节数
+type statusWriter struct {
+	http.ResponseWriter
+	e *accesslog.Entry
+}
 
-	// 对于白名单IP，跳过全局密码验证和黑名单检查，直接进行代理
-	if !isWhiteIp {
-		// 全局密码认证检查 (如果 host 未设置 Bypass)
-		if !host.BypassGlobalPassword && CheckGlobalPasswordAuth(c.RemoteAddr().String()) {
-			// 对于 handleHttp (非 Upgrade)，理论上已经在 handleTunneling 重定向了。
-			// 但如果直接访问 IP:port，可能到这里。此时无法重定向，直接关闭。
-			logs.Warn("Global password authentication required for HTTP connection (host: %s) from %s, closing.", host.Host, c.RemoteAddr().String())
-			s.writeConnFail(c.Conn)
-			c.Close()
-			return
-		}
+func (w *statusWriter) WriteHeader(code int) {
+	w.e.Status = code
+	w.ResponseWriter.WriteHeader(code)
+}
 
-		// 判断访问地址是否在全局黑名单内
-		if IsGlobalBlackIp(c.RemoteAddr().String()) {
-			logs.Warn("IP %s is in global black list, closing connection.", c.RemoteAddr().String())
-			c.Close()
-			return
-		}
+func (w *statusWriter) Write(b []byte) (n int, err error) {
+	if w.e.Status == 0 {
+		w.e.Status = http.StatusOK
 	}
+	n, err = w.ResponseWriter.Write(b)
+	w.e.AddOut(int64(n))
+	return
+}
 
-	if err := s.CheckFlowAndConnNum(host.Client); err != nil {
-		logs.Warn("client id %d, host id %d, error %s, when https connection", host.Client.Id, host.Id, err.Error())
-		c.Close()
-		return
-	}
-	if !isReset {
-		defer host.Client.AddConn()
-	}
-	if err = s.auth(r, c, host.Client.Cnf.U, host.Client.Cnf.P); err != nil {
-		logs.Warn("auth error", err, r.RemoteAddr)
-		return
+// Hijack 之后的 websocket 流量通过连接统计
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
 	}
-	if targetAddr, err = host.Target.GetRandomTarget(); err != nil {
-		logs.Warn(err.Error())
-		return
-	}
-
-	lk = conn.NewLink("http", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, host.Target.LocalProxy)
-	if target, err = s.bridge.SendLinkInfo(host.Client.Id, lk, nil); err != nil {
-		logs.Notice("connect to target %s error %s", lk.Host, err)
-		return
+	c, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
 	}
-	connClient = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)
-
-	//read from inc-client
-	go func() {
-		wg.Add(1)
-		isReset = false
-		defer connClient.Close()
-		defer func() {
-			wg.Done()
-			if !isReset {
-				c.Close()
-			}
-		}()
-
-		err1 := goroutine.CopyBuffer(c, connClient, host.Client.Flow, nil, "")
-		if err1 != nil {
-			return
-		}
-
-		resp, err := http.ReadResponse(bufio.NewReader(connClient), r)
-		if err != nil || resp == nil || r == nil {
-			// if there got broken pipe, http.ReadResponse will get a nil
-			//break
-			return
-		} else {
-			lenConn := conn.NewLenConn(c)
-			if err := resp.Write(lenConn); err != nil {
-				logs.Error(err)
-				//break
-				return
-			}
-		}
-	}()
-
-	for {
-		//if the cache start and the request is in the cache list, return the cache
-		if s.useCache {
-			if v, ok := s.cache.Get(filepath.Join(host.Host, r.URL.Path)); ok {
-				n, err := c.Write(v.([]byte))
-				if err != nil {
-					break
-				}
-				logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return cache", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String())
-				host.Client.Flow.Add(int64(n), int64(n))
-				//if return cache and does not create a new conn with client and Connection is not set or close, close the connection.
-				if strings.ToLower(r.Header.Get("Connection")) == "close" || strings.ToLower(r.Header.Get("Connection")) == "" {
-					break
-				}
-				goto readReq
-			}
-		}
-
-		//change the host and header and set proxy setting
-		common.ChangeHostAndHeader(r, host.HostChange, host.HeaderChange, c.Conn.RemoteAddr().String())
-
-		logs.Info("%s request, method %s, host %s, url %s, remote address %s, target %s", r.URL.Scheme, r.Method, r.Host, r.URL.Path, remoteAddr, lk.Host)
-
-		//write
-		lenConn = conn.NewLenConn(connClient)
-		//lenConn = conn.LenConn
-		if err := r.Write(lenConn); err != nil {
-			logs.Error(err)
-			break
-		}
-		host.Client.Flow.Add(int64(lenConn.Len), int64(lenConn.Len))
+	return w.e.Wrap(c), rw, nil
+}
 
-	readReq:
-		//read req from connection
-		r, err = http.ReadRequest(bufio.NewReader(c))
-		if err != nil {
-			//break
-			return
-		}
-		r.URL.Scheme = scheme
-		//What happened ，Why one character less???
-		r.Method = resetReqMethod(r.Method)
-		if hostTmp, err := file.GetDb().GetInfoByHost(r.Host, r); err != nil {
-			logs.Notice("the url %s %s %s can't be parsed!", r.URL.Scheme, r.Host, r.RequestURI)
-			break
-		} else if host != hostTmp {
-			host = hostTmp
-			isReset = true
-			connClient.Close()
-			goto reset
-		}
-	}
-	wg.Wait()
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
-func resetReqMethod(method string) string {
-	if method == "ET" {
-		return "GET"
-	}
-	if method == "OST" {
-		return "POST"
+// routeResponse 生成路由的重定向或者固定响应
+func routeResponse(r *http.Request, route *file.Route) *http.Response {
+	resp := &http.Response{StatusCode: route.Code, Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+		Header: make(http.Header), Request: r, Close: true}
+	body := route.Body
+	if route.Action == file.RouteRedirect {
+		resp.Header.Set("Location", route.RedirectURL(r.URL))
+	} else {
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
 	}
-	return method
+	resp.Body, resp.ContentLength = io.NopCloser(strings.NewReader(body)), int64(len(body))
+	return resp
 }
 
+// 可以安全重试的请求方法
+var idempotentMethods = map[string]bool{http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true,
+	http.MethodTrace: true, http.MethodPut: true, http.MethodDelete: true}
+
 func (s *httpServer) NewServer(port int, scheme string) *http.Server {
 	return &http.Server{
 		Addr: ":" + strconv.Itoa(port),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 支持 h2c
+		Handler: h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			r.URL.Scheme = scheme
 			s.handleTunneling(w, r)
-		}),
-		// Disable HTTP/2.
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		}), &http2.Server{}),
 	}
 }
 
@@ -396,16 +283,18 @@ func (s *httpServer) NewServerWithTls(port int, scheme string, l net.Listener, c
 	if err != nil {
 		return err
 	}
+	return s.NewServerWithTlsConfig(port, scheme, l, config)
+}
 
+func (s *httpServer) NewServerWithTlsConfig(port int, scheme string, l net.Listener, config *tls.Config) error {
 	s2 := &http.Server{
 		Addr: ":" + strconv.Itoa(port),
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			r.URL.Scheme = scheme
 			s.handleTunneling(w, r)
 		}),
-		// Disable HTTP/2.
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		TLSConfig:    config,
+		// 通过 ALPN 支持 h2
+		TLSConfig: config,
 	}
 
 	return s2.ServeTLS(l, "", "")
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"ehang.io/nps/lib/ban"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Http3Enable 为 true 时在 https 端口的 udp 上同时提供 http/3
+var Http3Enable bool
+
+// startHttp3 在 https 端口上监听 quic，和 https 使用相同的域名和证书，
+// 证书在客户端的域名无法在 nps 终止 tls，不提供 http/3
+func (https *HttpsServer) startHttp3() {
+	https.http3 = &http3.Server{
+		Addr: https.listener.Addr().String(),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			https.handleTunneling(w, r)
+		}),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{GetCertificate: https.getHttp3Certificate}),
+	}
+	go func() {
+		logs.Info("start http3 listener, address is %s", https.http3.Addr)
+		if err := https.http3.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logs.Error("http3 listener error %s", err)
+		}
+	}()
+}
+
+func (https *HttpsServer) getHttp3Certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.Conn != nil && ban.IsBanned(hello.Conn.RemoteAddr().String()) {
+		return nil, errors.New("banned ip " + hello.Conn.RemoteAddr().String())
+	}
+	if hello.ServerName != "" {
+		if host, err := file.GetDb().GetInfoByHost(hello.ServerName, buildHttpsRequest(hello.ServerName)); err == nil && !hasCert(host) {
+			return nil, errors.New("no certificate on server for host " + hello.ServerName)
+		}
+	}
+	return https.getCertificate(hello)
+}
+
+// setAltSvc 在 tls 的响应中通告 http/3
+func (s *httpServer) setAltSvc(w http.ResponseWriter, r *http.Request) {
+	if s.http3 != nil && r.TLS != nil {
+		s.http3.SetQUICHeaders(w.Header())
+	}
+}
@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/accesslog"
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/metrics"
+	"github.com/astaxie/beego/logs"
+	"golang.org/x/net/http2"
+)
+
+// hostProxy 是域名模式的反向代理，到目标的连接按客户端和目标复用
+type hostProxy struct {
+	s          *httpServer
+	proxy      *httputil.ReverseProxy
+	transports sync.Map // 客户端id/localProxy -> *http.Transport
+}
+
+type proxyCtxKey struct{}
+
+// proxyRequest 是一个请求在代理过程中需要的信息
+type proxyRequest struct {
+	host    *file.Host
+	route   *file.Route
+	vars    *file.HeaderVars
+	entry   *accesslog.Entry
+	upgrade bool // 协议升级的请求使用单独的连接
+}
+
+func newHostProxy(s *httpServer) *hostProxy {
+	p := &hostProxy{s: s}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      p,
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.errorHandler,
+	}
+	return p
+}
+
+// ServeHTTP 检查访问权限和限制后转发请求，websocket 等协议升级也在这里处理
+func (p *hostProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, host *file.Host, route *file.Route) {
+	e := accesslog.New(r.URL.Scheme, r.RemoteAddr)
+	e.HostId, e.ClientId, e.Host, e.Method, e.Url = host.Id, host.Client.Id, r.Host, r.Method, r.RequestURI
+	defer e.Write()
+	if r.ContentLength > 0 {
+		defer func() { e.AddIn(r.ContentLength) }()
+	}
+	w = &statusWriter{w, e}
+
+	// 对于白名单IP，跳过全局密码验证和黑名单检查
+	if IsGlobalWhiteIp(r.RemoteAddr) {
+		e.Auth = accesslog.AuthWhiteList
+	} else if !host.BypassGlobalPassword && CheckGlobalPasswordAuth(r.RemoteAddr) {
+		// 需要全局密码的请求已经在 handleTunneling 重定向，这里只剩下验证路径本身
+		logs.Warn("Global password authentication required for HTTP connection (host: %s) from %s", host.Host, r.RemoteAddr)
+		e.Deny(accesslog.AuthGlobalPassword)
+		p.writeFail(w, http.StatusNotFound)
+		return
+	} else if IsGlobalBlackIp(r.RemoteAddr) {
+		e.Deny(accesslog.AuthBlackList)
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := p.s.CheckFlowAndConnNum(host.Client); err != nil {
+		logs.Warn("client id %d, host id %d, error %s, when http connection", host.Client.Id, host.Id, err.Error())
+		e.Close(accesslog.ReasonLimit)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer host.Client.AddConn()
+	if u, pwd := host.Client.Cnf.U, host.Client.Cnf.P; u != "" && pwd != "" && !common.CheckAuth(r, u, pwd) {
+		logs.Warn("auth error %s", r.RemoteAddr)
+		authFailed(r, r.RemoteAddr)
+		e.Deny(accesslog.AuthBasicAuth)
+		w.Header().Set("WWW-Authenticate", `Basic realm="easyProxy"`)
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	defer metrics.Open(metrics.Host, host.Id)()
+
+	pr := &proxyRequest{host: host, route: route, vars: headerVars(r, r.RemoteAddr, host), entry: e, upgrade: r.Header.Get("Upgrade") != ""}
+	logs.Info("%s request, method %s, host %s, url %s, remote address %s", r.URL.Scheme, r.Method, r.Host, r.URL.Path, r.RemoteAddr)
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyCtxKey{}, pr)))
+}
+
+func (p *hostProxy) rewrite(r *httputil.ProxyRequest) {
+	pr := r.In.Context().Value(proxyCtxKey{}).(*proxyRequest)
+	// 访问者带来的 X-Forwarded 请求头原样转发，是否追加由 http_add_origin_header 决定
+	for _, k := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+		if v, ok := r.In.Header[k]; ok {
+			r.Out.Header[k] = v
+		}
+	}
+	if pr.route != nil {
+		pr.route.RewriteURL(r.Out.URL)
+	}
+	r.Out.URL.Scheme = "http"
+	common.ChangeHostAndHeader(r.Out, pr.host.HostChange, pr.host.HeaderChange, r.In.RemoteAddr)
+	pr.host.ApplyHeaderRules(file.HeaderRequest, r.Out.Header, pr.vars)
+}
+
+// RoundTrip 按负载均衡策略选择目标发送请求，幂等的请求在目标拒绝连接时换其他目标重试
+func (p *hostProxy) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	pr := req.Context().Value(proxyCtxKey{}).(*proxyRequest)
+	t := pr.host.RouteTarget(pr.route)
+	retries := 0
+	if idempotentMethods[req.Method] {
+		retries = DialRetries
+	}
+	if body := req.Body; body != nil && body != http.NoBody {
+		// 重试时请求体还没有被读取，全部失败时由这里关闭，成功时请求体可能还在发送（grpc 等双向流）
+		defer func() {
+			if err != nil {
+				body.Close()
+			}
+		}()
+		req.Body = noCloseBody{body}
+	}
+	tr := p.transport(pr)
+	addr, done, err := retryTargets(t, common.GetIpByAddr(req.RemoteAddr), retries, func(addr string) (err error) {
+		pr.entry.Target = addr
+		out := req.Clone(req.Context())
+		out.URL.Host = addr
+		if resp, err = tr.RoundTrip(out); err != nil {
+			var de *dialError
+			if !errors.As(err, &de) && req.Context().Err() == nil {
+				// 连接成功但是没有收到响应
+				t.Report(addr, false)
+			}
+		}
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Report(addr, resp.StatusCode < 500)
+	resp.Body = &doneBody{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+func (p *hostProxy) modifyResponse(resp *http.Response) error {
+	pr := resp.Request.Context().Value(proxyCtxKey{}).(*proxyRequest)
+	pr.host.ApplyHeaderRules(file.HeaderResponse, resp.Header, pr.vars)
+	return nil
+}
+
+func (p *hostProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	pr := r.Context().Value(proxyCtxKey{}).(*proxyRequest)
+	if r.Context().Err() != nil {
+		pr.entry.Close(accesslog.ReasonClosed)
+		return
+	}
+	logs.Notice("connect to target %s error %s", pr.entry.Target, err)
+	var de *dialError
+	if errors.As(err, &de) || pr.entry.Target == "" {
+		pr.entry.Close(accesslog.ReasonDialError)
+	} else {
+		pr.entry.Close(accesslog.ReasonError)
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		// grpc 的客户端从 grpc-status 读取错误，14 为 UNAVAILABLE
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "14")
+		w.Header().Set("Grpc-Message", "nps: target unavailable")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	p.writeFail(w, http.StatusBadGateway)
+}
+
+// writeFail 返回错误页面，内容为 web/static/page/error.html
+func (p *hostProxy) writeFail(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(p.s.errorContent)
+}
+
+// transport 返回客户端的 http.Transport，同一个客户端到同一个目标的连接会被复用。
+// 目标使用 http/2 时按域名复用，一个连接上可以同时处理多个请求
+func (p *hostProxy) transport(pr *proxyRequest) http.RoundTripper {
+	host := pr.host
+	key := strconv.Itoa(host.Client.Id) + "/" + strconv.FormatBool(host.Target.LocalProxy) + "/" + strconv.FormatBool(pr.upgrade)
+	if host.TargetProto != file.TargetProtoHttp {
+		key += "/" + host.TargetProto + "/" + strconv.Itoa(host.Id)
+	}
+	if tr, ok := p.transports.Load(key); ok {
+		return tr.(http.RoundTripper)
+	}
+	var tr http.RoundTripper
+	switch host.TargetProto {
+	case file.TargetProtoH2c, file.TargetProtoH2:
+		proto := host.TargetProto
+		tr = &http2.Transport{
+			// x/net 的 http2 不会把请求的 context 传给 DialTLS
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				c, err := p.dial(host, common.CONN_TCP, "", addr)
+				if err != nil || proto == file.TargetProtoH2c {
+					return c, err
+				}
+				tc := tls.Client(c, cfg)
+				if err := tc.Handshake(); err != nil {
+					tc.Close()
+					return nil, err
+				}
+				return tc, nil
+			},
+			// 目标一般是内网地址，不校验证书
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			AllowHTTP:       true,
+			ReadIdleTimeout: HttpIdleTimeout,
+		}
+	default:
+		tr = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				pr, ok := ctx.Value(proxyCtxKey{}).(*proxyRequest)
+				if !ok {
+					return nil, errors.New("missing request of the connection")
+				}
+				connType := "http"
+				if pr.upgrade {
+					// 协议升级后客户端不能再按 http 解析
+					connType = common.CONN_TCP
+				}
+				return p.dial(pr.host, connType, pr.vars.RemoteIp, addr)
+			},
+			DisableKeepAlives:     pr.upgrade,
+			MaxIdleConnsPerHost:   HttpMaxIdleConns,
+			IdleConnTimeout:       HttpIdleTimeout,
+			ExpectContinueTimeout: time.Second,
+		}
+	}
+	v, _ := p.transports.LoadOrStore(key, tr)
+	return v.(http.RoundTripper)
+}
+
+// dial 通过客户端连接目标
+func (p *hostProxy) dial(host *file.Host, connType, remoteIp, addr string) (net.Conn, error) {
+	client := host.Client
+	lk := conn.NewLink(connType, addr, client.Cnf.Crypt, client.Cnf.Compress, remoteIp, host.Target.LocalProxy)
+	target, err := p.s.bridge.SendLinkInfo(client.Id, lk, nil)
+	metrics.Dial(metrics.Host, host.Id, err)
+	if err != nil {
+		return nil, &dialError{err}
+	}
+	return &flowConn{
+		ReadWriteCloser: conn.GetConn(target, lk.Crypt, lk.Compress, client.Rate, true),
+		conn:            target,
+		flow:            client.Flow,
+	}, nil
+}
+
+// 到目标的空闲连接数和空闲时间
+var (
+	HttpMaxIdleConns = 32
+	HttpIdleTimeout  = 90 * time.Second
+)
+
+// dialError 是连接目标时的错误，与连接后没有收到响应区分
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string { return e.err.Error() }
+
+func (e *dialError) Unwrap() error { return e.err }
+
+// flowConn 统计客户端的流量，可能经过加密、压缩和限速
+type flowConn struct {
+	io.ReadWriteCloser
+	conn net.Conn
+	flow *file.Flow
+}
+
+func (c *flowConn) Read(p []byte) (n int, err error) {
+	n, err = c.ReadWriteCloser.Read(p)
+	c.flow.Add(int64(n), int64(n))
+	return
+}
+
+func (c *flowConn) Write(p []byte) (n int, err error) {
+	n, err = c.ReadWriteCloser.Write(p)
+	c.flow.Add(int64(n), int64(n))
+	return
+}
+
+func (c *flowConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+func (c *flowConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *flowConn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+func (c *flowConn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+func (c *flowConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+type noCloseBody struct {
+	io.ReadCloser
+}
+
+func (noCloseBody) Close() error { return nil }
+
+// doneBody 在响应结束时减少目标的连接数，协议升级时还需要写入
+type doneBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *doneBody) Write(p []byte) (int, error) {
+	if w, ok := b.ReadCloser.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, errors.New("response body is not writable")
+}
+
+func (b *doneBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
@@ -7,9 +7,12 @@ import (
 	"net"
 	"strconv"
 
+	"ehang.io/nps/lib/accesslog"
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/metrics"
 	"github.com/astaxie/beego/logs"
 )
 
@@ -52,7 +55,7 @@ type Sock5ModeServer struct {
 }
 
 //req
-func (s *Sock5ModeServer) handleRequest(c net.Conn) {
+func (s *Sock5ModeServer) handleRequest(c net.Conn, e *accesslog.Entry) {
 	/*
 		The SOCKS request is formed as follows:
 		+----+-----+-------+------+----------+----------+
@@ -67,19 +70,21 @@ func (s *Sock5ModeServer) handleRequest(c net.Conn) {
 
 	if err != nil {
 		logs.Warn("illegal request", err)
+		e.Close(accesslog.ReasonError)
 		c.Close()
 		return
 	}
 
 	switch header[1] {
 	case connectMethod:
-		s.handleConnect(c)
+		s.handleConnect(c, e)
 	case bindMethod:
 		s.handleBind(c)
 	case associateMethod:
-		s.handleUDP(c)
+		s.handleUDP(c, e)
 	default:
 		s.sendReply(c, commandNotSupported)
+		e.Close(accesslog.ReasonError)
 		c.Close()
 	}
 }
@@ -106,7 +111,7 @@ func (s *Sock5ModeServer) sendReply(c net.Conn, rep uint8) {
 }
 
 //do conn
-func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
+func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8, e *accesslog.Entry) {
 	addrType := make([]byte, 1)
 	c.Read(addrType)
 	var host string
@@ -127,6 +132,7 @@ func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
 		host = string(domain)
 	default:
 		s.sendReply(c, addrTypeNotSupported)
+		e.Close(accesslog.ReasonError)
 		return
 	}
 
@@ -142,13 +148,13 @@ func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
 	}
 	s.DealClient(conn.NewConn(c), s.task.Client, addr, nil, ltype, func() {
 		s.sendReply(c, succeeded)
-	}, s.task.Flow, s.task.Target.LocalProxy, nil)
+	}, s.task.Flow, s.task.Target.LocalProxy, nil, e)
 	return
 }
 
 //conn
-func (s *Sock5ModeServer) handleConnect(c net.Conn) {
-	s.doConnect(c, connectMethod)
+func (s *Sock5ModeServer) handleConnect(c net.Conn, e *accesslog.Entry) {
+	s.doConnect(c, connectMethod, e)
 }
 
 // passive mode
@@ -173,7 +179,7 @@ func (s *Sock5ModeServer) sendUdpReply(writeConn net.Conn, c net.Conn, rep uint8
 
 }
 
-func (s *Sock5ModeServer) handleUDP(c net.Conn) {
+func (s *Sock5ModeServer) handleUDP(c net.Conn, e *accesslog.Entry) {
 	defer c.Close()
 	addrType := make([]byte, 1)
 	c.Read(addrType)
@@ -195,6 +201,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 		host = string(domain)
 	default:
 		s.sendReply(c, addrTypeNotSupported)
+		e.Close(accesslog.ReasonError)
 		return
 	}
 	//读取端口
@@ -216,10 +223,12 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 	s.sendUdpReply(c, reply, succeeded, common.GetServerIpByClientIp(c.RemoteAddr().(*net.TCPAddr).IP))
 	defer reply.Close()
 	// new a tunnel to client
+	e.Target = net.JoinHostPort(host, strconv.Itoa(int(port)))
 	link := conn.NewLink("udp5", "", s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, c.RemoteAddr().String(), false)
 	target, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
 	if err != nil {
 		logs.Warn("get connection from client id %d  error %s", s.task.Client.Id, err.Error())
+		e.Close(accesslog.ReasonDialError)
 		return
 	}
 
@@ -243,6 +252,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 				logs.Error("write data to client error", err.Error())
 				return
 			}
+			e.AddIn(int64(n))
 		}
 	}()
 
@@ -265,6 +275,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 				logs.Warn("write data to user ", err.Error())
 				return
 			}
+			e.AddOut(int64(l))
 		}
 	}()
 
@@ -281,7 +292,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 }
 
 //new conn
-func (s *Sock5ModeServer) handleConn(c net.Conn) {
+func (s *Sock5ModeServer) handleConn(c net.Conn, e *accesslog.Entry) {
 	buf := make([]byte, 2)
 	if _, err := io.ReadFull(c, buf); err != nil {
 		logs.Warn("negotiation err", err)
@@ -306,6 +317,7 @@ func (s *Sock5ModeServer) handleConn(c net.Conn) {
 		buf[1] = UserPassAuth
 		c.Write(buf)
 		if err := s.Auth(c); err != nil {
+			e.Deny(accesslog.AuthBasicAuth)
 			c.Close()
 			logs.Warn("Validation failed:", err)
 			return
@@ -314,7 +326,7 @@ func (s *Sock5ModeServer) handleConn(c net.Conn) {
 		buf[1] = 0
 		c.Write(buf)
 	}
-	s.handleRequest(c)
+	s.handleRequest(c, e)
 }
 
 //socks5 auth
@@ -350,6 +362,7 @@ func (s *Sock5ModeServer) Auth(c net.Conn) error {
 		var ok bool
 		P, ok = s.task.MultiAccount.AccountMap[U]
 		if !ok {
+			ban.Fail(c.RemoteAddr().String(), ban.ReasonSocks5)
 			return errors.New("验证不通过")
 		}
 	} else {
@@ -363,6 +376,7 @@ func (s *Sock5ModeServer) Auth(c net.Conn) error {
 		}
 		return nil
 	} else {
+		ban.Fail(c.RemoteAddr().String(), ban.ReasonSocks5)
 		if _, err := c.Write([]byte{userAuthVersion, authFailure}); err != nil {
 			return err
 		}
@@ -373,13 +387,24 @@ func (s *Sock5ModeServer) Auth(c net.Conn) error {
 //start
 func (s *Sock5ModeServer) Start() error {
 	return conn.NewTcpListenerAndProcess(s.task.ServerIp+":"+strconv.Itoa(s.task.Port), func(c net.Conn) {
+		e := accesslog.New(s.task.Mode, c.RemoteAddr().String())
+		e.TunnelId = s.task.Id
+		e.ClientId = s.task.Client.Id
+		defer e.Write()
+		if IsAclDenied(c.RemoteAddr().String(), &s.task.Acl, "隧道["+strconv.Itoa(s.task.Id)+"]") {
+			e.Deny(accesslog.AuthAcl)
+			c.Close()
+			return
+		}
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
 			logs.Warn("client id %d, task id %d, error %s, when socks5 connection", s.task.Client.Id, s.task.Id, err.Error())
+			e.Close(accesslog.ReasonLimit)
 			c.Close()
 			return
 		}
 		logs.Trace("New socks5 connection,client %d,remote address %s", s.task.Client.Id, c.RemoteAddr())
-		s.handleConn(c)
+		defer metrics.Open(metrics.Tunnel, s.task.Id)()
+		s.handleConn(c, e)
 		s.task.Client.AddConn()
 	}, &s.listener)
 }
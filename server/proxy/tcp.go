@@ -8,9 +8,12 @@ import (
 	"strconv"
 
 	"ehang.io/nps/bridge"
+	"ehang.io/nps/lib/accesslog"
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/metrics"
 	"ehang.io/nps/server/connection"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
@@ -34,13 +37,27 @@ func NewTunnelModeServer(process process, bridge NetBridge, task *file.Tunnel) *
 // 开始
 func (s *TunnelModeServer) Start() error {
 	return conn.NewTcpListenerAndProcess(s.task.ServerIp+":"+strconv.Itoa(s.task.Port), func(c net.Conn) {
+		e := accesslog.New(s.task.Mode, c.RemoteAddr().String())
+		e.TunnelId = s.task.Id
+		e.ClientId = s.task.Client.Id
+		defer e.Write()
+		if IsAclDenied(c.RemoteAddr().String(), &s.task.Acl, "隧道["+strconv.Itoa(s.task.Id)+"]") {
+			e.Deny(accesslog.AuthAcl)
+			c.Close()
+			return
+		}
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
 			logs.Warn("client id %d, task id %d,error %s, when tcp connection", s.task.Client.Id, s.task.Id, err.Error())
+			e.Close(accesslog.ReasonLimit)
 			c.Close()
 			return
 		}
 		logs.Trace("new tcp connection,local port %d,client %d,remote address %s", s.task.Port, s.task.Client.Id, c.RemoteAddr())
-		s.process(conn.NewConn(c), s)
+		done := metrics.Open(metrics.Tunnel, s.task.Id)
+		if err := s.process(conn.NewConn(c), s, e); err != nil {
+			e.Close(accesslog.ReasonError)
+		}
+		done()
 		s.task.Client.AddConn()
 	}, &s.listener)
 }
@@ -68,6 +85,7 @@ func (s *WebServer) Start() error {
 	err := errors.New("Web management startup failure ")
 	var l net.Listener
 	if l, err = connection.GetWebManagerListener(); err == nil {
+		l = &ban.Listener{Listener: l}
 		beego.InitBeforeHTTPRun()
 		if beego.AppConfig.String("web_open_ssl") == "true" {
 			keyPath := beego.AppConfig.String("web_key_file")
@@ -93,41 +111,45 @@ func NewWebServer(bridge *bridge.Bridge) *WebServer {
 	return s
 }
 
-type process func(c *conn.Conn, s *TunnelModeServer) error
+type process func(c *conn.Conn, s *TunnelModeServer, e *accesslog.Entry) error
 
 // tcp proxy
-func ProcessTunnel(c *conn.Conn, s *TunnelModeServer) error {
+func ProcessTunnel(c *conn.Conn, s *TunnelModeServer, e *accesslog.Entry) error {
 	// 优先检查访问地址是否在全局白名单内，如果在白名单内则跳过所有验证
 	if IsGlobalWhiteIp(c.RemoteAddr().String()) {
 		// 白名单内的IP直接通过，不需要任何验证
-		targetAddr, err := s.task.Target.GetRandomTarget()
-		if err != nil {
-			c.Close()
-			logs.Warn("tcp port %d ,client id %d,task id %d connect error %s (whitelisted)", s.task.Port, s.task.Client.Id, s.task.Id, err.Error())
-			return err
-		}
-		return s.DealClient(c, s.task.Client, targetAddr, nil, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, s.task)
+		return s.dealTarget(c, e)
 	}
 
 	// 全局密码认证检查 (如果隧道未设置 Bypass)
 	if !s.task.BypassGlobalPassword && CheckGlobalPasswordAuth(c.RemoteAddr().String()) {
 		logs.Warn("Global password authentication required for TCP tunnel (TaskID: %d) from %s, closing.", s.task.Id, c.RemoteAddr().String())
+		e.Deny(accesslog.AuthGlobalPassword)
 		c.Close()
 		return errors.New("global password authentication required")
 	}
 
-	targetAddr, err := s.task.Target.GetRandomTarget()
-	if err != nil {
-		c.Close()
-		logs.Warn("tcp port %d ,client id %d,task id %d connect error %s", s.task.Port, s.task.Client.Id, s.task.Id, err.Error())
-		return err
-	}
+	return s.dealTarget(c, e)
+}
 
-	return s.DealClient(c, s.task.Client, targetAddr, nil, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, s.task)
+// dealTarget 连接负载均衡选出的目标，目标拒绝连接时换其他目标重试
+func (s *TunnelModeServer) dealTarget(c *conn.Conn, e *accesslog.Entry) error {
+	done := func() {}
+	defer func() { done() }()
+	return s.dealClient(c, s.task.Client, nil, common.CONN_TCP, nil, s.task.Client.Flow, s.task, e, func() (target net.Conn, link *conn.Link, err error) {
+		target, done, err = dialTarget(s.task.Target, common.GetIpByAddr(c.RemoteAddr().String()), DialRetries, func(addr string) (net.Conn, error) {
+			link = conn.NewLink(common.CONN_TCP, addr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, c.Conn.RemoteAddr().String(), s.task.Target.LocalProxy)
+			return s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
+		})
+		if err != nil {
+			logs.Warn("tcp port %d ,client id %d,task id %d connect error %s", s.task.Port, s.task.Client.Id, s.task.Id, err.Error())
+		}
+		return
+	})
 }
 
 // http proxy
-func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
+func ProcessHttp(c *conn.Conn, s *TunnelModeServer, e *accesslog.Entry) error {
 	// 优先检查访问地址是否在全局白名单内，如果在白名单内则跳过所有验证
 	if IsGlobalWhiteIp(c.RemoteAddr().String()) {
 		_, addr, rb, err, r := c.GetHost()
@@ -140,8 +162,9 @@ func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
 			c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 			rb = nil
 		}
+		e.Method, e.Url = r.Method, r.RequestURI
 		// 白名单IP直接通过，跳过认证
-		return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, nil)
+		return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, nil, e)
 	}
 
 	// 全局密码认证检查 (如果隧道未设置 Bypass)
@@ -150,6 +173,7 @@ func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
 	// 这里我们遵循隧道设置
 	if !s.task.BypassGlobalPassword && CheckGlobalPasswordAuth(c.RemoteAddr().String()) {
 		logs.Warn("Global password authentication required for HTTP proxy (TaskID: %d) from %s, closing.", s.task.Id, c.RemoteAddr().String())
+		e.Deny(accesslog.AuthGlobalPassword)
 		c.Close()
 		return errors.New("global password authentication required")
 	}
@@ -164,8 +188,10 @@ func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
 		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 		rb = nil
 	}
+	e.Method, e.Url = r.Method, r.RequestURI
 	if err := s.auth(r, c, s.task.Client.Cnf.U, s.task.Client.Cnf.P); err != nil {
+		e.Deny(accesslog.AuthBasicAuth)
 		return err
 	}
-	return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, nil)
+	return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, nil, e)
 }
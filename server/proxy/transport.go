@@ -8,15 +8,16 @@ import (
 	"strconv"
 	"syscall"
 
+	"ehang.io/nps/lib/accesslog"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 )
 
-func HandleTrans(c *conn.Conn, s *TunnelModeServer) error {
+func HandleTrans(c *conn.Conn, s *TunnelModeServer, e *accesslog.Entry) error {
 	if addr, err := getAddress(c.Conn); err != nil {
 		return err
 	} else {
-		return s.DealClient(c, s.task.Client, addr, nil, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy, nil)
+		return s.DealClient(c, s.task.Client, addr, nil, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy, nil, e)
 	}
 }
 
@@ -3,9 +3,10 @@
 package proxy
 
 import (
+	"ehang.io/nps/lib/accesslog"
 	"ehang.io/nps/lib/conn"
 )
 
-func HandleTrans(c *conn.Conn, s *TunnelModeServer) error {
+func HandleTrans(c *conn.Conn, s *TunnelModeServer, e *accesslog.Entry) error {
 	return nil
 }
@@ -3,14 +3,18 @@ package proxy
 import (
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"ehang.io/nps/bridge"
+	"ehang.io/nps/lib/accesslog"
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/metrics"
 	"github.com/astaxie/beego/logs"
 )
 
@@ -47,31 +51,51 @@ func (s *UdpModeServer) Start() error {
 			continue
 		}
 
+		if ban.IsBanned(addr.String()) {
+			continue
+		}
+
+		if IsAclDenied(addr.String(), &s.task.Acl, "隧道["+strconv.Itoa(s.task.Id)+"]") {
+			continue
+		}
+
 		// 优先检查访问地址是否在全局白名单内，如果在白名单内则跳过所有验证
 		if IsGlobalWhiteIp(addr.String()) {
 			// 白名单内的IP直接通过，不需要任何验证
 			logs.Trace("New udp connection,client %d,remote address %s (whitelisted)", s.task.Client.Id, addr)
-			go s.process(addr, buf[:n])
+			go s.process(addr, buf[:n], accesslog.AuthWhiteList)
 			continue
 		}
 
 		// 判断访问地址是否在全局黑名单内
 		if IsGlobalBlackIp(addr.String()) {
-			break
+			continue
 		}
 
 		// 判断访问地址是否在黑名单内
-		if common.IsBlackIp(addr.String(), s.task.Client.VerifyKey, s.task.Client.BlackIpList) {
-			break
+		if IsClientBlackIp(addr.String(), s.task.Client) {
+			continue
 		}
 
 		logs.Trace("New udp connection,client %d,remote address %s", s.task.Client.Id, addr)
-		go s.process(addr, buf[:n])
+		go s.process(addr, buf[:n], accesslog.AuthPass)
 	}
 	return nil
 }
 
-func (s *UdpModeServer) process(addr *net.UDPAddr, data []byte) {
+// udpSession 统计 udp 会话中访问者发送的字节数
+type udpSession struct {
+	io.ReadWriteCloser
+	e *accesslog.Entry
+}
+
+func (s *udpSession) Write(b []byte) (n int, err error) {
+	n, err = s.ReadWriteCloser.Write(b)
+	s.e.AddIn(int64(n))
+	return
+}
+
+func (s *UdpModeServer) process(addr *net.UDPAddr, data []byte, auth string) {
 	if v, ok := s.addrMap.Load(addr.String()); ok {
 		clientConn, ok := v.(io.ReadWriteCloser)
 		if ok {
@@ -83,16 +107,25 @@ func (s *UdpModeServer) process(addr *net.UDPAddr, data []byte) {
 			s.task.Client.Flow.Add(int64(len(data)), int64(len(data)))
 		}
 	} else {
+		e := accesslog.New(s.task.Mode, addr.String())
+		e.TunnelId = s.task.Id
+		e.ClientId = s.task.Client.Id
+		e.Target = s.task.Target.TargetStr
+		e.Auth = auth
+		defer e.Write()
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
 			logs.Warn("client id %d, task id %d,error %s, when udp connection", s.task.Client.Id, s.task.Id, err.Error())
+			e.Close(accesslog.ReasonLimit)
 			return
 		}
 		defer s.task.Client.AddConn()
+		defer metrics.Open(metrics.Tunnel, s.task.Id)()
 		link := conn.NewLink(common.CONN_UDP, s.task.Target.TargetStr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, addr.String(), s.task.Target.LocalProxy)
 		if clientConn, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task); err != nil {
+			e.Close(accesslog.ReasonDialError)
 			return
 		} else {
-			target := conn.GetConn(clientConn, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, nil, true)
+			target := &udpSession{conn.GetConn(clientConn, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, nil, true), e}
 			s.addrMap.Store(addr.String(), target)
 			defer target.Close()
 
@@ -118,6 +151,7 @@ func (s *UdpModeServer) process(addr *net.UDPAddr, data []byte) {
 						logs.Warn(err)
 						return
 					}
+					e.AddOut(int64(n))
 					s.task.Client.Flow.Add(int64(n), int64(n))
 				}
 				//if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
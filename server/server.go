@@ -59,6 +59,10 @@ func InitFromCsv() {
 		//RunList[c.Id] = nil
 	}
 	//Initialize services in server-side files
+	if clusterNode != nil {
+		// 集群模式下由选举结果决定启动哪些隧道
+		return
+	}
 	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 		if value.(*file.Tunnel).Status {
 			AddTask(value.(*file.Tunnel))
@@ -88,7 +92,7 @@ func DealBridgeTask() {
 			logs.Trace("New secret connection, addr", s.Conn.Conn.RemoteAddr())
 			if t := file.GetDb().GetTaskByMd5Password(s.Password); t != nil {
 				if t.Status {
-					go proxy.NewBaseServer(Bridge, t).DealClient(s.Conn, t.Client, t.Target.TargetStr, nil, common.CONN_TCP, nil, t.Flow, t.Target.LocalProxy, nil)
+					go proxy.NewBaseServer(Bridge, t).DealClient(s.Conn, t.Client, t.Target.TargetStr, nil, common.CONN_TCP, nil, t.Flow, t.Target.LocalProxy, nil, nil)
 				} else {
 					s.Conn.Close()
 					logs.Trace("This key %s cannot be processed,status is close", s.Password)
@@ -104,6 +108,7 @@ func DealBridgeTask() {
 // start a new server
 func StartNewServer(bridgePort int, cnf *file.Tunnel, bridgeType string, bridgeDisconnect int) {
 	Bridge = bridge.NewTunnel(bridgePort, bridgeType, common.GetBoolByStr(beego.AppConfig.String("ip_limit")), RunList, bridgeDisconnect)
+	initCluster()
 	go func() {
 		if err := Bridge.StartTunnel(); err != nil {
 			logs.Error("start server bridge error", err)
@@ -117,6 +122,8 @@ func StartNewServer(bridgePort int, cnf *file.Tunnel, bridgeType string, bridgeD
 	}
 	go DealBridgeTask()
 	go dealClientFlow()
+	StartMetricsServer()
+	proxy.InitAcme()
 	if svr := NewMode(Bridge, cnf); svr != nil {
 		if err := svr.Start(); err != nil {
 			logs.Error(err)
@@ -165,10 +172,7 @@ func NewMode(Bridge *bridge.Bridge, c *file.Tunnel) proxy.Service {
 	case "httpHostServer":
 		httpPort, _ := beego.AppConfig.Int("http_proxy_port")
 		httpsPort, _ := beego.AppConfig.Int("https_proxy_port")
-		useCache, _ := beego.AppConfig.Bool("http_cache")
-		cacheLen, _ := beego.AppConfig.Int("http_cache_length")
-		addOrigin, _ := beego.AppConfig.Bool("http_add_origin_header")
-		service = proxy.NewHttp(Bridge, c, httpPort, httpsPort, useCache, cacheLen, addOrigin)
+		service = proxy.NewHttp(Bridge, c, httpPort, httpsPort)
 	}
 	return service
 }
@@ -207,12 +211,18 @@ func AddTask(t *file.Tunnel) error {
 		RunList.Store(t.Id, nil)
 		return nil
 	}
+	if clusterNode != nil && !clusterNode.accept(t) {
+		logs.Info("taskId %d port %d is served by another cluster node", t.Id, t.Port)
+		return nil
+	}
 	if b := tool.TestServerPort(t.Port, t.Mode); !b && t.Mode != "httpHostServer" {
 		logs.Error("taskId %d start error port %d open failed", t.Id, t.Port)
 		return errors.New("the port open error")
 	}
 	if minute, err := beego.AppConfig.Int("flow_store_interval"); err == nil && minute > 0 {
-		go flowSession(time.Minute * time.Duration(minute))
+		flowSessionOnce.Do(func() {
+			go flowSession(time.Minute * time.Duration(minute))
+		})
 	}
 	if svr := NewMode(Bridge, t); svr != nil {
 		logs.Info("tunnel task %s start mode：%s port %d", t.Remark, t.Mode, t.Port)
@@ -256,7 +266,7 @@ func DelTask(id int) error {
 }
 
 // get task list by page num
-func GetTunnel(start, length int, typeVal string, clientId int, search string, sortField string, order string) ([]*file.Tunnel, int) {
+func GetTunnel(start, length int, typeVal string, clientId int, search string, sortField string, order string, allow func(clientId int) bool) ([]*file.Tunnel, int) {
 	all_list := make([]*file.Tunnel, 0) //store all Tunnel
 	list := make([]*file.Tunnel, 0)
 	var cnt int
@@ -269,6 +279,9 @@ func GetTunnel(start, length int, typeVal string, clientId int, search string, s
 			if (typeVal != "" && v.Mode != typeVal || (clientId != 0 && v.Client.Id != clientId)) || (typeVal == "" && clientId != v.Client.Id) {
 				continue
 			}
+			if allow != nil && !allow(v.Client.Id) {
+				continue
+			}
 			all_list = append(all_list, v)
 		}
 	}
@@ -337,12 +350,12 @@ func GetTunnel(start, length int, typeVal string, clientId int, search string, s
 }
 
 // get client list
-func GetClientList(start, length int, search, sort, order string, clientId int) (list []*file.Client, cnt int) {
+func GetClientList(start, length int, search, sort, order string, clientId int, allow func(clientId int) bool) (list []*file.Client, cnt int) {
 	// 先创建本机客户端
 	localClient := createLocalhostClient()
 
 	// 检查搜索条件是否匹配本机客户端
-	includeLocalhost := shouldIncludeLocalhost(localClient, search, clientId)
+	includeLocalhost := shouldIncludeLocalhost(localClient, search, clientId) && (allow == nil || allow(localClient.Id))
 
 	// 获取数据库中的客户端列表
 	var dbList []*file.Client
@@ -352,13 +365,13 @@ func GetClientList(start, length int, search, sort, order string, clientId int)
 		// 如果包含本机客户端，需要调整分页参数
 		if start > 0 {
 			// 本机客户端占第一位，所以数据库查询的start需要减1
-			dbList, dbCnt = file.GetDb().GetClientList(start-1, length, search, sort, order, clientId)
+			dbList, dbCnt = file.GetDb().GetClientList(start-1, length, search, sort, order, clientId, allow)
 		} else {
 			// start为0，本机客户端会占用一个位置，所以数据库查询的length需要减1
 			if length > 0 {
-				dbList, dbCnt = file.GetDb().GetClientList(start, length-1, search, sort, order, clientId)
+				dbList, dbCnt = file.GetDb().GetClientList(start, length-1, search, sort, order, clientId, allow)
 			} else {
-				dbList, dbCnt = file.GetDb().GetClientList(start, length, search, sort, order, clientId)
+				dbList, dbCnt = file.GetDb().GetClientList(start, length, search, sort, order, clientId, allow)
 			}
 		}
 		cnt = dbCnt + 1 // 总数要加上本机客户端
@@ -373,7 +386,7 @@ func GetClientList(start, length int, search, sort, order string, clientId int)
 		}
 	} else {
 		// 不包含本机客户端，直接查询数据库
-		list, cnt = file.GetDb().GetClientList(start, length, search, sort, order, clientId)
+		list, cnt = file.GetDb().GetClientList(start, length, search, sort, order, clientId, allow)
 	}
 
 	dealClientData()
@@ -647,17 +660,16 @@ func GetDashboardData() map[string]interface{} {
 	return data
 }
 
-// 实例化流量数据到文件
+var flowSessionOnce sync.Once
+
+// 实例化流量数据到文件，所有数据在同一个事务内写入
 func flowSession(m time.Duration) {
 	ticker := time.NewTicker(m)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			file.GetDb().JsonDb.StoreHostToJsonFile()
-			file.GetDb().JsonDb.StoreTasksToJsonFile()
-			file.GetDb().JsonDb.StoreClientsToJsonFile()
-			file.GetDb().JsonDb.StoreGlobalToJsonFile()
+			file.GetDb().JsonDb.Flush()
 		}
 	}
 }
@@ -33,7 +33,7 @@ func TestServerConfig() {
 	if p := beego.AppConfig.String("bridge_port"); p != "" {
 		if port, err := strconv.Atoi(p); err != nil {
 			log.Fatalln("get Server and client communication portserror:", err)
-		} else if beego.AppConfig.String("bridge_type") == "kcp" {
+		} else if t := beego.AppConfig.String("bridge_type"); t == "kcp" || t == "quic" {
 			isInArr(&postUdpArr, port, "Server and client communication ports", "udp")
 		} else {
 			isInArr(&postTcpArr, port, "Server and client communication ports", "tcp")
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"time"
+
+	"ehang.io/nps/lib/audit"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+)
+
+// AccountController 当前登录账号的设置，管理员、web 用户和客户端用户都可以访问
+type AccountController struct {
+	BaseController
+}
+
+// client 返回客户端用户登录的客户端，其他账号返回 nil
+func (s *AccountController) client() *file.Client {
+	if isAdmin, ok := s.GetSession("isAdmin").(bool); !ok || isAdmin || s.user != nil {
+		return nil
+	}
+	if id, ok := s.GetSession("clientId").(int); ok {
+		if c, err := file.GetDb().GetClient(id); err == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// totp 返回当前账号的两步验证配置和账号名称
+func (s *AccountController) totp() (*file.Totp, string) {
+	if s.user != nil {
+		return s.user.Totp, s.user.Username
+	}
+	if c := s.client(); c != nil {
+		if c.WebUserName == "" {
+			return c.Totp, "user"
+		}
+		return c.Totp, c.WebUserName
+	}
+	if isAdmin, ok := s.GetSession("isAdmin").(bool); ok && isAdmin {
+		if g := file.GetDb().GetGlobal(); g != nil {
+			return g.AdminTotp, beego.AppConfig.String("web_username")
+		}
+		return nil, beego.AppConfig.String("web_username")
+	}
+	s.forbidden()
+	return nil, ""
+}
+
+func (s *AccountController) setTotp(t *file.Totp) error {
+	if s.user != nil {
+		return file.GetDb().SetUserTotp(s.user, t)
+	}
+	if c := s.client(); c != nil {
+		return file.GetDb().SetClientTotp(c, t)
+	}
+	return file.GetDb().SetAdminTotp(t)
+}
+
+// auditTotp 记录两步验证的修改，管理员的 id 为 0，客户端用户记录在客户端上
+func (s *AccountController) auditTotp(before, after map[string]interface{}) {
+	id := 0
+	if s.user != nil {
+		id = s.user.Id
+	} else if c := s.client(); c != nil {
+		s.audit(audit.ActionUpdate, audit.ObjectClient, c.Id, before, after)
+		return
+	}
+	s.audit(audit.ActionUpdate, audit.ObjectAccount, id, before, after)
+}
+
+// Totp 两步验证设置页面，未开启时生成新的密钥
+func (s *AccountController) Totp() {
+	t, account := s.totp()
+	s.Data["menu"] = "totp"
+	s.Data["totp_enabled"] = t.Enabled()
+	if t.Enabled() {
+		s.Data["recovery_codes_left"] = len(t.RecoveryCodes)
+	} else {
+		secret := crypt.NewTotpSecret()
+		s.SetSession("totpSecret", secret)
+		s.Data["totp_secret"] = secret
+		s.Data["totp_uri"] = crypt.TotpUri("nps", account, secret)
+	}
+	s.SetInfo("two-factor authentication")
+	s.display("account/totp")
+}
+
+// EnableTotp 验证动态码后开启两步验证，返回只显示一次的恢复码
+func (s *AccountController) EnableTotp() {
+	t, _ := s.totp()
+	if t.Enabled() {
+		s.AjaxErr("two-factor authentication is already enabled")
+	}
+	secret, ok := s.GetSession("totpSecret").(string)
+	if !ok {
+		s.AjaxErr("please refresh the page and try again")
+	}
+	if _, ok := crypt.VerifyTotp(secret, s.GetString("code"), time.Now()); !ok {
+		s.AjaxErr("two-factor code incorrect")
+	}
+	t, codes := file.NewTotp(secret)
+	if err := s.setTotp(t); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.DelSession("totpSecret")
+	s.auditTotp(map[string]interface{}{"Totp": false}, map[string]interface{}{"Totp": true})
+	s.Data["json"] = map[string]interface{}{"status": 1, "msg": "two-factor authentication enabled", "codes": codes}
+	s.ServeJSON()
+	s.StopRun()
+}
+
+// DisableTotp 使用动态码或恢复码关闭两步验证
+func (s *AccountController) DisableTotp() {
+	t, _ := s.totp()
+	if !t.Enabled() || !file.GetDb().VerifyTotp(t, s.GetString("code")) {
+		s.AjaxErr("two-factor code incorrect")
+	}
+	if err := s.setTotp(nil); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.auditTotp(map[string]interface{}{"Totp": true}, map[string]interface{}{"Totp": false})
+	s.AjaxOk("two-factor authentication disabled")
+}
+
+// RecoveryCodes 重新生成恢复码，旧的恢复码失效
+func (s *AccountController) RecoveryCodes() {
+	t, _ := s.totp()
+	if !t.Enabled() || !file.GetDb().VerifyTotp(t, s.GetString("code")) {
+		s.AjaxErr("two-factor code incorrect")
+	}
+	before := audit.Capture(t)
+	t, codes := file.NewTotp(t.Secret)
+	if err := s.setTotp(t); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.auditTotp(before, audit.Capture(t))
+	s.Data["json"] = map[string]interface{}{"status": 1, "msg": "recovery codes regenerated", "codes": codes}
+	s.ServeJSON()
+	s.StopRun()
+}
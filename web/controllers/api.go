@@ -0,0 +1,1042 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ehang.io/nps/lib/audit"
+	"ehang.io/nps/lib/ban"
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/iplist"
+	"ehang.io/nps/lib/rate"
+	"ehang.io/nps/server"
+	"ehang.io/nps/server/proxy"
+	"ehang.io/nps/server/tool"
+	"github.com/astaxie/beego"
+)
+
+// /api/v1 接口，使用 json 请求与响应，通过 Authorization: Bearer <token> 验证
+
+type ApiController struct {
+	beego.Controller
+	token *file.ApiToken
+}
+
+type apiError struct {
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+type apiList struct {
+	Total int         `json:"total"`
+	Items interface{} `json:"items"`
+}
+
+// 隧道模式，域名解析不属于隧道
+var apiTunnelModes = []string{"tcp", "udp", "socks5", "httpProxy", "secret", "p2p", "file"}
+
+// Prepare 验证令牌以及令牌对请求资源的权限
+func (s *ApiController) Prepare() {
+	if _, action := s.GetControllerAndAction(); action == "OpenApi" {
+		return
+	}
+	auth := s.Ctx.Input.Header("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		s.Ctx.Output.Header("WWW-Authenticate", "Bearer")
+		s.fail(http.StatusUnauthorized, "missing bearer token", nil)
+	}
+	t, err := file.GetDb().GetApiToken(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		s.Ctx.Output.Header("WWW-Authenticate", "Bearer")
+		s.fail(http.StatusUnauthorized, err.Error(), nil)
+	}
+	if !t.Allow(s.resource(), s.Ctx.Request.Method != http.MethodGet) {
+		s.fail(http.StatusForbidden, "the token does not have the required scope", nil)
+	}
+	s.token = t
+}
+
+// resource 返回请求路径 /api/v1/ 后的第一段
+func (s *ApiController) resource() string {
+	path := s.Ctx.Request.URL.Path
+	if i := strings.Index(path, "/api/v1/"); i >= 0 {
+		path = path[i+len("/api/v1/"):]
+	}
+	return strings.SplitN(path, "/", 2)[0]
+}
+
+func (s *ApiController) reply(status int, v interface{}) {
+	if v == nil {
+		s.Ctx.ResponseWriter.WriteHeader(status)
+		s.StopRun()
+	}
+	s.Ctx.Output.SetStatus(status)
+	s.Data["json"] = v
+	s.ServeJSON()
+	s.StopRun()
+}
+
+func (s *ApiController) fail(status int, msg string, fields map[string]string) {
+	s.reply(status, &apiError{Error: msg, Fields: fields})
+}
+
+// decode 解析请求体，v 中为 nil 的字段表示未提交
+func (s *ApiController) decode(v interface{}) {
+	// 表单请求体已经被 beego 解析，无法再读取
+	if !strings.HasPrefix(s.Ctx.Input.Header("Content-Type"), "application/json") {
+		s.fail(http.StatusUnsupportedMediaType, "Content-Type must be application/json", nil)
+	}
+	if err := json.NewDecoder(s.Ctx.Request.Body).Decode(v); err != nil {
+		s.fail(http.StatusBadRequest, "invalid json body: "+err.Error(), nil)
+	}
+}
+
+func (s *ApiController) id() int {
+	id, err := strconv.Atoi(s.Ctx.Input.Param(":id"))
+	if err != nil {
+		s.fail(http.StatusNotFound, "not found", nil)
+	}
+	return id
+}
+
+// audit 记录令牌做出的配置修改
+func (s *ApiController) audit(action, object string, id int, before, after map[string]interface{}) {
+	audit.Log("token:"+s.token.Name, common.GetIpByAddr(s.Ctx.Request.RemoteAddr), action, object, id, before, after)
+}
+
+func (s *ApiController) page() (offset, limit int) {
+	offset, _ = strconv.Atoi(s.Ctx.Input.Query("offset"))
+	limit, _ = strconv.Atoi(s.Ctx.Input.Query("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	return
+}
+
+// fieldErrors 收集字段校验错误
+type fieldErrors map[string]string
+
+func (f fieldErrors) check(ok bool, field, msg string) {
+	if !ok {
+		if _, exist := f[field]; !exist {
+			f[field] = msg
+		}
+	}
+}
+
+func (s *ApiController) validate(f fieldErrors) {
+	if len(f) > 0 {
+		s.fail(http.StatusUnprocessableEntity, "validation failed", f)
+	}
+}
+
+func setString(dst *string, v *string) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setInt(dst *int, v *int) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setBool(dst *bool, v *bool) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// setIpList 设置访问控制列表，去掉空行和重复的行
+func setIpList(dst *[]string, v *[]string) {
+	if v != nil {
+		list := make([]string, 0, len(*v))
+		for _, line := range *v {
+			if line = strings.TrimSpace(line); line != "" {
+				list = append(list, line)
+			}
+		}
+		*dst = RemoveRepeatedElement(list)
+	}
+}
+
+// ---------------- clients ----------------
+
+type apiClient struct {
+	Id              int      `json:"id"`
+	VerifyKey       string   `json:"vkey"`
+	Remark          string   `json:"remark"`
+	Status          bool     `json:"status"`
+	Online          bool     `json:"online"`
+	Addr            string   `json:"addr"`
+	Version         string   `json:"version"`
+	BasicUsername   string   `json:"basic_username"`
+	BasicPassword   string   `json:"basic_password"`
+	Compress        bool     `json:"compress"`
+	Crypt           bool     `json:"crypt"`
+	ConfigConnAllow bool     `json:"config_conn_allow"`
+	RateLimit       int      `json:"rate_limit"`
+	MaxConn         int      `json:"max_conn"`
+	MaxTunnel       int      `json:"max_tunnel"`
+	FlowLimit       int64    `json:"flow_limit"`
+	WebUsername     string   `json:"web_username"`
+	WebPassword     string   `json:"web_password"`
+	BlackIpList     []string `json:"black_ip_list"`
+	NowConn         int32    `json:"now_conn"`
+	InletFlow       int64    `json:"inlet_flow"`
+	ExportFlow      int64    `json:"export_flow"`
+	CreateTime      string   `json:"create_time"`
+	LastOnlineTime  string   `json:"last_online_time"`
+}
+
+type apiClientInput struct {
+	VerifyKey       *string   `json:"vkey"`
+	Remark          *string   `json:"remark"`
+	Status          *bool     `json:"status"`
+	BasicUsername   *string   `json:"basic_username"`
+	BasicPassword   *string   `json:"basic_password"`
+	Compress        *bool     `json:"compress"`
+	Crypt           *bool     `json:"crypt"`
+	ConfigConnAllow *bool     `json:"config_conn_allow"`
+	RateLimit       *int      `json:"rate_limit"`
+	MaxConn         *int      `json:"max_conn"`
+	MaxTunnel       *int      `json:"max_tunnel"`
+	FlowLimit       *int64    `json:"flow_limit"`
+	WebUsername     *string   `json:"web_username"`
+	WebPassword     *string   `json:"web_password"`
+	BlackIpList     *[]string `json:"black_ip_list"`
+}
+
+func toApiClient(c *file.Client) *apiClient {
+	v := &apiClient{Id: c.Id, VerifyKey: c.VerifyKey, Remark: c.Remark, Status: c.Status, Online: c.IsConnect,
+		Addr: c.Addr, Version: c.Version, ConfigConnAllow: c.ConfigConnAllow, RateLimit: c.RateLimit,
+		MaxConn: c.MaxConn, MaxTunnel: c.MaxTunnelNum, WebUsername: c.WebUserName, WebPassword: c.WebPassword,
+		BlackIpList: c.BlackIpList, NowConn: c.NowConn, CreateTime: c.CreateTime, LastOnlineTime: c.LastOnlineTime}
+	if c.Cnf != nil {
+		v.BasicUsername, v.BasicPassword, v.Compress, v.Crypt = c.Cnf.U, c.Cnf.P, c.Cnf.Compress, c.Cnf.Crypt
+	}
+	if c.Flow != nil {
+		v.FlowLimit, v.InletFlow, v.ExportFlow = c.Flow.FlowLimit, c.Flow.InletFlow, c.Flow.ExportFlow
+	}
+	return v
+}
+
+func (in *apiClientInput) validate(f fieldErrors, id int) {
+	if in.RateLimit != nil {
+		f.check(*in.RateLimit >= 0, "rate_limit", "must not be negative")
+	}
+	if in.MaxConn != nil {
+		f.check(*in.MaxConn >= 0, "max_conn", "must not be negative")
+	}
+	if in.MaxTunnel != nil {
+		f.check(*in.MaxTunnel >= 0, "max_tunnel", "must not be negative")
+	}
+	if in.FlowLimit != nil {
+		f.check(*in.FlowLimit >= 0, "flow_limit", "must not be negative")
+	}
+	if in.VerifyKey != nil && *in.VerifyKey != "" {
+		f.check(file.GetDb().VerifyVkey(*in.VerifyKey, id), "vkey", "duplicate vkey")
+	}
+	if in.WebUsername != nil && *in.WebUsername != "" {
+		f.check(*in.WebUsername != beego.AppConfig.String("web_username") && file.GetDb().VerifyUserName(*in.WebUsername, id),
+			"web_username", "duplicate web username")
+	}
+	if in.BlackIpList != nil {
+		checkIpList(f, "black_ip_list", *in.BlackIpList)
+	}
+}
+
+func checkIpList(f fieldErrors, field string, lines []string) {
+	if err := iplist.Check(lines); err != nil {
+		f.check(false, field, err.Error())
+	}
+}
+
+func (in *apiClientInput) apply(c *file.Client) {
+	setString(&c.VerifyKey, in.VerifyKey)
+	setString(&c.Remark, in.Remark)
+	setBool(&c.Status, in.Status)
+	setString(&c.Cnf.U, in.BasicUsername)
+	setString(&c.Cnf.P, in.BasicPassword)
+	setBool(&c.Cnf.Compress, in.Compress)
+	setBool(&c.Cnf.Crypt, in.Crypt)
+	setBool(&c.ConfigConnAllow, in.ConfigConnAllow)
+	setInt(&c.RateLimit, in.RateLimit)
+	setInt(&c.MaxConn, in.MaxConn)
+	setInt(&c.MaxTunnelNum, in.MaxTunnel)
+	if in.FlowLimit != nil {
+		c.Flow.FlowLimit = *in.FlowLimit
+	}
+	setString(&c.WebUserName, in.WebUsername)
+	setString(&c.WebPassword, in.WebPassword)
+	if in.BlackIpList != nil {
+		c.BlackIpList = RemoveRepeatedElement(*in.BlackIpList)
+	}
+}
+
+func (s *ApiController) getClient() *file.Client {
+	c, err := file.GetDb().GetClient(s.id())
+	if err != nil || c.NoDisplay {
+		s.fail(http.StatusNotFound, "client not found", nil)
+	}
+	return c
+}
+
+func (s *ApiController) ListClients() {
+	offset, limit := s.page()
+	list, cnt := file.GetDb().GetClientList(offset, limit, s.Ctx.Input.Query("search"), "", "", 0, nil)
+	items := make([]*apiClient, 0, len(list))
+	for _, c := range list {
+		items = append(items, toApiClient(c))
+	}
+	s.reply(http.StatusOK, &apiList{Total: cnt, Items: items})
+}
+
+func (s *ApiController) GetClient() {
+	s.reply(http.StatusOK, toApiClient(s.getClient()))
+}
+
+func (s *ApiController) CreateClient() {
+	in := new(apiClientInput)
+	s.decode(in)
+	f := make(fieldErrors)
+	in.validate(f, 0)
+	s.validate(f)
+	c := &file.Client{
+		Status:     true,
+		Cnf:        &file.Config{},
+		Flow:       &file.Flow{},
+		CreateTime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	in.apply(c)
+	c.Id = int(file.GetDb().JsonDb.GetClientId())
+	if err := file.GetDb().NewClient(c); err != nil {
+		s.fail(http.StatusConflict, err.Error(), nil)
+	}
+	s.audit(audit.ActionCreate, audit.ObjectClient, c.Id, nil, audit.Capture(c))
+	s.reply(http.StatusCreated, toApiClient(c))
+}
+
+func (s *ApiController) UpdateClient() {
+	c := s.getClient()
+	in := new(apiClientInput)
+	s.decode(in)
+	f := make(fieldErrors)
+	in.validate(f, c.Id)
+	s.validate(f)
+	before := audit.Capture(c)
+	rateLimit := c.RateLimit
+	in.apply(c)
+	if c.RateLimit != rateLimit {
+		if c.Rate != nil {
+			c.Rate.Stop()
+		}
+		if c.RateLimit > 0 {
+			c.Rate = rate.NewRate(int64(c.RateLimit * 1024))
+		} else {
+			c.Rate = rate.NewRate(int64(2 << 23))
+		}
+		c.Rate.Start()
+	}
+	file.GetDb().JsonDb.StoreClientsToJsonFile()
+	s.audit(audit.ActionUpdate, audit.ObjectClient, c.Id, before, audit.Capture(c))
+	if !c.Status {
+		server.DelClientConnect(c.Id)
+	}
+	s.reply(http.StatusOK, toApiClient(c))
+}
+
+func (s *ApiController) DeleteClient() {
+	c := s.getClient()
+	before := audit.Capture(c)
+	if err := file.GetDb().DelClient(c.Id); err != nil {
+		s.fail(http.StatusInternalServerError, err.Error(), nil)
+	}
+	s.audit(audit.ActionDelete, audit.ObjectClient, c.Id, before, nil)
+	server.DelTunnelAndHostByClientId(c.Id, false)
+	server.DelClientConnect(c.Id)
+	s.reply(http.StatusNoContent, nil)
+}
+
+// ---------------- tunnels ----------------
+
+type apiTunnel struct {
+	Id                   int              `json:"id"`
+	ClientId             int              `json:"client_id"`
+	Type                 string           `json:"type"`
+	Port                 int              `json:"port"`
+	ServerIp             string           `json:"server_ip"`
+	Target               string           `json:"target"`
+	Balance              string           `json:"balance"`
+	TargetConns          map[string]int64 `json:"target_conns"`
+	Ejected              []*file.Ejection `json:"ejected"`
+	LocalProxy           bool             `json:"local_proxy"`
+	Password             string           `json:"password"`
+	LocalPath            string           `json:"local_path"`
+	StripPre             string           `json:"strip_pre"`
+	Remark               string           `json:"remark"`
+	BypassGlobalPassword bool             `json:"bypass_global_password"`
+	AllowIpList          []string         `json:"allow_ip_list"`
+	DenyIpList           []string         `json:"deny_ip_list"`
+	Status               bool             `json:"status"`
+	Running              bool             `json:"running"`
+	InletFlow            int64            `json:"inlet_flow"`
+	ExportFlow           int64            `json:"export_flow"`
+}
+
+type apiTunnelInput struct {
+	ClientId             *int      `json:"client_id"`
+	Type                 *string   `json:"type"`
+	Port                 *int      `json:"port"`
+	ServerIp             *string   `json:"server_ip"`
+	Target               *string   `json:"target"`
+	Balance              *string   `json:"balance"`
+	LocalProxy           *bool     `json:"local_proxy"`
+	Password             *string   `json:"password"`
+	LocalPath            *string   `json:"local_path"`
+	StripPre             *string   `json:"strip_pre"`
+	Remark               *string   `json:"remark"`
+	BypassGlobalPassword *bool     `json:"bypass_global_password"`
+	AllowIpList          *[]string `json:"allow_ip_list"`
+	DenyIpList           *[]string `json:"deny_ip_list"`
+}
+
+func toApiTunnel(t *file.Tunnel) *apiTunnel {
+	v := &apiTunnel{Id: t.Id, ClientId: t.Client.Id, Type: t.Mode, Port: t.Port, ServerIp: t.ServerIp,
+		Password: t.Password, LocalPath: t.LocalPath, StripPre: t.StripPre, Remark: t.Remark,
+		BypassGlobalPassword: t.BypassGlobalPassword, Status: t.Status,
+		AllowIpList: append(make([]string, 0), t.AllowIpList...), DenyIpList: append(make([]string, 0), t.DenyIpList...)}
+	if t.Target != nil {
+		v.Target, v.Balance, v.TargetConns, v.LocalProxy = t.Target.TargetStr, t.Target.Balance, t.Target.Conns(), t.Target.LocalProxy
+		v.Ejected = t.Target.Ejections()
+	}
+	if t.Flow != nil {
+		v.InletFlow, v.ExportFlow = t.Flow.InletFlow, t.Flow.ExportFlow
+	}
+	_, v.Running = server.RunList.Load(t.Id)
+	return v
+}
+
+func (in *apiTunnelInput) apply(t *file.Tunnel) {
+	setString(&t.Mode, in.Type)
+	setInt(&t.Port, in.Port)
+	setString(&t.ServerIp, in.ServerIp)
+	if t.Target == nil {
+		t.Target = new(file.Target)
+	}
+	if in.Target != nil {
+		t.Target = &file.Target{TargetStr: *in.Target, Balance: t.Target.Balance, LocalProxy: t.Target.LocalProxy}
+	}
+	setString(&t.Target.Balance, in.Balance)
+	setBool(&t.Target.LocalProxy, in.LocalProxy)
+	setString(&t.Password, in.Password)
+	setString(&t.LocalPath, in.LocalPath)
+	setString(&t.StripPre, in.StripPre)
+	setString(&t.Remark, in.Remark)
+	setBool(&t.BypassGlobalPassword, in.BypassGlobalPassword)
+	setIpList(&t.AllowIpList, in.AllowIpList)
+	setIpList(&t.DenyIpList, in.DenyIpList)
+	if t.Client != nil && t.Client.Id == common.LOCALHOST_CLIENT_ID {
+		t.Target.LocalProxy = true
+	}
+}
+
+// checkTarget 校验目标的权重和负载均衡策略
+func checkTarget(f fieldErrors, t *file.Target) {
+	_, _, err := file.ParseTargetStr(t.TargetStr)
+	f.check(err == nil, "target", "targets are addr or addr@weight, one per line")
+	f.check(file.ValidBalance(t.Balance), "balance", "must be one of "+strings.Join(file.BalanceStrategies, ", "))
+}
+
+// validate 校验修改后的隧道，portChanged 为 true 时检查端口是否可用
+func (s *ApiController) validateTunnel(t *file.Tunnel, portChanged bool) {
+	f := make(fieldErrors)
+	f.check(t.Client != nil, "client_id", "client not found")
+	f.check(common.InStrArr(apiTunnelModes, t.Mode), "type", "must be one of "+strings.Join(apiTunnelModes, ", "))
+	f.check(t.Port >= 0 && t.Port <= 65535, "port", "must be between 0 and 65535")
+	checkTarget(f, t.Target)
+	checkIpList(f, "allow_ip_list", t.AllowIpList)
+	checkIpList(f, "deny_ip_list", t.DenyIpList)
+	switch t.Mode {
+	case "tcp", "udp":
+		f.check(t.Target.TargetStr != "", "target", "required")
+	case "secret", "p2p":
+		f.check(t.Target.TargetStr != "", "target", "required")
+		f.check(t.Password != "", "password", "required")
+	case "file":
+		f.check(t.LocalPath != "", "local_path", "required")
+	}
+	s.validate(f)
+	if t.Mode == "secret" || t.Mode == "p2p" {
+		return
+	}
+	if t.Port == 0 {
+		t.Port = tool.GenerateServerPort(t.Mode)
+	} else if portChanged && !tool.TestServerPort(t.Port, t.Mode) {
+		s.fail(http.StatusConflict, "validation failed", fieldErrors{"port": "the port cannot be opened, it may be occupied or not allowed"})
+	}
+}
+
+func (s *ApiController) getTunnel() *file.Tunnel {
+	t, err := file.GetDb().GetTask(s.id())
+	if err != nil || t.NoStore {
+		s.fail(http.StatusNotFound, "tunnel not found", nil)
+	}
+	return t
+}
+
+func (s *ApiController) ListTunnels() {
+	offset, limit := s.page()
+	typ := s.Ctx.Input.Query("type")
+	clientId, _ := strconv.Atoi(s.Ctx.Input.Query("client_id"))
+	search := s.Ctx.Input.Query("search")
+	var list []*file.Tunnel
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		t := value.(*file.Tunnel)
+		if t.NoStore || (typ != "" && t.Mode != typ) || (clientId != 0 && t.Client.Id != clientId) {
+			return true
+		}
+		if search != "" && !(strconv.Itoa(t.Id) == search || strconv.Itoa(t.Port) == search || strings.Contains(t.Remark, search) || strings.Contains(t.Target.TargetStr, search)) {
+			return true
+		}
+		list = append(list, t)
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	items := make([]*apiTunnel, 0)
+	for i := offset; i < len(list) && len(items) < limit; i++ {
+		items = append(items, toApiTunnel(list[i]))
+	}
+	cnt := len(list)
+	s.reply(http.StatusOK, &apiList{Total: cnt, Items: items})
+}
+
+func (s *ApiController) GetTunnel() {
+	s.reply(http.StatusOK, toApiTunnel(s.getTunnel()))
+}
+
+func (s *ApiController) CreateTunnel() {
+	in := new(apiTunnelInput)
+	s.decode(in)
+	if in.ClientId == nil || in.Type == nil {
+		f := make(fieldErrors)
+		f.check(in.ClientId != nil, "client_id", "required")
+		f.check(in.Type != nil, "type", "required")
+		s.validate(f)
+	}
+	t := &file.Tunnel{Status: true, Flow: &file.Flow{}, Target: &file.Target{}}
+	t.Client, _ = getClientOrCreateLocalhost(*in.ClientId)
+	in.apply(t)
+	s.validateTunnel(t, true)
+	if t.Client.MaxTunnelNum != 0 && t.Client.GetTunnelNum() >= t.Client.MaxTunnelNum {
+		s.fail(http.StatusConflict, "the number of tunnels exceeds the limit", nil)
+	}
+	t.Id = int(file.GetDb().JsonDb.GetTaskId())
+	if err := file.GetDb().NewTask(t); err != nil {
+		s.fail(http.StatusConflict, err.Error(), nil)
+	}
+	s.audit(audit.ActionCreate, audit.ObjectTunnel, t.Id, nil, audit.Capture(t))
+	if err := server.AddTask(t); err != nil {
+		s.fail(http.StatusConflict, err.Error(), nil)
+	}
+	s.reply(http.StatusCreated, toApiTunnel(t))
+}
+
+func (s *ApiController) UpdateTunnel() {
+	t := s.getTunnel()
+	in := new(apiTunnelInput)
+	s.decode(in)
+	// 在副本上修改，校验通过后再替换
+	n := &file.Tunnel{Id: t.Id, Client: t.Client, Mode: t.Mode, Port: t.Port, ServerIp: t.ServerIp,
+		Target:   &file.Target{TargetStr: t.Target.TargetStr, Balance: t.Target.Balance, LocalProxy: t.Target.LocalProxy},
+		Password: t.Password, LocalPath: t.LocalPath, StripPre: t.StripPre, Remark: t.Remark,
+		BypassGlobalPassword: t.BypassGlobalPassword, Acl: file.Acl{AllowIpList: t.AllowIpList, DenyIpList: t.DenyIpList}}
+	if in.ClientId != nil {
+		n.Client, _ = getClientOrCreateLocalhost(*in.ClientId)
+	}
+	in.apply(n)
+	s.validateTunnel(n, n.Port != t.Port)
+	before := audit.Capture(t)
+	running := t.Status
+	if running {
+		server.StopServer(t.Id)
+	}
+	t.Client, t.Mode, t.Port, t.ServerIp, t.Target = n.Client, n.Mode, n.Port, n.ServerIp, n.Target
+	t.Password, t.LocalPath, t.StripPre, t.Remark = n.Password, n.LocalPath, n.StripPre, n.Remark
+	t.BypassGlobalPassword, t.AllowIpList, t.DenyIpList = n.BypassGlobalPassword, n.AllowIpList, n.DenyIpList
+	file.GetDb().UpdateTask(t)
+	if running {
+		server.StartTask(t.Id)
+	}
+	s.audit(audit.ActionUpdate, audit.ObjectTunnel, t.Id, before, audit.Capture(t))
+	s.reply(http.StatusOK, toApiTunnel(t))
+}
+
+func (s *ApiController) DeleteTunnel() {
+	t := s.getTunnel()
+	before := audit.Capture(t)
+	if err := server.DelTask(t.Id); err != nil {
+		s.fail(http.StatusInternalServerError, err.Error(), nil)
+	}
+	s.audit(audit.ActionDelete, audit.ObjectTunnel, t.Id, before, nil)
+	s.reply(http.StatusNoContent, nil)
+}
+
+func (s *ApiController) StartTunnel() {
+	t := s.getTunnel()
+	if _, ok := server.RunList.Load(t.Id); !ok {
+		if err := server.StartTask(t.Id); err != nil {
+			s.fail(http.StatusInternalServerError, err.Error(), nil)
+		}
+		s.audit(audit.ActionStart, audit.ObjectTunnel, t.Id, nil, nil)
+	}
+	s.reply(http.StatusOK, toApiTunnel(t))
+}
+
+func (s *ApiController) StopTunnel() {
+	t := s.getTunnel()
+	if _, ok := server.RunList.Load(t.Id); ok {
+		if err := server.StopServer(t.Id); err != nil {
+			s.fail(http.StatusInternalServerError, err.Error(), nil)
+		}
+		s.audit(audit.ActionStop, audit.ObjectTunnel, t.Id, nil, nil)
+	}
+	s.reply(http.StatusOK, toApiTunnel(t))
+}
+
+// ---------------- hosts ----------------
+
+type apiHost struct {
+	Id                   int              `json:"id"`
+	ClientId             int              `json:"client_id"`
+	Host                 string           `json:"host"`
+	Scheme               string           `json:"scheme"`
+	Location             string           `json:"location"`
+	Target               string           `json:"target"`
+	Balance              string           `json:"balance"`
+	TargetConns          map[string]int64 `json:"target_conns"`
+	Ejected              []*file.Ejection `json:"ejected"`
+	LocalProxy           bool             `json:"local_proxy"`
+	HeaderChange         string           `json:"header"`
+	Routes               string           `json:"routes"`
+	HeaderRules          string           `json:"header_rules"`
+	TargetProto          string           `json:"target_proto"`
+	HostChange           string           `json:"host_change"`
+	Remark               string           `json:"remark"`
+	CertFile             string           `json:"cert_file"`
+	KeyFile              string           `json:"key_file"`
+	AutoHttps            bool             `json:"auto_https"`
+	AutoCert             bool             `json:"auto_cert"`
+	CertStatus           string           `json:"cert_status"`
+	CertExpire           int64            `json:"cert_expire"`
+	BypassGlobalPassword bool             `json:"bypass_global_password"`
+	AllowIpList          []string         `json:"allow_ip_list"`
+	DenyIpList           []string         `json:"deny_ip_list"`
+	InletFlow            int64            `json:"inlet_flow"`
+	ExportFlow           int64            `json:"export_flow"`
+}
+
+type apiHostInput struct {
+	ClientId             *int      `json:"client_id"`
+	Host                 *string   `json:"host"`
+	Scheme               *string   `json:"scheme"`
+	Location             *string   `json:"location"`
+	Target               *string   `json:"target"`
+	Balance              *string   `json:"balance"`
+	LocalProxy           *bool     `json:"local_proxy"`
+	HeaderChange         *string   `json:"header"`
+	Routes               *string   `json:"routes"`
+	HeaderRules          *string   `json:"header_rules"`
+	TargetProto          *string   `json:"target_proto"`
+	HostChange           *string   `json:"host_change"`
+	Remark               *string   `json:"remark"`
+	CertFile             *string   `json:"cert_file"`
+	KeyFile              *string   `json:"key_file"`
+	AutoHttps            *bool     `json:"auto_https"`
+	AutoCert             *bool     `json:"auto_cert"`
+	BypassGlobalPassword *bool     `json:"bypass_global_password"`
+	AllowIpList          *[]string `json:"allow_ip_list"`
+	DenyIpList           *[]string `json:"deny_ip_list"`
+}
+
+func toApiHost(h *file.Host) *apiHost {
+	v := &apiHost{Id: h.Id, ClientId: h.Client.Id, Host: h.Host, Scheme: h.Scheme, Location: h.Location,
+		HeaderChange: h.HeaderChange, Routes: h.Routes, HeaderRules: h.HeaderRules, TargetProto: h.TargetProto, HostChange: h.HostChange, Remark: h.Remark, CertFile: h.CertFilePath,
+		KeyFile: h.KeyFilePath, AutoHttps: h.AutoHttps, AutoCert: h.AutoCert, CertStatus: h.CertStatus,
+		CertExpire: h.CertExpire, BypassGlobalPassword: h.BypassGlobalPassword,
+		AllowIpList: append(make([]string, 0), h.AllowIpList...), DenyIpList: append(make([]string, 0), h.DenyIpList...)}
+	if h.Target != nil {
+		v.Target, v.Balance, v.TargetConns, v.LocalProxy = h.Target.TargetStr, h.Target.Balance, h.Target.Conns(), h.Target.LocalProxy
+		v.Ejected = h.Target.Ejections()
+	}
+	if h.Flow != nil {
+		v.InletFlow, v.ExportFlow = h.Flow.InletFlow, h.Flow.ExportFlow
+	}
+	return v
+}
+
+func (in *apiHostInput) apply(h *file.Host) {
+	setString(&h.Host, in.Host)
+	setString(&h.Scheme, in.Scheme)
+	setString(&h.Location, in.Location)
+	if h.Target == nil {
+		h.Target = new(file.Target)
+	}
+	if in.Target != nil {
+		h.Target = &file.Target{TargetStr: *in.Target, Balance: h.Target.Balance, LocalProxy: h.Target.LocalProxy}
+	}
+	setString(&h.Target.Balance, in.Balance)
+	setBool(&h.Target.LocalProxy, in.LocalProxy)
+	setString(&h.HeaderChange, in.HeaderChange)
+	setString(&h.Routes, in.Routes)
+	setString(&h.HeaderRules, in.HeaderRules)
+	setString(&h.TargetProto, in.TargetProto)
+	setString(&h.HostChange, in.HostChange)
+	setString(&h.Remark, in.Remark)
+	setString(&h.CertFilePath, in.CertFile)
+	setString(&h.KeyFilePath, in.KeyFile)
+	setBool(&h.AutoHttps, in.AutoHttps)
+	setBool(&h.AutoCert, in.AutoCert)
+	setBool(&h.BypassGlobalPassword, in.BypassGlobalPassword)
+	setIpList(&h.AllowIpList, in.AllowIpList)
+	setIpList(&h.DenyIpList, in.DenyIpList)
+	if h.Client != nil && h.Client.Id == common.LOCALHOST_CLIENT_ID {
+		h.Target.LocalProxy = true
+	}
+	if h.Location == "" {
+		h.Location = "/"
+	}
+}
+
+func (s *ApiController) validateHost(h *file.Host) {
+	f := make(fieldErrors)
+	f.check(h.Client != nil, "client_id", "client not found")
+	f.check(h.Host != "", "host", "required")
+	f.check(h.Target.TargetStr != "", "target", "required")
+	checkTarget(f, h.Target)
+	if _, err := file.ParseRoutes(h.Routes, h.Target); err != nil {
+		f.check(false, "routes", err.Error())
+	}
+	if _, err := file.ParseHeaderRules(h.HeaderRules); err != nil {
+		f.check(false, "header_rules", err.Error())
+	}
+	if err := file.CheckTargetProto(h.TargetProto); err != nil {
+		f.check(false, "target_proto", err.Error())
+	}
+	checkIpList(f, "allow_ip_list", h.AllowIpList)
+	checkIpList(f, "deny_ip_list", h.DenyIpList)
+	f.check(common.InStrArr([]string{"all", "http", "https"}, h.Scheme), "scheme", "must be one of all, http, https")
+	f.check(strings.HasPrefix(h.Location, "/"), "location", "must start with /")
+	f.check((h.CertFilePath == "") == (h.KeyFilePath == ""), "key_file", "cert_file and key_file must be set together")
+	if err := proxy.CheckAutoCert(h); err != nil {
+		f.check(false, "auto_cert", err.Error())
+	}
+	s.validate(f)
+	if file.GetDb().IsHostExist(h) {
+		s.fail(http.StatusConflict, "validation failed", fieldErrors{"host": "host has exist"})
+	}
+}
+
+func (s *ApiController) getHost() *file.Host {
+	h, err := file.GetDb().GetHostById(s.id())
+	if err != nil || h.NoStore {
+		s.fail(http.StatusNotFound, "host not found", nil)
+	}
+	return h
+}
+
+func (s *ApiController) ListHosts() {
+	offset, limit := s.page()
+	clientId, _ := strconv.Atoi(s.Ctx.Input.Query("client_id"))
+	list, cnt := file.GetDb().GetHost(offset, limit, clientId, s.Ctx.Input.Query("search"), nil)
+	items := make([]*apiHost, 0, len(list))
+	for _, h := range list {
+		items = append(items, toApiHost(h))
+	}
+	s.reply(http.StatusOK, &apiList{Total: cnt, Items: items})
+}
+
+func (s *ApiController) GetHost() {
+	s.reply(http.StatusOK, toApiHost(s.getHost()))
+}
+
+func (s *ApiController) CreateHost() {
+	in := new(apiHostInput)
+	s.decode(in)
+	if in.ClientId == nil {
+		s.validate(fieldErrors{"client_id": "required"})
+	}
+	h := &file.Host{Scheme: "all", Flow: &file.Flow{}, Target: &file.Target{}}
+	h.Client, _ = getClientOrCreateLocalhost(*in.ClientId)
+	in.apply(h)
+	s.validateHost(h)
+	if h.Client.MaxTunnelNum != 0 && h.Client.GetTunnelNum() >= h.Client.MaxTunnelNum {
+		s.fail(http.StatusConflict, "the number of tunnels exceeds the limit", nil)
+	}
+	if h.AutoCert {
+		h.CertStatus = proxy.CertPending
+	}
+	h.Id = int(file.GetDb().JsonDb.GetHostId())
+	if err := file.GetDb().NewHost(h); err != nil {
+		s.fail(http.StatusConflict, err.Error(), nil)
+	}
+	s.audit(audit.ActionCreate, audit.ObjectHost, h.Id, nil, audit.Capture(h))
+	proxy.RequestCert(h)
+	s.reply(http.StatusCreated, toApiHost(h))
+}
+
+func (s *ApiController) UpdateHost() {
+	h := s.getHost()
+	in := new(apiHostInput)
+	s.decode(in)
+	n := &file.Host{Id: h.Id, Client: h.Client, Host: h.Host, Scheme: h.Scheme, Location: h.Location,
+		Target:       &file.Target{TargetStr: h.Target.TargetStr, Balance: h.Target.Balance, LocalProxy: h.Target.LocalProxy},
+		HeaderChange: h.HeaderChange, Routes: h.Routes, HeaderRules: h.HeaderRules, TargetProto: h.TargetProto, HostChange: h.HostChange, Remark: h.Remark, CertFilePath: h.CertFilePath,
+		KeyFilePath: h.KeyFilePath, AutoHttps: h.AutoHttps, AutoCert: h.AutoCert, BypassGlobalPassword: h.BypassGlobalPassword,
+		Acl: file.Acl{AllowIpList: h.AllowIpList, DenyIpList: h.DenyIpList}}
+	if in.ClientId != nil {
+		n.Client, _ = getClientOrCreateLocalhost(*in.ClientId)
+	}
+	in.apply(n)
+	s.validateHost(n)
+	before := audit.Capture(h)
+	if n.AutoCert && !h.AutoCert {
+		h.CertStatus = proxy.CertPending
+	}
+	h.Lock()
+	h.Client, h.Host, h.Scheme, h.Location, h.Target = n.Client, n.Host, n.Scheme, n.Location, n.Target
+	h.HeaderChange, h.Routes, h.HeaderRules, h.HostChange, h.Remark = n.HeaderChange, n.Routes, n.HeaderRules, n.HostChange, n.Remark
+	h.CertFilePath, h.KeyFilePath, h.AutoHttps, h.AutoCert = n.CertFilePath, n.KeyFilePath, n.AutoHttps, n.AutoCert
+	h.BypassGlobalPassword, h.TargetProto = n.BypassGlobalPassword, n.TargetProto
+	h.AllowIpList, h.DenyIpList = n.AllowIpList, n.DenyIpList
+	h.Unlock()
+	file.GetDb().JsonDb.StoreHostToJsonFile()
+	s.audit(audit.ActionUpdate, audit.ObjectHost, h.Id, before, audit.Capture(h))
+	proxy.InvalidateCert(h.Id)
+	proxy.RequestCert(h)
+	s.reply(http.StatusOK, toApiHost(h))
+}
+
+func (s *ApiController) DeleteHost() {
+	h := s.getHost()
+	before := audit.Capture(h)
+	if err := file.GetDb().DelHost(h.Id); err != nil {
+		s.fail(http.StatusInternalServerError, err.Error(), nil)
+	}
+	s.audit(audit.ActionDelete, audit.ObjectHost, h.Id, before, nil)
+	proxy.InvalidateCert(h.Id)
+	s.reply(http.StatusNoContent, nil)
+}
+
+// ---------------- global ----------------
+
+type apiGlobal struct {
+	BlackIpList       []string `json:"black_ip_list"`
+	WhiteIpList       []string `json:"white_ip_list"`
+	GlobalPasswordSet bool     `json:"global_password_set"`
+}
+
+type apiGlobalInput struct {
+	BlackIpList    *[]string `json:"black_ip_list"`
+	WhiteIpList    *[]string `json:"white_ip_list"`
+	GlobalPassword *string   `json:"global_password"`
+}
+
+func toApiGlobal(g *file.Glob) *apiGlobal {
+	v := &apiGlobal{BlackIpList: make([]string, 0), WhiteIpList: make([]string, 0)}
+	if g != nil {
+		v.BlackIpList = append(v.BlackIpList, g.BlackIpList...)
+		v.WhiteIpList = append(v.WhiteIpList, g.WhiteIpList...)
+		v.GlobalPasswordSet = g.GlobalPassword != ""
+	}
+	return v
+}
+
+func (s *ApiController) GetGlobal() {
+	s.reply(http.StatusOK, toApiGlobal(file.GetDb().GetGlobal()))
+}
+
+func (s *ApiController) UpdateGlobal() {
+	in := new(apiGlobalInput)
+	s.decode(in)
+	f := fieldErrors{}
+	if in.BlackIpList != nil {
+		checkIpList(f, "black_ip_list", *in.BlackIpList)
+	}
+	if in.WhiteIpList != nil {
+		checkIpList(f, "white_ip_list", *in.WhiteIpList)
+	}
+	s.validate(f)
+	g := new(file.Glob)
+	old := file.GetDb().GetGlobal()
+	if old != nil {
+		*g = *old
+	}
+	if in.BlackIpList != nil {
+		g.BlackIpList = RemoveRepeatedElement(*in.BlackIpList)
+	}
+	if in.WhiteIpList != nil {
+		g.WhiteIpList = RemoveRepeatedElement(*in.WhiteIpList)
+	}
+	setString(&g.GlobalPassword, in.GlobalPassword)
+	if err := file.GetDb().SaveGlobal(g); err != nil {
+		s.fail(http.StatusInternalServerError, err.Error(), nil)
+	}
+	s.audit(audit.ActionUpdate, audit.ObjectGlobal, 0, audit.Capture(old), audit.Capture(g))
+	s.reply(http.StatusOK, toApiGlobal(g))
+}
+
+// ---------------- tokens ----------------
+
+type apiToken struct {
+	Id           int      `json:"id"`
+	Name         string   `json:"name"`
+	Hint         string   `json:"hint"`
+	Scopes       []string `json:"scopes"`
+	ExpireTime   int64    `json:"expire_time"`
+	CreateTime   string   `json:"create_time"`
+	LastUsedTime int64    `json:"last_used_time"`
+	Token        string   `json:"token,omitempty"`
+}
+
+type apiTokenInput struct {
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	ExpireTime int64    `json:"expire_time"`
+}
+
+func toApiToken(t *file.ApiToken) *apiToken {
+	return &apiToken{Id: t.Id, Name: t.Name, Hint: t.Hint, Scopes: t.Scopes, ExpireTime: t.ExpireTime,
+		CreateTime: t.CreateTime, LastUsedTime: t.LastUsedTime}
+}
+
+// checkTokenInput 校验新令牌，web 控制台创建令牌时也使用
+func checkTokenInput(in *apiTokenInput) fieldErrors {
+	f := make(fieldErrors)
+	f.check(in.Name != "", "name", "required")
+	f.check(len(in.Scopes) > 0, "scopes", "required")
+	for _, scope := range in.Scopes {
+		f.check(file.ValidApiScope(scope), "scopes", "invalid scope "+scope)
+	}
+	f.check(in.ExpireTime == 0 || in.ExpireTime > time.Now().Unix(), "expire_time", "must be in the future")
+	return f
+}
+
+func (s *ApiController) ListTokens() {
+	items := make([]*apiToken, 0)
+	for _, t := range file.GetDb().GetApiTokens() {
+		items = append(items, toApiToken(t))
+	}
+	s.reply(http.StatusOK, &apiList{Total: len(items), Items: items})
+}
+
+func (s *ApiController) CreateToken() {
+	in := new(apiTokenInput)
+	s.decode(in)
+	s.validate(checkTokenInput(in))
+	for _, scope := range in.Scopes {
+		if !s.token.Covers(scope) {
+			s.fail(http.StatusForbidden, "the token can not grant scopes it does not hold", map[string]string{"scopes": "scope " + scope + " is not held by the current token"})
+		}
+	}
+	t := &file.ApiToken{Name: in.Name, Scopes: in.Scopes, ExpireTime: in.ExpireTime}
+	token, err := file.GetDb().NewApiToken(t)
+	if err != nil {
+		s.fail(http.StatusInternalServerError, err.Error(), nil)
+	}
+	s.audit(audit.ActionCreate, audit.ObjectToken, t.Id, nil, audit.Capture(t))
+	v := toApiToken(t)
+	v.Token = token
+	s.reply(http.StatusCreated, v)
+}
+
+func (s *ApiController) DeleteToken() {
+	id := s.id()
+	var before map[string]interface{}
+	if t, err := file.GetDb().GetApiTokenById(id); err == nil {
+		before = audit.Capture(t)
+	}
+	if err := file.GetDb().DelApiToken(id); err != nil {
+		s.fail(http.StatusNotFound, err.Error(), nil)
+	}
+	s.audit(audit.ActionDelete, audit.ObjectToken, id, before, nil)
+	s.reply(http.StatusNoContent, nil)
+}
+
+// ---------------- bans ----------------
+
+func (s *ApiController) ListBans() {
+	list := ban.List()
+	s.reply(http.StatusOK, &apiList{Total: len(list), Items: list})
+}
+
+func (s *ApiController) DeleteBan() {
+	b := ban.Unban(s.Ctx.Input.Param(":ip"))
+	if b == nil {
+		s.fail(http.StatusNotFound, "the ip is not banned", nil)
+	}
+	s.audit(audit.ActionDelete, audit.ObjectBan, 0, audit.Capture(b), nil)
+	s.reply(http.StatusNoContent, nil)
+}
+
+// ---------------- audit ----------------
+
+// auditQuery 读取审计日志的查询条件，web 控制台也使用
+func auditQuery(c *beego.Controller) (*audit.Query, fieldErrors) {
+	f := make(fieldErrors)
+	q := &audit.Query{
+		Actor:  c.GetString("actor"),
+		Ip:     c.GetString("ip"),
+		Action: c.GetString("action"),
+		Object: c.GetString("object"),
+		Search: c.GetString("search"),
+	}
+	if v := c.GetString("object_id"); v != "" {
+		var err error
+		q.ObjectId, err = strconv.Atoi(v)
+		f.check(err == nil, "object_id", "must be an integer")
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := c.GetString(name); v != "" {
+			var err error
+			*t, err = time.Parse(time.RFC3339, v)
+			f.check(err == nil, name, "must be an RFC 3339 time")
+		}
+	}
+	return q, f
+}
+
+func (s *ApiController) ListAudit() {
+	q, f := auditQuery(&s.Controller)
+	s.validate(f)
+	offset, limit := s.page()
+	list, total, err := audit.Search(q, offset, limit)
+	if err != nil {
+		s.fail(http.StatusInternalServerError, err.Error(), nil)
+	}
+	s.reply(http.StatusOK, &apiList{Total: total, Items: list})
+}
+
+// VerifyAudit 检查审计日志的 hash 链，broken_seq 为第一条被篡改的记录
+func (s *ApiController) VerifyAudit() {
+	seq, err := audit.Verify()
+	if err != nil {
+		s.fail(http.StatusInternalServerError, err.Error(), nil)
+	}
+	s.reply(http.StatusOK, map[string]interface{}{"intact": seq == 0, "broken_seq": seq})
+}
+
+// OpenApi 返回接口的 OpenAPI 文档，不需要令牌
+func (s *ApiController) OpenApi() {
+	s.Ctx.Output.Header("Content-Type", "application/json; charset=utf-8")
+	s.Ctx.Output.Body([]byte(strings.Replace(openApiDoc, "{{base_url}}", beego.AppConfig.String("web_base_url"), 1)))
+}
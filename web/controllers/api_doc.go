@@ -0,0 +1,1945 @@
+package controllers
+
+// openApiDoc 是 /api/v1 的 OpenAPI 文档，{{base_url}} 替换为 web_base_url
+const openApiDoc = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "nps api",
+    "version": "v1"
+  },
+  "servers": [
+    {
+      "url": "{{base_url}}/api/v1"
+    }
+  ],
+  "security": [
+    {
+      "bearer": []
+    }
+  ],
+  "paths": {
+    "/clients": {
+      "get": {
+        "tags": [
+          "clients"
+        ],
+        "summary": "List clients",
+        "parameters": [
+          {
+            "name": "offset",
+            "in": "query",
+            "schema": {
+              "type": "integer",
+              "default": 0
+            }
+          },
+          {
+            "name": "limit",
+            "in": "query",
+            "schema": {
+              "type": "integer",
+              "default": 100
+            }
+          },
+          {
+            "name": "search",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "total": {
+                      "type": "integer"
+                    },
+                    "items": {
+                      "type": "array",
+                      "items": {
+                        "$ref": "#/components/schemas/Client"
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "clients"
+        ],
+        "summary": "Create a client",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/ClientInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "created",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Client"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          },
+          "422": {
+            "$ref": "#/components/responses/ValidationFailed"
+          }
+        }
+      }
+    },
+    "/clients/{id}": {
+      "parameters": [
+        {
+          "name": "id",
+          "in": "path",
+          "required": true,
+          "schema": {
+            "type": "integer"
+          }
+        }
+      ],
+      "get": {
+        "tags": [
+          "clients"
+        ],
+        "summary": "Get a client",
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Client"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "clients"
+        ],
+        "summary": "Update a client, omitted fields are unchanged",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/ClientInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Client"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          },
+          "422": {
+            "$ref": "#/components/responses/ValidationFailed"
+          }
+        }
+      },
+      "delete": {
+        "tags": [
+          "clients"
+        ],
+        "summary": "Delete a client",
+        "responses": {
+          "204": {
+            "description": "deleted"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/tunnels": {
+      "get": {
+        "tags": [
+          "tunnels"
+        ],
+        "summary": "List tunnels",
+        "parameters": [
+          {
+            "name": "offset",
+            "in": "query",
+            "schema": {
+              "type": "integer",
+              "default": 0
+            }
+          },
+          {
+            "name": "limit",
+            "in": "query",
+            "schema": {
+              "type": "integer",
+              "default": 100
+            }
+          },
+          {
+            "name": "search",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "type",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "client_id",
+            "in": "query",
+            "schema": {
+              "type": "integer"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "total": {
+                      "type": "integer"
+                    },
+                    "items": {
+                      "type": "array",
+                      "items": {
+                        "$ref": "#/components/schemas/Tunnel"
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "tunnels"
+        ],
+        "summary": "Create a tunnel",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/TunnelInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "created",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Tunnel"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          },
+          "422": {
+            "$ref": "#/components/responses/ValidationFailed"
+          }
+        }
+      }
+    },
+    "/tunnels/{id}": {
+      "parameters": [
+        {
+          "name": "id",
+          "in": "path",
+          "required": true,
+          "schema": {
+            "type": "integer"
+          }
+        }
+      ],
+      "get": {
+        "tags": [
+          "tunnels"
+        ],
+        "summary": "Get a tunnel",
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Tunnel"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "tunnels"
+        ],
+        "summary": "Update a tunnel, omitted fields are unchanged",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/TunnelInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Tunnel"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          },
+          "422": {
+            "$ref": "#/components/responses/ValidationFailed"
+          }
+        }
+      },
+      "delete": {
+        "tags": [
+          "tunnels"
+        ],
+        "summary": "Delete a tunnel",
+        "responses": {
+          "204": {
+            "description": "deleted"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/hosts": {
+      "get": {
+        "tags": [
+          "hosts"
+        ],
+        "summary": "List hosts",
+        "parameters": [
+          {
+            "name": "offset",
+            "in": "query",
+            "schema": {
+              "type": "integer",
+              "default": 0
+            }
+          },
+          {
+            "name": "limit",
+            "in": "query",
+            "schema": {
+              "type": "integer",
+              "default": 100
+            }
+          },
+          {
+            "name": "search",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "client_id",
+            "in": "query",
+            "schema": {
+              "type": "integer"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "total": {
+                      "type": "integer"
+                    },
+                    "items": {
+                      "type": "array",
+                      "items": {
+                        "$ref": "#/components/schemas/Host"
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "hosts"
+        ],
+        "summary": "Create a host",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/HostInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "created",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Host"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          },
+          "422": {
+            "$ref": "#/components/responses/ValidationFailed"
+          }
+        }
+      }
+    },
+    "/hosts/{id}": {
+      "parameters": [
+        {
+          "name": "id",
+          "in": "path",
+          "required": true,
+          "schema": {
+            "type": "integer"
+          }
+        }
+      ],
+      "get": {
+        "tags": [
+          "hosts"
+        ],
+        "summary": "Get a host",
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Host"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "hosts"
+        ],
+        "summary": "Update a host, omitted fields are unchanged",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/HostInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Host"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          },
+          "422": {
+            "$ref": "#/components/responses/ValidationFailed"
+          }
+        }
+      },
+      "delete": {
+        "tags": [
+          "hosts"
+        ],
+        "summary": "Delete a host",
+        "responses": {
+          "204": {
+            "description": "deleted"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/tunnels/{id}/start": {
+      "parameters": [
+        {
+          "name": "id",
+          "in": "path",
+          "required": true,
+          "schema": {
+            "type": "integer"
+          }
+        }
+      ],
+      "post": {
+        "tags": [
+          "tunnels"
+        ],
+        "summary": "Start a tunnel",
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Tunnel"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/tunnels/{id}/stop": {
+      "parameters": [
+        {
+          "name": "id",
+          "in": "path",
+          "required": true,
+          "schema": {
+            "type": "integer"
+          }
+        }
+      ],
+      "post": {
+        "tags": [
+          "tunnels"
+        ],
+        "summary": "Stop a tunnel",
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Tunnel"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/global": {
+      "get": {
+        "tags": [
+          "global"
+        ],
+        "summary": "Get global settings",
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Global"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "global"
+        ],
+        "summary": "Update global settings, omitted fields are unchanged",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/GlobalInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Global"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      }
+    },
+    "/tokens": {
+      "get": {
+        "tags": [
+          "tokens"
+        ],
+        "summary": "List api tokens",
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "total": {
+                      "type": "integer"
+                    },
+                    "items": {
+                      "type": "array",
+                      "items": {
+                        "$ref": "#/components/schemas/Token"
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "tokens"
+        ],
+        "summary": "Create an api token, the token is only returned once. The new scopes must be held by the calling token, otherwise 403 with a field error on scopes",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/TokenInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "created",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Token"
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "422": {
+            "$ref": "#/components/responses/ValidationFailed"
+          }
+        }
+      }
+    },
+    "/tokens/{id}": {
+      "parameters": [
+        {
+          "name": "id",
+          "in": "path",
+          "required": true,
+          "schema": {
+            "type": "integer"
+          }
+        }
+      ],
+      "delete": {
+        "tags": [
+          "tokens"
+        ],
+        "summary": "Delete an api token",
+        "responses": {
+          "204": {
+            "description": "deleted"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/bans": {
+      "get": {
+        "tags": [
+          "bans"
+        ],
+        "summary": "List source ips temporarily banned after repeated authentication failures",
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "total": {
+                      "type": "integer"
+                    },
+                    "items": {
+                      "type": "array",
+                      "items": {
+                        "$ref": "#/components/schemas/Ban"
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      }
+    },
+    "/bans/{ip}": {
+      "parameters": [
+        {
+          "name": "ip",
+          "in": "path",
+          "required": true,
+          "schema": {
+            "type": "string"
+          }
+        }
+      ],
+      "delete": {
+        "tags": [
+          "bans"
+        ],
+        "summary": "Lift a ban and reset the failure count of the ip",
+        "responses": {
+          "204": {
+            "description": "unbanned"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/audit": {
+      "get": {
+        "tags": [
+          "audit"
+        ],
+        "summary": "Search the audit log of configuration changes, newest first",
+        "parameters": [
+          {
+            "name": "offset",
+            "in": "query",
+            "schema": {
+              "type": "integer",
+              "default": 0
+            }
+          },
+          {
+            "name": "limit",
+            "in": "query",
+            "schema": {
+              "type": "integer",
+              "default": 100
+            }
+          },
+          {
+            "name": "actor",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            },
+            "description": "e.g. admin:admin, user:alice, token:deploy"
+          },
+          {
+            "name": "ip",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "action",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            },
+            "description": "create, update, delete, start or stop"
+          },
+          {
+            "name": "object",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            },
+            "description": "tunnel, host, client, global, user, token, account or ban"
+          },
+          {
+            "name": "object_id",
+            "in": "query",
+            "schema": {
+              "type": "integer"
+            }
+          },
+          {
+            "name": "search",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            },
+            "description": "matched against changed field names and values"
+          },
+          {
+            "name": "since",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            },
+            "description": "RFC 3339 time"
+          },
+          {
+            "name": "until",
+            "in": "query",
+            "schema": {
+              "type": "string"
+            },
+            "description": "RFC 3339 time"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "total": {
+                      "type": "integer"
+                    },
+                    "items": {
+                      "type": "array",
+                      "items": {
+                        "$ref": "#/components/schemas/AuditEntry"
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          },
+          "422": {
+            "$ref": "#/components/responses/ValidationFailed"
+          }
+        }
+      }
+    },
+    "/audit/verify": {
+      "get": {
+        "tags": [
+          "audit"
+        ],
+        "summary": "Check the hash chain of the audit log",
+        "responses": {
+          "200": {
+            "description": "ok",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "intact": {
+                      "type": "boolean"
+                    },
+                    "broken_seq": {
+                      "type": "integer",
+                      "description": "the first tampered entry, 0 when intact"
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "403": {
+            "$ref": "#/components/responses/Forbidden"
+          }
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "tags": [
+          "meta"
+        ],
+        "summary": "This document",
+        "security": [],
+        "responses": {
+          "200": {
+            "description": "OpenAPI document"
+          }
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {
+        "type": "http",
+        "scheme": "bearer"
+      }
+    },
+    "responses": {
+      "Unauthorized": {
+        "description": "missing, invalid or expired token",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "Forbidden": {
+        "description": "the token does not have the required scope",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "NotFound": {
+        "description": "not found",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "Conflict": {
+        "description": "conflict, such as an occupied port or a duplicate host",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      },
+      "ValidationFailed": {
+        "description": "validation failed",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/Error"
+            }
+          }
+        }
+      }
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {
+            "type": "string"
+          },
+          "fields": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "string"
+            },
+            "description": "validation error of each field"
+          }
+        }
+      },
+      "Client": {
+        "type": "object",
+        "properties": {
+          "id": {
+            "type": "integer"
+          },
+          "vkey": {
+            "type": "string"
+          },
+          "remark": {
+            "type": "string"
+          },
+          "status": {
+            "type": "boolean"
+          },
+          "basic_username": {
+            "type": "string"
+          },
+          "basic_password": {
+            "type": "string"
+          },
+          "compress": {
+            "type": "boolean"
+          },
+          "crypt": {
+            "type": "boolean"
+          },
+          "config_conn_allow": {
+            "type": "boolean"
+          },
+          "rate_limit": {
+            "type": "integer",
+            "description": "KB/s, 0 is unlimited"
+          },
+          "max_conn": {
+            "type": "integer"
+          },
+          "max_tunnel": {
+            "type": "integer"
+          },
+          "flow_limit": {
+            "type": "integer",
+            "description": "MB, 0 is unlimited"
+          },
+          "web_username": {
+            "type": "string"
+          },
+          "web_password": {
+            "type": "string"
+          },
+          "black_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "online": {
+            "type": "boolean"
+          },
+          "addr": {
+            "type": "string"
+          },
+          "version": {
+            "type": "string"
+          },
+          "now_conn": {
+            "type": "integer"
+          },
+          "inlet_flow": {
+            "type": "integer"
+          },
+          "export_flow": {
+            "type": "integer"
+          },
+          "create_time": {
+            "type": "string"
+          },
+          "last_online_time": {
+            "type": "string"
+          }
+        }
+      },
+      "ClientInput": {
+        "type": "object",
+        "properties": {
+          "vkey": {
+            "type": "string"
+          },
+          "remark": {
+            "type": "string"
+          },
+          "status": {
+            "type": "boolean"
+          },
+          "basic_username": {
+            "type": "string"
+          },
+          "basic_password": {
+            "type": "string"
+          },
+          "compress": {
+            "type": "boolean"
+          },
+          "crypt": {
+            "type": "boolean"
+          },
+          "config_conn_allow": {
+            "type": "boolean"
+          },
+          "rate_limit": {
+            "type": "integer",
+            "description": "KB/s, 0 is unlimited"
+          },
+          "max_conn": {
+            "type": "integer"
+          },
+          "max_tunnel": {
+            "type": "integer"
+          },
+          "flow_limit": {
+            "type": "integer",
+            "description": "MB, 0 is unlimited"
+          },
+          "web_username": {
+            "type": "string"
+          },
+          "web_password": {
+            "type": "string"
+          },
+          "black_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "one entry per line: ip, cidr (10.0.0.0/8, 2001:db8::/32), range (1.2.3.4-1.2.3.90), country:CN,HK or asn:13335 (prefix ! to match other countries or asns, needs the geoip database), optional expires=2006-01-02 and # comment"
+          }
+        }
+      },
+      "Tunnel": {
+        "type": "object",
+        "properties": {
+          "id": {
+            "type": "integer"
+          },
+          "client_id": {
+            "type": "integer"
+          },
+          "type": {
+            "type": "string",
+            "enum": [
+              "tcp",
+              "udp",
+              "socks5",
+              "httpProxy",
+              "secret",
+              "p2p",
+              "file"
+            ]
+          },
+          "port": {
+            "type": "integer",
+            "description": "0 picks a free port"
+          },
+          "server_ip": {
+            "type": "string"
+          },
+          "target": {
+            "type": "string",
+            "description": "one target per line"
+          },
+          "balance": {
+            "type": "string",
+            "enum": [
+              "",
+              "rr",
+              "wrr",
+              "leastconn",
+              "random",
+              "iphash"
+            ],
+            "description": "load balancing strategy for multiple targets, empty means rr"
+          },
+          "target_conns": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "integer"
+            },
+            "description": "in-flight connections of each target"
+          },
+          "ejected": {
+            "type": "array",
+            "items": {
+              "$ref": "#/components/schemas/Ejection"
+            },
+            "description": "targets temporarily removed after consecutive failures"
+          },
+          "local_proxy": {
+            "type": "boolean"
+          },
+          "password": {
+            "type": "string"
+          },
+          "local_path": {
+            "type": "string"
+          },
+          "strip_pre": {
+            "type": "string"
+          },
+          "remark": {
+            "type": "string"
+          },
+          "bypass_global_password": {
+            "type": "boolean"
+          },
+          "allow_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "deny_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "status": {
+            "type": "boolean"
+          },
+          "running": {
+            "type": "boolean"
+          },
+          "inlet_flow": {
+            "type": "integer"
+          },
+          "export_flow": {
+            "type": "integer"
+          }
+        }
+      },
+      "TunnelInput": {
+        "type": "object",
+        "properties": {
+          "client_id": {
+            "type": "integer"
+          },
+          "type": {
+            "type": "string",
+            "enum": [
+              "tcp",
+              "udp",
+              "socks5",
+              "httpProxy",
+              "secret",
+              "p2p",
+              "file"
+            ]
+          },
+          "port": {
+            "type": "integer",
+            "description": "0 picks a free port"
+          },
+          "server_ip": {
+            "type": "string"
+          },
+          "target": {
+            "type": "string",
+            "description": "one target per line"
+          },
+          "balance": {
+            "type": "string",
+            "enum": [
+              "",
+              "rr",
+              "wrr",
+              "leastconn",
+              "random",
+              "iphash"
+            ],
+            "description": "load balancing strategy for multiple targets, empty means rr"
+          },
+          "local_proxy": {
+            "type": "boolean"
+          },
+          "password": {
+            "type": "string"
+          },
+          "local_path": {
+            "type": "string"
+          },
+          "strip_pre": {
+            "type": "string"
+          },
+          "remark": {
+            "type": "string"
+          },
+          "bypass_global_password": {
+            "type": "boolean"
+          },
+          "allow_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "only these addresses may connect when not empty, same format as black_ip_list"
+          },
+          "deny_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "checked before allow_ip_list and the global white list"
+          }
+        },
+        "required": [
+          "client_id",
+          "type"
+        ]
+      },
+      "Host": {
+        "type": "object",
+        "properties": {
+          "id": {
+            "type": "integer"
+          },
+          "client_id": {
+            "type": "integer"
+          },
+          "host": {
+            "type": "string"
+          },
+          "scheme": {
+            "type": "string",
+            "enum": [
+              "all",
+              "http",
+              "https"
+            ]
+          },
+          "location": {
+            "type": "string"
+          },
+          "target": {
+            "type": "string",
+            "description": "one target per line, addr or addr@weight"
+          },
+          "balance": {
+            "type": "string",
+            "enum": [
+              "",
+              "rr",
+              "wrr",
+              "leastconn",
+              "random",
+              "iphash"
+            ],
+            "description": "load balancing strategy for multiple targets, empty means rr"
+          },
+          "target_conns": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "integer"
+            },
+            "description": "in-flight connections of each target"
+          },
+          "ejected": {
+            "type": "array",
+            "items": {
+              "$ref": "#/components/schemas/Ejection"
+            },
+            "description": "targets temporarily removed after consecutive failures"
+          },
+          "local_proxy": {
+            "type": "boolean"
+          },
+          "header": {
+            "type": "string"
+          },
+          "routes": {
+            "type": "string",
+            "description": "route table, one route per line: match path [conditions] action [args], see docs/feature.md"
+          },
+          "header_rules": {
+            "type": "string",
+            "description": "request and response header rules, one per line: request|response add|set|remove|append name [value], see docs/feature.md"
+          },
+          "target_proto": {
+            "type": "string",
+            "enum": [
+              "",
+              "h2c",
+              "h2"
+            ],
+            "description": "protocol to the target: empty for http/1.1, h2c or h2 (tls, certificate not verified); grpc needs h2c or h2"
+          },
+          "host_change": {
+            "type": "string"
+          },
+          "remark": {
+            "type": "string"
+          },
+          "cert_file": {
+            "type": "string",
+            "description": "pem content or file path"
+          },
+          "key_file": {
+            "type": "string",
+            "description": "pem content or file path"
+          },
+          "auto_https": {
+            "type": "boolean"
+          },
+          "auto_cert": {
+            "type": "boolean"
+          },
+          "bypass_global_password": {
+            "type": "boolean"
+          },
+          "allow_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "deny_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "cert_status": {
+            "type": "string"
+          },
+          "cert_expire": {
+            "type": "integer"
+          },
+          "inlet_flow": {
+            "type": "integer"
+          },
+          "export_flow": {
+            "type": "integer"
+          }
+        }
+      },
+      "HostInput": {
+        "type": "object",
+        "properties": {
+          "client_id": {
+            "type": "integer"
+          },
+          "host": {
+            "type": "string"
+          },
+          "scheme": {
+            "type": "string",
+            "enum": [
+              "all",
+              "http",
+              "https"
+            ]
+          },
+          "location": {
+            "type": "string"
+          },
+          "target": {
+            "type": "string",
+            "description": "one target per line, addr or addr@weight"
+          },
+          "balance": {
+            "type": "string",
+            "enum": [
+              "",
+              "rr",
+              "wrr",
+              "leastconn",
+              "random",
+              "iphash"
+            ],
+            "description": "load balancing strategy for multiple targets, empty means rr"
+          },
+          "local_proxy": {
+            "type": "boolean"
+          },
+          "header": {
+            "type": "string"
+          },
+          "routes": {
+            "type": "string",
+            "description": "route table, one route per line: match path [conditions] action [args], see docs/feature.md"
+          },
+          "header_rules": {
+            "type": "string",
+            "description": "request and response header rules, one per line: request|response add|set|remove|append name [value], see docs/feature.md"
+          },
+          "target_proto": {
+            "type": "string",
+            "enum": [
+              "",
+              "h2c",
+              "h2"
+            ],
+            "description": "protocol to the target: empty for http/1.1, h2c or h2 (tls, certificate not verified); grpc needs h2c or h2"
+          },
+          "host_change": {
+            "type": "string"
+          },
+          "remark": {
+            "type": "string"
+          },
+          "cert_file": {
+            "type": "string",
+            "description": "pem content or file path"
+          },
+          "key_file": {
+            "type": "string",
+            "description": "pem content or file path"
+          },
+          "auto_https": {
+            "type": "boolean"
+          },
+          "auto_cert": {
+            "type": "boolean"
+          },
+          "bypass_global_password": {
+            "type": "boolean"
+          },
+          "allow_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "only these addresses may connect when not empty, same format as black_ip_list"
+          },
+          "deny_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "checked before allow_ip_list and the global white list"
+          }
+        },
+        "required": [
+          "client_id",
+          "host",
+          "target"
+        ]
+      },
+      "Global": {
+        "type": "object",
+        "properties": {
+          "black_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "white_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "global_password_set": {
+            "type": "boolean"
+          }
+        }
+      },
+      "GlobalInput": {
+        "type": "object",
+        "properties": {
+          "black_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "one entry per line: ip, cidr (10.0.0.0/8, 2001:db8::/32), range (1.2.3.4-1.2.3.90), country:CN,HK or asn:13335 (prefix ! to match other countries or asns, needs the geoip database), optional expires=2006-01-02 and # comment"
+          },
+          "white_ip_list": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "one entry per line: ip, cidr (10.0.0.0/8, 2001:db8::/32), range (1.2.3.4-1.2.3.90), country:CN,HK or asn:13335 (prefix ! to match other countries or asns, needs the geoip database), optional expires=2006-01-02 and # comment"
+          },
+          "global_password": {
+            "type": "string"
+          }
+        }
+      },
+      "Token": {
+        "type": "object",
+        "properties": {
+          "id": {
+            "type": "integer"
+          },
+          "name": {
+            "type": "string"
+          },
+          "hint": {
+            "type": "string"
+          },
+          "scopes": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "expire_time": {
+            "type": "integer",
+            "description": "unix time, 0 never expires"
+          },
+          "create_time": {
+            "type": "string"
+          },
+          "last_used_time": {
+            "type": "integer"
+          },
+          "token": {
+            "type": "string",
+            "description": "only returned when created"
+          }
+        }
+      },
+      "TokenInput": {
+        "type": "object",
+        "properties": {
+          "name": {
+            "type": "string"
+          },
+          "scopes": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "*, or <resource>:read / <resource>:write of clients, tunnels, hosts, global, tokens, audit, bans"
+          },
+          "expire_time": {
+            "type": "integer"
+          }
+        },
+        "required": [
+          "name",
+          "scopes"
+        ]
+      },
+      "Ban": {
+        "type": "object",
+        "properties": {
+          "ip": {
+            "type": "string"
+          },
+          "reason": {
+            "type": "string",
+            "description": "the last failure, login, global_password, basic_auth, socks5 or vkey"
+          },
+          "fails": {
+            "type": "integer"
+          },
+          "since": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "until": {
+            "type": "string",
+            "format": "date-time"
+          }
+        }
+      },
+      "AuditEntry": {
+        "type": "object",
+        "properties": {
+          "seq": {
+            "type": "integer"
+          },
+          "time": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "actor": {
+            "type": "string"
+          },
+          "ip": {
+            "type": "string"
+          },
+          "action": {
+            "type": "string"
+          },
+          "object": {
+            "type": "string"
+          },
+          "object_id": {
+            "type": "integer"
+          },
+          "diff": {
+            "type": "object",
+            "description": "changed fields, secrets are shown as ******",
+            "additionalProperties": {
+              "type": "object",
+              "properties": {
+                "before": {},
+                "after": {}
+              }
+            }
+          },
+          "prev": {
+            "type": "string",
+            "description": "hash of the previous entry"
+          },
+          "hash": {
+            "type": "string"
+          }
+        }
+      },
+      "Ejection": {
+        "type": "object",
+        "description": "target ejected by the passive health check",
+        "properties": {
+          "addr": {
+            "type": "string"
+          },
+          "until": {
+            "type": "integer",
+            "description": "unix time when the target is tried again"
+          },
+          "ejections": {
+            "type": "integer",
+            "description": "consecutive ejections, the eject time doubles each time"
+          }
+        }
+      }
+    }
+  }
+}
+`
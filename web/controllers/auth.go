@@ -6,9 +6,11 @@ import (
 
 	"net/url"
 
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/crypt"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/metrics"
 	"ehang.io/nps/server/proxy"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
@@ -79,6 +81,7 @@ func (s *AuthController) HandleAuth() {
 		ipCache := proxy.GetGlobalIpAuthCache() // Get the cache instance
 		ip := common.GetIpByAddr(clientIP)      // Ensure we use the IP part only
 		ipCache.Authenticate(ip)
+		metrics.Challenge(metrics.ChallengeSuccess)
 		logs.Info("Global password authentication successful for IP: %s. Redirecting to: %s", ip, returnURL)
 
 		// Redirect back to the originally requested URL
@@ -86,6 +89,8 @@ func (s *AuthController) HandleAuth() {
 	} else {
 		// Password incorrect, redirect back to auth page with an error message
 		logs.Warn("Global password authentication failed for IP: %s", clientIP)
+		metrics.Challenge(metrics.ChallengeFailure)
+		ban.Fail(clientIP, ban.ReasonGlobalPassword)
 		// Use flash messages or URL parameters to show the error
 		// Using URL parameter for simplicity here:
 		redirectURL := "/nps_global_auth?error=" + url.QueryEscape("密码错误")
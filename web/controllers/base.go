@@ -9,6 +9,7 @@ import (
 
 	"ehang.io/nps/bridge"
 
+	"ehang.io/nps/lib/audit"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/crypt"
 	"ehang.io/nps/lib/file"
@@ -20,6 +21,8 @@ type BaseController struct {
 	beego.Controller
 	controllerName string
 	actionName     string
+	user           *file.User // 通过用户表登录的用户，管理员和客户端用户为 nil
+	authKey        bool       // 通过 auth_key 访问
 }
 
 // 初始化参数
@@ -51,8 +54,12 @@ func (s *BaseController) Prepare() {
 	} else {
 		s.SetSession("isAdmin", true)
 		s.Data["isAdmin"] = true
+		s.authKey = true
 	}
-	if s.GetSession("isAdmin") != nil && !s.GetSession("isAdmin").(bool) {
+	s.Data["show_global"] = true
+	if userId, ok := s.GetSession("userId").(int); ok && s.GetSession("isAdmin") == false {
+		s.initUser(userId)
+	} else if s.GetSession("isAdmin") != nil && !s.GetSession("isAdmin").(bool) {
 		s.Ctx.Input.SetData("client_id", s.GetSession("clientId").(int))
 		s.Ctx.Input.SetParam("client_id", strconv.Itoa(s.GetSession("clientId").(int)))
 		s.Data["isAdmin"] = false
@@ -61,6 +68,7 @@ func (s *BaseController) Prepare() {
 	} else {
 		s.Data["isAdmin"] = true
 	}
+	s.Data["show_audit"] = s.user == nil && s.Data["isAdmin"] == true || s.user != nil && s.user.Can(file.PermGlobal, 0)
 	s.Data["https_just_proxy"], _ = beego.AppConfig.Bool("https_just_proxy")
 	s.Data["allow_user_login"], _ = beego.AppConfig.Bool("allow_user_login")
 	s.Data["allow_flow_limit"], _ = beego.AppConfig.Bool("allow_flow_limit")
@@ -242,3 +250,151 @@ func (s *BaseController) CheckUserAuth() {
 		}
 	}
 }
+
+// 各页面需要的权限，未列出的页面只有管理员可以访问
+var actionPermissions = map[string]string{
+	"index.index":                  file.PermView,
+	"index.help":                   file.PermView,
+	"index.tcp":                    file.PermView,
+	"index.udp":                    file.PermView,
+	"index.socks5":                 file.PermView,
+	"index.http":                   file.PermView,
+	"index.file":                   file.PermView,
+	"index.secret":                 file.PermView,
+	"index.p2p":                    file.PermView,
+	"index.host":                   file.PermView,
+	"index.all":                    file.PermView,
+	"index.gettunnel":              file.PermView,
+	"index.getonetunnel":           file.PermView,
+	"index.hostlist":               file.PermView,
+	"index.gethost":                file.PermView,
+	"index.add":                    file.PermTunnelCreate,
+	"index.addhost":                file.PermTunnelCreate,
+	"index.edit":                   file.PermTunnelEdit,
+	"index.edithost":               file.PermTunnelEdit,
+	"index.togglebypassstatus":     file.PermTunnelEdit,
+	"index.togglehostbypassstatus": file.PermTunnelEdit,
+	"index.start":                  file.PermTunnelControl,
+	"index.stop":                   file.PermTunnelControl,
+	"index.del":                    file.PermTunnelDelete,
+	"index.delhost":                file.PermTunnelDelete,
+	"client.list":                  file.PermView,
+	"client.getclient":             file.PermView,
+	"client.add":                   file.PermClientManage,
+	"client.edit":                  file.PermClientManage,
+	"client.changestatus":          file.PermClientManage,
+	"client.del":                   file.PermClientManage,
+	// 只有黑白名单权限时不能修改全局密码，见 GlobalController.Save
+	"global.index": file.PermGlobalIpList,
+	"global.save":  file.PermGlobalIpList,
+	"global.ban":   file.PermGlobalIpList,
+	"global.unban": file.PermGlobalIpList,
+	// 审计日志
+	"global.audit":       file.PermGlobal,
+	"global.auditverify": file.PermGlobal,
+	// 当前账号的设置，不需要权限
+	"account.totp":          "",
+	"account.enabletotp":    "",
+	"account.disabletotp":   "",
+	"account.recoverycodes": "",
+}
+
+var hostActions = map[string]bool{"gethost": true, "delhost": true, "edithost": true, "togglehostbypassstatus": true}
+
+func (s *BaseController) initUser(id int) {
+	u, err := file.GetDb().GetUserById(id)
+	if err != nil || !u.Status {
+		s.DestroySession()
+		s.Redirect(beego.AppConfig.String("web_base_url")+"/login/meteor", 302)
+		s.StopRun()
+	}
+	s.user = u
+	s.Data["isAdmin"] = false
+	s.Data["username"] = u.Username
+	s.Data["show_global"] = u.Can(file.PermGlobalIpList, 0)
+	s.checkPermission()
+}
+
+// checkPermission 检查用户对请求中 id、client_id 对应的客户端是否有权限
+func (s *BaseController) checkPermission() {
+	perm, ok := actionPermissions[s.controllerName+"."+s.actionName]
+	if !ok {
+		s.forbidden()
+	}
+	if perm == "" {
+		return
+	}
+	ids := make([]int, 0)
+	if id := s.GetIntNoErr("id"); id != 0 && s.controllerName != "global" {
+		switch {
+		case s.controllerName == "client":
+			ids = append(ids, id)
+		case hostActions[s.actionName]:
+			h, err := file.GetDb().GetHostById(id)
+			if err != nil {
+				s.forbidden()
+			}
+			ids = append(ids, h.Client.Id)
+		default:
+			t, err := file.GetDb().GetTask(id)
+			if err != nil {
+				s.forbidden()
+			}
+			ids = append(ids, t.Client.Id)
+		}
+	}
+	if clientId := s.GetIntNoErr("client_id"); clientId != 0 {
+		ids = append(ids, clientId)
+	}
+	if len(ids) == 0 {
+		// 不针对某个客户端的请求，列表由 allowClient 过滤
+		if perm == file.PermClientManage || strings.HasPrefix(perm, "global:") {
+			ok = s.user.Can(perm, 0)
+		} else {
+			ok = s.user.CanAny(perm)
+		}
+	}
+	for _, id := range ids {
+		if ok = s.user.Can(perm, id); !ok {
+			break
+		}
+	}
+	if !ok {
+		s.forbidden()
+	}
+}
+
+func (s *BaseController) forbidden() {
+	s.Ctx.Output.SetStatus(403)
+	s.AjaxErr("permission denied")
+}
+
+// allowClient 返回列表的客户端过滤条件，管理员和客户端用户返回 nil
+func (s *BaseController) allowClient() func(clientId int) bool {
+	if s.user == nil {
+		return nil
+	}
+	return func(clientId int) bool {
+		return s.user.Can(file.PermView, clientId)
+	}
+}
+
+// actor 返回审计日志中的操作者
+func (s *BaseController) actor() string {
+	switch {
+	case s.user != nil:
+		return "user:" + s.user.Username
+	case s.authKey:
+		return "auth_key"
+	case s.GetSession("isAdmin") == true:
+		return "admin:" + beego.AppConfig.String("web_username")
+	default:
+		name, _ := s.GetSession("username").(string)
+		return "client:" + name
+	}
+}
+
+// audit 记录一次配置修改，before、after 为 audit.Capture 的结果
+func (s *BaseController) audit(action, object string, id int, before, after map[string]interface{}) {
+	audit.Log(s.actor(), common.GetIpByAddr(s.Ctx.Request.RemoteAddr), action, object, id, before, after)
+}
@@ -1,8 +1,10 @@
 package controllers
 
 import (
+	"ehang.io/nps/lib/audit"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/iplist"
 	"ehang.io/nps/lib/rate"
 	"ehang.io/nps/server"
 	"github.com/astaxie/beego"
@@ -29,7 +31,7 @@ func (s *ClientController) List() {
 	} else {
 		clientId = clientIdSession.(int)
 	}
-	list, cnt := server.GetClientList(start, length, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"), clientId)
+	list, cnt := server.GetClientList(start, length, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"), clientId, s.allowClient())
 	cmd := make(map[string]interface{})
 	ip := s.Ctx.Request.Host
 	cmd["ip"] = common.GetIpByAddr(ip)
@@ -68,12 +70,16 @@ func (s *ClientController) Add() {
 				InletFlow:  0,
 				FlowLimit:  int64(s.GetIntNoErr("flow_limit")),
 			},
-			BlackIpList: RemoveRepeatedElement(strings.Split(s.getEscapeString("blackiplist"), "\r\n")),
+			BlackIpList: RemoveRepeatedElement(strings.Split(s.GetString("blackiplist"), "\r\n")),
 			CreateTime:  time.Now().Format("2006-01-02 15:04:05"),
 		}
+		if err := iplist.Check(t.BlackIpList); err != nil {
+			s.AjaxErr(err.Error())
+		}
 		if err := file.GetDb().NewClient(t); err != nil {
 			s.AjaxErr(err.Error())
 		}
+		s.audit(audit.ActionCreate, audit.ObjectClient, t.Id, nil, audit.Capture(t))
 		s.AjaxOkWithId("add success", id)
 	}
 }
@@ -111,8 +117,9 @@ func (s *ClientController) Edit() {
 			s.AjaxErr("client ID not found")
 			return
 		} else {
+			before := audit.Capture(c)
 			if s.getEscapeString("web_username") != "" {
-				if s.getEscapeString("web_username") == beego.AppConfig.String("web_username") || !file.GetDb().VerifyUserName(s.getEscapeString("web_username"), c.Id) {
+				if s.getEscapeString("web_username") == beego.AppConfig.String("web_username") || !file.GetDb().VerifyUserName(s.getEscapeString("web_username"), c.Id) || userExist(s.getEscapeString("web_username")) {
 					s.AjaxErr("web login username duplicate, please reset")
 					return
 				}
@@ -127,6 +134,10 @@ func (s *ClientController) Edit() {
 				c.RateLimit = s.GetIntNoErr("rate_limit")
 				c.MaxConn = s.GetIntNoErr("max_conn")
 				c.MaxTunnelNum = s.GetIntNoErr("max_tunnel")
+				// 客户端丢失身份验证器和恢复码时由管理员重置
+				if s.GetBoolNoErr("reset_totp") {
+					c.Totp = nil
+				}
 			}
 			c.Remark = s.getEscapeString("remark")
 			c.Cnf.U = s.getEscapeString("u")
@@ -150,13 +161,24 @@ func (s *ClientController) Edit() {
 				c.Rate.Start()
 			}
 
-			c.BlackIpList = RemoveRepeatedElement(strings.Split(s.getEscapeString("blackiplist"), "\r\n"))
+			blackIpList := RemoveRepeatedElement(strings.Split(s.GetString("blackiplist"), "\r\n"))
+			if err := iplist.Check(blackIpList); err != nil {
+				s.AjaxErr(err.Error())
+			}
+			c.BlackIpList = blackIpList
 			file.GetDb().JsonDb.StoreClientsToJsonFile()
+			s.audit(audit.ActionUpdate, audit.ObjectClient, c.Id, before, audit.Capture(c))
 		}
 		s.AjaxOk("save success")
 	}
 }
 
+// userExist 客户端的 web 用户名不能与用户表中的用户重复
+func userExist(username string) bool {
+	_, err := file.GetDb().GetUserByName(username)
+	return err == nil
+}
+
 func RemoveRepeatedElement(arr []string) (newArr []string) {
 	newArr = make([]string, 0)
 	for i := 0; i < len(arr); i++ {
@@ -178,10 +200,12 @@ func RemoveRepeatedElement(arr []string) (newArr []string) {
 func (s *ClientController) ChangeStatus() {
 	id := s.GetIntNoErr("id")
 	if client, err := file.GetDb().GetClient(id); err == nil {
+		before := audit.Capture(client)
 		client.Status = s.GetBoolNoErr("status")
 		if client.Status == false {
 			server.DelClientConnect(client.Id)
 		}
+		s.audit(audit.ActionUpdate, audit.ObjectClient, id, before, audit.Capture(client))
 		s.AjaxOk("modified success")
 	}
 	s.AjaxErr("modified fail")
@@ -190,9 +214,14 @@ func (s *ClientController) ChangeStatus() {
 // 删除客户端
 func (s *ClientController) Del() {
 	id := s.GetIntNoErr("id")
+	var before map[string]interface{}
+	if c, err := file.GetDb().GetClient(id); err == nil {
+		before = audit.Capture(c)
+	}
 	if err := file.GetDb().DelClient(id); err != nil {
 		s.AjaxErr("delete error")
 	}
+	s.audit(audit.ActionDelete, audit.ObjectClient, id, before, nil)
 	server.DelTunnelAndHostByClientId(id, false)
 	server.DelClientConnect(id)
 	s.AjaxOk("delete success")
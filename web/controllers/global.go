@@ -1,9 +1,15 @@
 package controllers
 
 import (
+	"strconv"
 	"strings"
+	"time"
 
+	"ehang.io/nps/lib/audit"
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/iplist"
+	"github.com/astaxie/beego"
 )
 
 type GlobalController struct {
@@ -18,6 +24,7 @@ func (s *GlobalController) Index() {
 	s.Data["menu"] = "global"
 	s.SetInfo("global")
 	s.display("global/index")
+	s.Data["global_password_editable"] = s.user == nil || s.user.Can(file.PermGlobal, 0)
 
 	global := file.GetDb().GetGlobal()
 	if global == nil {
@@ -41,14 +48,236 @@ func (s *GlobalController) Save() {
 	} else {
 
 		t := &file.Glob{
-			BlackIpList:    RemoveRepeatedElement(strings.Split(s.getEscapeString("globalBlackIpList"), "\r\n")),
-			WhiteIpList:    RemoveRepeatedElement(strings.Split(s.getEscapeString("globalWhiteIpList"), "\r\n")),
+			BlackIpList:    RemoveRepeatedElement(strings.Split(s.GetString("globalBlackIpList"), "\r\n")),
+			WhiteIpList:    RemoveRepeatedElement(strings.Split(s.GetString("globalWhiteIpList"), "\r\n")),
 			GlobalPassword: s.GetString("globalPassword"),
 		}
+		if err := iplist.Check(t.BlackIpList); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if err := iplist.Check(t.WhiteIpList); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		global := file.GetDb().GetGlobal()
+		before := audit.Capture(global)
+		if global != nil {
+			t.AdminTotp = global.AdminTotp
+			// 只有黑白名单权限的用户不能修改全局密码
+			if s.user != nil && !s.user.Can(file.PermGlobal, 0) {
+				t.GlobalPassword = global.GlobalPassword
+			}
+		} else if s.user != nil && !s.user.Can(file.PermGlobal, 0) {
+			t.GlobalPassword = ""
+		}
 
 		if err := file.GetDb().SaveGlobal(t); err != nil {
 			s.AjaxErr(err.Error())
 		}
+		s.audit(audit.ActionUpdate, audit.ObjectGlobal, 0, before, audit.Capture(t))
 		s.AjaxOk("save success")
 	}
 }
+
+// Ban 正在封禁的 ip 列表
+func (s *GlobalController) Ban() {
+	list := ban.List()
+	s.AjaxTable(list, len(list), len(list), nil)
+}
+
+// Unban 解除 ip 的封禁
+func (s *GlobalController) Unban() {
+	b := ban.Unban(s.GetString("ip"))
+	if b == nil {
+		s.AjaxErr("the ip is not banned")
+	}
+	s.audit(audit.ActionDelete, audit.ObjectBan, 0, audit.Capture(b), nil)
+	s.AjaxOk("unban success")
+}
+
+// Token api 令牌管理，只有管理员可以访问
+func (s *GlobalController) Token() {
+	s.checkAdmin()
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "token"
+		s.Data["scopeResources"] = file.ApiScopeResources
+		s.SetInfo("api token")
+		s.display("global/token")
+		return
+	}
+	list := file.GetDb().GetApiTokens()
+	s.AjaxTable(list, len(list), len(list), nil)
+}
+
+// AddToken 创建令牌，明文令牌只在创建时返回一次
+func (s *GlobalController) AddToken() {
+	s.checkAdmin()
+	in := &apiTokenInput{Name: s.getEscapeString("name"), Scopes: s.GetStrings("scopes")}
+	if days := s.GetIntNoErr("expire_days"); days > 0 {
+		in.ExpireTime = time.Now().Add(time.Duration(days) * 24 * time.Hour).Unix()
+	}
+	for field, msg := range checkTokenInput(in) {
+		s.AjaxErr(field + ": " + msg)
+	}
+	t := &file.ApiToken{Name: in.Name, Scopes: in.Scopes, ExpireTime: in.ExpireTime}
+	token, err := file.GetDb().NewApiToken(t)
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.audit(audit.ActionCreate, audit.ObjectToken, t.Id, nil, audit.Capture(t))
+	s.Data["json"] = map[string]interface{}{"status": 1, "msg": "add success", "token": token}
+	s.ServeJSON()
+	s.StopRun()
+}
+
+func (s *GlobalController) DelToken() {
+	s.checkAdmin()
+	id := s.GetIntNoErr("id")
+	var before map[string]interface{}
+	if t, err := file.GetDb().GetApiTokenById(id); err == nil {
+		before = audit.Capture(t)
+	}
+	if err := file.GetDb().DelApiToken(id); err != nil {
+		s.AjaxErr("delete error")
+	}
+	s.audit(audit.ActionDelete, audit.ObjectToken, id, before, nil)
+	s.AjaxOk("delete success")
+}
+
+// User web 用户管理，只有管理员可以访问
+func (s *GlobalController) User() {
+	s.checkAdmin()
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "user"
+		s.SetInfo("user")
+		s.display("global/user")
+		return
+	}
+	users := file.GetDb().GetUsers()
+	list := make([]map[string]interface{}, 0, len(users))
+	for _, u := range users {
+		bindings := make([]string, len(u.Bindings))
+		for i, b := range u.Bindings {
+			bindings[i] = b.String()
+		}
+		list = append(list, map[string]interface{}{
+			"Id":         u.Id,
+			"Username":   u.Username,
+			"Status":     u.Status,
+			"Remark":     u.Remark,
+			"Bindings":   bindings,
+			"Totp":       u.Totp.Enabled(),
+			"CreateTime": u.CreateTime,
+		})
+	}
+	s.AjaxTable(list, len(list), len(list), nil)
+}
+
+// AddUser 添加或修改用户，id 为 0 时添加，修改时密码留空表示不修改
+func (s *GlobalController) AddUser() {
+	s.checkAdmin()
+	id := s.GetIntNoErr("id")
+	username := s.getEscapeString("username")
+	password := s.GetString("password")
+	bindings, err := file.ParseRoleBindings(s.GetString("bindings"))
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	if username == "" || username == beego.AppConfig.String("web_username") || !file.GetDb().VerifyUserName(username, 0) {
+		s.AjaxErr("web login username duplicate, please reset")
+	}
+	u := &file.User{Id: id}
+	var before map[string]interface{}
+	if id != 0 {
+		old, err := file.GetDb().GetUserById(id)
+		if err != nil {
+			s.AjaxErr(err.Error())
+		}
+		*u = *old
+		before = audit.Capture(old)
+	} else if password == "" {
+		s.AjaxErr("password is required")
+	}
+	u.Username = username
+	u.Status = s.GetBoolNoErr("status")
+	u.Remark = s.getEscapeString("remark")
+	u.Bindings = bindings
+	// 用户丢失身份验证器和恢复码时由管理员重置
+	if s.GetBoolNoErr("reset_totp") {
+		u.Totp = nil
+	}
+	if password != "" {
+		if err := u.SetPassword(password); err != nil {
+			s.AjaxErr(err.Error())
+		}
+	}
+	action := audit.ActionUpdate
+	if id == 0 {
+		err = file.GetDb().NewUser(u)
+		action = audit.ActionCreate
+	} else {
+		err = file.GetDb().UpdateUser(u)
+	}
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.audit(action, audit.ObjectUser, u.Id, before, audit.Capture(u))
+	s.AjaxOkWithId("save success", u.Id)
+}
+
+func (s *GlobalController) DelUser() {
+	s.checkAdmin()
+	id := s.GetIntNoErr("id")
+	var before map[string]interface{}
+	if u, err := file.GetDb().GetUserById(id); err == nil {
+		before = audit.Capture(u)
+	}
+	if err := file.GetDb().DelUser(id); err != nil {
+		s.AjaxErr("delete error")
+	}
+	s.audit(audit.ActionDelete, audit.ObjectUser, id, before, nil)
+	s.AjaxOk("delete success")
+}
+
+// Audit 配置修改的审计日志，管理员和绑定所有客户端的 admin 角色可以访问
+func (s *GlobalController) Audit() {
+	if s.user == nil {
+		s.checkAdmin()
+	}
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "audit"
+		s.SetInfo("audit log")
+		s.display("global/audit")
+		return
+	}
+	q, f := auditQuery(&s.Controller)
+	for field, msg := range f {
+		s.AjaxErr(field + ": " + msg)
+	}
+	start, length := s.GetAjaxParams()
+	list, total, err := audit.Search(q, start, length)
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.AjaxTable(list, total, total, nil)
+}
+
+// AuditVerify 检查审计日志是否被修改
+func (s *GlobalController) AuditVerify() {
+	if s.user == nil {
+		s.checkAdmin()
+	}
+	seq, err := audit.Verify()
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	if seq != 0 {
+		s.AjaxErr("the audit log has been modified from seq " + strconv.FormatInt(seq, 10))
+	}
+	s.AjaxOk("the audit log is intact")
+}
+
+func (s *GlobalController) checkAdmin() {
+	if isAdmin, ok := s.GetSession("isAdmin").(bool); !ok || !isAdmin {
+		s.StopRun()
+	}
+}
@@ -1,9 +1,13 @@
 package controllers
 
 import (
+	"strings"
+
+	"ehang.io/nps/lib/audit"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/file"
 	"ehang.io/nps/server"
+	"ehang.io/nps/server/proxy"
 	"ehang.io/nps/server/tool"
 	"github.com/astaxie/beego/logs"
 
@@ -15,7 +19,7 @@ type IndexController struct {
 }
 
 // getClientOrCreateLocalhost 获取客户端或创建本机客户端
-func (s *IndexController) getClientOrCreateLocalhost(clientId int) (*file.Client, error) {
+func getClientOrCreateLocalhost(clientId int) (*file.Client, error) {
 	if clientId == common.LOCALHOST_CLIENT_ID {
 		// 创建虚拟的本机客户端
 		localClient := &file.Client{
@@ -113,8 +117,14 @@ func (s *IndexController) GetTunnel() {
 	start, length := s.GetAjaxParams()
 	taskType := s.getEscapeString("type")
 	clientId := s.GetIntNoErr("client_id")
-	list, cnt := server.GetTunnel(start, length, taskType, clientId, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"))
-	s.AjaxTable(list, cnt, cnt, nil)
+	list, cnt := server.GetTunnel(start, length, taskType, clientId, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"), s.allowClient())
+	ejected := make(map[int][]*file.Ejection)
+	for _, v := range list {
+		if e := v.Target.Ejections(); len(e) > 0 {
+			ejected[v.Id] = e
+		}
+	}
+	s.AjaxTable(list, cnt, cnt, map[string]interface{}{"ejected": ejected})
 }
 
 func (s *IndexController) Add() {
@@ -137,7 +147,7 @@ func (s *IndexController) Add() {
 			Port:                 s.GetIntNoErr("port"),
 			ServerIp:             s.getEscapeString("server_ip"),
 			Mode:                 s.getEscapeString("type"),
-			Target:               &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: localProxy},
+			Target:               &file.Target{TargetStr: s.getEscapeString("target"), Balance: s.getEscapeString("balance"), LocalProxy: localProxy},
 			Id:                   id,
 			Status:               true,
 			Remark:               s.getEscapeString("remark"),
@@ -147,16 +157,20 @@ func (s *IndexController) Add() {
 			Flow:                 &file.Flow{},
 			BypassGlobalPassword: s.GetBoolNoErr("bypass_global_password"),
 		}
+		t.AllowIpList, t.DenyIpList = s.getAcl()
 
 		if t.Port <= 0 {
 			t.Port = tool.GenerateServerPort(t.Mode)
 		}
+		if err := t.Target.Check(); err != nil {
+			s.AjaxErr(err.Error())
+		}
 
 		if !tool.TestServerPort(t.Port, t.Mode) {
 			s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
 		}
 		var err error
-		if t.Client, err = s.getClientOrCreateLocalhost(clientId); err != nil {
+		if t.Client, err = getClientOrCreateLocalhost(clientId); err != nil {
 			s.AjaxErr(err.Error())
 		}
 		if t.Client.MaxTunnelNum != 0 && t.Client.GetTunnelNum() >= t.Client.MaxTunnelNum {
@@ -165,6 +179,7 @@ func (s *IndexController) Add() {
 		if err := file.GetDb().NewTask(t); err != nil {
 			s.AjaxErr(err.Error())
 		}
+		s.audit(audit.ActionCreate, audit.ObjectTunnel, t.Id, nil, audit.Capture(t))
 		if err := server.AddTask(t); err != nil {
 			s.AjaxErr(err.Error())
 		} else {
@@ -193,6 +208,8 @@ func (s *IndexController) Edit() {
 			s.error()
 		} else {
 			s.Data["t"] = t
+			s.Data["allow_ip_list"] = strings.Join(t.AllowIpList, "\n")
+			s.Data["deny_ip_list"] = strings.Join(t.DenyIpList, "\n")
 		}
 		s.SetInfo("edit tunnel")
 		s.display()
@@ -200,8 +217,9 @@ func (s *IndexController) Edit() {
 		if t, err := file.GetDb().GetTask(id); err != nil {
 			s.error()
 		} else {
+			before := audit.Capture(t)
 			clientId := s.GetIntNoErr("client_id")
-			if client, err := s.getClientOrCreateLocalhost(clientId); err != nil {
+			if client, err := getClientOrCreateLocalhost(clientId); err != nil {
 				s.AjaxErr("modified error,the client is not exist")
 				return
 			} else {
@@ -221,7 +239,10 @@ func (s *IndexController) Edit() {
 			}
 			t.ServerIp = s.getEscapeString("server_ip")
 			t.Mode = s.getEscapeString("type")
-			t.Target = &file.Target{TargetStr: s.getEscapeString("target")}
+			t.Target = &file.Target{TargetStr: s.getEscapeString("target"), Balance: s.getEscapeString("balance")}
+			if err := t.Target.Check(); err != nil {
+				s.AjaxErr(err.Error())
+			}
 			t.Password = s.getEscapeString("password")
 			t.Id = id
 			t.LocalPath = s.getEscapeString("local_path")
@@ -235,7 +256,9 @@ func (s *IndexController) Edit() {
 			}
 			t.Target.LocalProxy = localProxy
 			t.BypassGlobalPassword = s.GetBoolNoErr("bypass_global_password")
+			t.AllowIpList, t.DenyIpList = s.getAcl()
 			file.GetDb().UpdateTask(t)
+			s.audit(audit.ActionUpdate, audit.ObjectTunnel, t.Id, before, audit.Capture(t))
 			server.StopServer(t.Id)
 			server.StartTask(t.Id)
 		}
@@ -248,14 +271,20 @@ func (s *IndexController) Stop() {
 	if err := server.StopServer(id); err != nil {
 		s.AjaxErr("stop error")
 	}
+	s.audit(audit.ActionStop, audit.ObjectTunnel, id, nil, nil)
 	s.AjaxOk("stop success")
 }
 
 func (s *IndexController) Del() {
 	id := s.GetIntNoErr("id")
+	var before map[string]interface{}
+	if t, err := file.GetDb().GetTask(id); err == nil {
+		before = audit.Capture(t)
+	}
 	if err := server.DelTask(id); err != nil {
 		s.AjaxErr("delete error")
 	}
+	s.audit(audit.ActionDelete, audit.ObjectTunnel, id, before, nil)
 	s.AjaxOk("delete success")
 }
 
@@ -264,6 +293,7 @@ func (s *IndexController) Start() {
 	if err := server.StartTask(id); err != nil {
 		s.AjaxErr("start error")
 	}
+	s.audit(audit.ActionStart, audit.ObjectTunnel, id, nil, nil)
 	s.AjaxOk("start success")
 }
 
@@ -276,8 +306,14 @@ func (s *IndexController) HostList() {
 	} else {
 		start, length := s.GetAjaxParams()
 		clientId := s.GetIntNoErr("client_id")
-		list, cnt := file.GetDb().GetHost(start, length, clientId, s.getEscapeString("search"))
-		s.AjaxTable(list, cnt, cnt, nil)
+		list, cnt := file.GetDb().GetHost(start, length, clientId, s.getEscapeString("search"), s.allowClient())
+		ejected := make(map[int][]*file.Ejection)
+		for _, v := range list {
+			if e := v.Target.Ejections(); len(e) > 0 {
+				ejected[v.Id] = e
+			}
+		}
+		s.AjaxTable(list, cnt, cnt, map[string]interface{}{"ejected": ejected})
 	}
 }
 
@@ -297,9 +333,15 @@ func (s *IndexController) GetHost() {
 
 func (s *IndexController) DelHost() {
 	id := s.GetIntNoErr("id")
+	var before map[string]interface{}
+	if h, err := file.GetDb().GetHostById(id); err == nil {
+		before = audit.Capture(h)
+	}
 	if err := file.GetDb().DelHost(id); err != nil {
 		s.AjaxErr("delete error")
 	}
+	s.audit(audit.ActionDelete, audit.ObjectHost, id, before, nil)
+	proxy.InvalidateCert(id)
 	s.AjaxOk("delete success")
 }
 
@@ -322,8 +364,11 @@ func (s *IndexController) AddHost() {
 		h := &file.Host{
 			Id:                   id,
 			Host:                 s.getEscapeString("host"),
-			Target:               &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: localProxy},
+			Target:               &file.Target{TargetStr: s.getEscapeString("target"), Balance: s.getEscapeString("balance"), LocalProxy: localProxy},
 			HeaderChange:         s.getEscapeString("header"),
+			Routes:               s.GetString("routes"),
+			HeaderRules:          s.GetString("header_rules"),
+			TargetProto:          s.getEscapeString("target_proto"),
 			HostChange:           s.getEscapeString("hostchange"),
 			Remark:               s.getEscapeString("remark"),
 			Location:             s.getEscapeString("location"),
@@ -332,10 +377,30 @@ func (s *IndexController) AddHost() {
 			KeyFilePath:          s.getEscapeString("key_file_path"),
 			CertFilePath:         s.getEscapeString("cert_file_path"),
 			AutoHttps:            s.GetBoolNoErr("AutoHttps"),
+			AutoCert:             s.GetBoolNoErr("auto_cert"),
 			BypassGlobalPassword: s.GetBoolNoErr("bypass_global_password"),
 		}
+		h.AllowIpList, h.DenyIpList = s.getAcl()
+		if err := h.Target.Check(); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if _, err := file.ParseRoutes(h.Routes, h.Target); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if _, err := file.ParseHeaderRules(h.HeaderRules); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if err := file.CheckTargetProto(h.TargetProto); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if err := proxy.CheckAutoCert(h); err != nil {
+			s.AjaxErr(err.Error())
+		}
+		if h.AutoCert {
+			h.CertStatus = proxy.CertPending
+		}
 		var err error
-		if h.Client, err = s.getClientOrCreateLocalhost(clientId); err != nil {
+		if h.Client, err = getClientOrCreateLocalhost(clientId); err != nil {
 			s.AjaxErr("add error the client can not be found")
 		}
 		if h.Client.MaxTunnelNum != 0 && h.Client.GetTunnelNum() >= h.Client.MaxTunnelNum {
@@ -345,6 +410,8 @@ func (s *IndexController) AddHost() {
 		if err := file.GetDb().NewHost(h); err != nil {
 			s.AjaxErr("add fail" + err.Error())
 		}
+		s.audit(audit.ActionCreate, audit.ObjectHost, h.Id, nil, audit.Capture(h))
+		proxy.RequestCert(h)
 		s.AjaxOkWithId("add success", id)
 	}
 }
@@ -357,6 +424,8 @@ func (s *IndexController) EditHost() {
 			s.error()
 		} else {
 			s.Data["h"] = h
+			s.Data["allow_ip_list"] = strings.Join(h.AllowIpList, "\n")
+			s.Data["deny_ip_list"] = strings.Join(h.DenyIpList, "\n")
 		}
 		s.SetInfo("edit")
 		s.display("index/hedit")
@@ -364,6 +433,7 @@ func (s *IndexController) EditHost() {
 		if h, err := file.GetDb().GetHostById(id); err != nil {
 			s.error()
 		} else {
+			before := audit.Capture(h)
 			if h.Host != s.getEscapeString("host") {
 				tmpHost := new(file.Host)
 				tmpHost.Host = s.getEscapeString("host")
@@ -374,14 +444,29 @@ func (s *IndexController) EditHost() {
 					return
 				}
 			}
-			if client, err := s.getClientOrCreateLocalhost(s.GetIntNoErr("client_id")); err != nil {
+			if client, err := getClientOrCreateLocalhost(s.GetIntNoErr("client_id")); err != nil {
 				s.AjaxErr("modified error,the client is not exist")
 			} else {
 				h.Client = client
 			}
 			h.Host = s.getEscapeString("host")
-			h.Target = &file.Target{TargetStr: s.getEscapeString("target")}
+			h.Target = &file.Target{TargetStr: s.getEscapeString("target"), Balance: s.getEscapeString("balance")}
+			if err := h.Target.Check(); err != nil {
+				s.AjaxErr(err.Error())
+			}
 			h.HeaderChange = s.getEscapeString("header")
+			if _, err := file.ParseRoutes(s.GetString("routes"), h.Target); err != nil {
+				s.AjaxErr(err.Error())
+			}
+			h.Routes = s.GetString("routes")
+			if _, err := file.ParseHeaderRules(s.GetString("header_rules")); err != nil {
+				s.AjaxErr(err.Error())
+			}
+			h.HeaderRules = s.GetString("header_rules")
+			if err := file.CheckTargetProto(s.getEscapeString("target_proto")); err != nil {
+				s.AjaxErr(err.Error())
+			}
+			h.TargetProto = s.getEscapeString("target_proto")
 			h.HostChange = s.getEscapeString("hostchange")
 			h.Remark = s.getEscapeString("remark")
 			h.Location = s.getEscapeString("location")
@@ -397,8 +482,20 @@ func (s *IndexController) EditHost() {
 			}
 			h.Target.LocalProxy = localProxy
 			h.AutoHttps = s.GetBoolNoErr("AutoHttps")
+			autoCert := s.GetBoolNoErr("auto_cert")
+			if autoCert && !h.AutoCert {
+				h.CertStatus = proxy.CertPending
+			}
+			h.AutoCert = autoCert
+			if err := proxy.CheckAutoCert(h); err != nil {
+				s.AjaxErr(err.Error())
+			}
 			h.BypassGlobalPassword = s.GetBoolNoErr("bypass_global_password")
+			h.AllowIpList, h.DenyIpList = s.getAcl()
 			file.GetDb().JsonDb.StoreHostToJsonFile()
+			s.audit(audit.ActionUpdate, audit.ObjectHost, h.Id, before, audit.Capture(h))
+			proxy.InvalidateCert(h.Id)
+			proxy.RequestCert(h)
 		}
 		s.AjaxOk("modified success")
 	}
@@ -413,12 +510,14 @@ func (s *IndexController) ToggleBypassStatus() {
 		s.AjaxErr("任务不存在")
 		return
 	} else {
+		before := audit.Capture(t)
 		t.BypassGlobalPassword = newStatus
 		if err := file.GetDb().UpdateTask(t); err != nil {
 			logs.Error("ToggleBypassStatus failed: Error updating task %d, error: %v", id, err)
 			s.AjaxErr("更新失败: " + err.Error())
 			return
 		}
+		s.audit(audit.ActionUpdate, audit.ObjectTunnel, id, before, audit.Capture(t))
 		logs.Info("Tunnel %d BypassGlobalPassword status updated to %v", id, newStatus)
 		s.AjaxOk("更新成功")
 	}
@@ -434,10 +533,31 @@ func (s *IndexController) ToggleHostBypassStatus() {
 		s.AjaxErr("域名记录不存在")
 		return
 	} else {
+		before := audit.Capture(h)
 		h.BypassGlobalPassword = newStatus
 		// 保存对 Host 记录的更改
 		file.GetDb().JsonDb.StoreHostToJsonFile() // 确保更改被持久化
+		s.audit(audit.ActionUpdate, audit.ObjectHost, id, before, audit.Capture(h))
 		logs.Info("Host %d BypassGlobalPassword status updated to %v", id, newStatus)
 		s.AjaxOk("更新成功")
 	}
 }
+
+// getAcl 读取表单中隧道和域名的访问控制列表，格式错误时直接返回错误。
+// 列表保存原文，注释中的特殊字符在页面显示时转义
+func (s *IndexController) getAcl() (allow, deny []string) {
+	split := func(key string) []string {
+		var list []string
+		for _, line := range strings.Split(s.GetString(key), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				list = append(list, line)
+			}
+		}
+		return RemoveRepeatedElement(list)
+	}
+	allow, deny = split("allow_ip_list"), split("deny_ip_list")
+	if err := file.CheckAcl(allow, deny); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	return
+}
@@ -9,10 +9,12 @@ import (
 	"github.com/astaxie/beego/cache"
 	"github.com/astaxie/beego/utils/captcha"
 
+	"ehang.io/nps/lib/ban"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/file"
 	"ehang.io/nps/server"
 	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
 )
 
 type LoginController struct {
@@ -36,7 +38,7 @@ func init() {
 func (self *LoginController) Meteor() {
 	// Try login implicitly, will succeed if it's configured as no-auth(empty username&password).
 	webBaseUrl := beego.AppConfig.String("web_base_url")
-	if self.doLogin("", "", false) {
+	if auth, _ := self.doLogin("", "", false); auth {
 		self.Redirect(webBaseUrl+"/index/index", 302)
 	}
 	self.Data["web_base_url"] = webBaseUrl
@@ -53,76 +55,186 @@ func (self *LoginController) Verify() {
 		if !cpt.VerifyReq(self.Ctx.Request) {
 			self.Data["json"] = map[string]interface{}{"status": 0, "msg": "the verification code is wrong, please get it again and try again"}
 			self.ServeJSON()
+			return
 		}
 	}
-	if self.doLogin(username, password, true) {
+	if auth, totp := self.doLogin(username, password, true); auth {
 		self.Data["json"] = map[string]interface{}{"status": 1, "msg": "login success"}
+	} else if totp {
+		self.Data["json"] = map[string]interface{}{"status": 2, "msg": "two-factor code required"}
 	} else {
 		self.Data["json"] = map[string]interface{}{"status": 0, "msg": "username or password incorrect"}
 	}
 	self.ServeJSON()
 }
 
-func (self *LoginController) doLogin(username, password string, explicit bool) bool {
-	clearIprecord()
+// Totp 密码验证通过后验证两步验证码，也可以使用恢复码
+func (self *LoginController) Totp() {
 	ip, _, _ := net.SplitHostPort(self.Ctx.Request.RemoteAddr)
-	if v, ok := ipRecord.Load(ip); ok {
-		vv := v.(*record)
-		if (time.Now().Unix() - vv.lastLoginTime.Unix()) >= 60 {
-			vv.hasLoginFailTimes = 0
-		}
-		if vv.hasLoginFailTimes >= 10 {
-			return false
+	id, ok := self.GetSession("totpUserId").(int)
+	since, _ := self.GetSession("totpTime").(int64)
+	if !ok || time.Now().Unix()-since > 300 {
+		self.Data["json"] = map[string]interface{}{"status": 0, "msg": "login timeout, please login again"}
+		self.ServeJSON()
+		return
+	}
+	auth := false
+	if !loginBlocked(ip) {
+		code := self.GetString("code")
+		if client, _ := self.GetSession("totpClient").(bool); client {
+			if c, err := file.GetDb().GetClient(id); err == nil && c.Status && !c.NoDisplay && file.GetDb().VerifyTotp(c.Totp, code) {
+				self.loginClient(c)
+				auth = true
+			}
+		} else if id == 0 {
+			if g := file.GetDb().GetGlobal(); g != nil && file.GetDb().VerifyTotp(g.AdminTotp, code) {
+				self.loginAdmin()
+				auth = true
+			}
+		} else if u, err := file.GetDb().GetUserById(id); err == nil && u.Status && file.GetDb().VerifyTotp(u.Totp, code) {
+			self.loginUser(u)
+			auth = true
 		}
 	}
-	var auth bool
+	if auth {
+		self.DelSession("totpUserId")
+		self.DelSession("totpTime")
+		self.DelSession("totpClient")
+		self.SetSession("auth", true)
+		ipRecord.Delete(ip)
+		self.Data["json"] = map[string]interface{}{"status": 1, "msg": "login success"}
+	} else {
+		loginFailed(ip)
+		self.Data["json"] = map[string]interface{}{"status": 0, "msg": "two-factor code incorrect"}
+	}
+	self.ServeJSON()
+}
+
+// doLogin 验证用户名密码，开启了两步验证时 totp 为 true，需要再调用 Totp 完成登录
+func (self *LoginController) doLogin(username, password string, explicit bool) (auth, totp bool) {
+	clearIprecord()
+	ip, _, _ := net.SplitHostPort(self.Ctx.Request.RemoteAddr)
+	if loginBlocked(ip) {
+		return false, false
+	}
 	if password == beego.AppConfig.String("web_password") && username == beego.AppConfig.String("web_username") {
-		self.SetSession("isAdmin", true)
-		self.DelSession("clientId")
-		self.DelSession("username")
+		if g := file.GetDb().GetGlobal(); g != nil && g.AdminTotp.Enabled() {
+			// 管理员丢失身份验证器和恢复码时可以在 nps.conf 中临时跳过
+			if beego.AppConfig.DefaultBool("web_admin_totp_bypass", false) {
+				logs.Warn("two-factor authentication of admin is bypassed by web_admin_totp_bypass")
+			} else {
+				self.totpPending(0, false)
+				return false, true
+			}
+		}
+		self.loginAdmin()
 		auth = true
-		server.Bridge.Register.Store(common.GetIpByAddr(self.Ctx.Input.IP()), time.Now().Add(time.Hour*time.Duration(2)))
+	}
+	if !auth && username != "" {
+		if u, err := file.GetDb().GetUserByName(username); err == nil && u.Status && u.CheckPassword(password) {
+			if u.Totp.Enabled() {
+				self.totpPending(u.Id, false)
+				return false, true
+			}
+			self.loginUser(u)
+			auth = true
+		}
 	}
 	b, err := beego.AppConfig.Bool("allow_user_login")
 	if err == nil && b && !auth {
+		var client *file.Client
 		file.GetDb().JsonDb.Clients.Range(func(key, value interface{}) bool {
 			v := value.(*file.Client)
 			if !v.Status || v.NoDisplay {
 				return true
 			}
 			if v.WebUserName == "" && v.WebPassword == "" {
-				if username != "user" || v.VerifyKey != password {
-					return true
-				} else {
-					auth = true
+				if username == "user" && v.VerifyKey == password {
+					client = v
 				}
+			} else if v.WebPassword == password && v.WebUserName == username {
+				client = v
 			}
-			if !auth && v.WebPassword == password && v.WebUserName == username {
-				auth = true
-			}
-			if auth {
-				self.SetSession("isAdmin", false)
-				self.SetSession("clientId", v.Id)
-				self.SetSession("username", v.WebUserName)
-				return false
-			}
-			return true
+			return client == nil
 		})
+		if client != nil {
+			// 客户端的 web 账号和 user + 密钥登录同样需要两步验证
+			if client.Totp.Enabled() {
+				self.totpPending(client.Id, true)
+				return false, true
+			}
+			self.loginClient(client)
+			auth = true
+		}
 	}
 	if auth {
 		self.SetSession("auth", true)
 		ipRecord.Delete(ip)
-		return true
+		return true, false
+
+	}
+	if explicit {
+		loginFailed(ip)
+	} else {
+		ipRecord.LoadOrStore(ip, &record{hasLoginFailTimes: 1, lastLoginTime: time.Now()})
+	}
+	return false, false
+}
+
+func (self *LoginController) loginAdmin() {
+	self.SetSession("isAdmin", true)
+	self.DelSession("clientId")
+	self.DelSession("username")
+	self.DelSession("userId")
+	server.Bridge.Register.Store(common.GetIpByAddr(self.Ctx.Input.IP()), time.Now().Add(time.Hour*time.Duration(2)))
+}
+
+func (self *LoginController) loginClient(c *file.Client) {
+	self.SetSession("isAdmin", false)
+	self.SetSession("clientId", c.Id)
+	self.DelSession("userId")
+	self.SetSession("username", c.WebUserName)
+}
+
+func (self *LoginController) loginUser(u *file.User) {
+	self.SetSession("isAdmin", false)
+	self.SetSession("userId", u.Id)
+	self.SetSession("username", u.Username)
+	self.DelSession("clientId")
+}
 
+// totpPending 记录密码验证通过的用户，id 为 0 表示管理员，client 为 true 时 id 是客户端的 id
+func (self *LoginController) totpPending(id int, client bool) {
+	self.SetSession("auth", false)
+	self.SetSession("totpUserId", id)
+	self.SetSession("totpClient", client)
+	self.SetSession("totpTime", time.Now().Unix())
+}
+
+// loginBlocked 一分钟内失败 10 次后拒绝登录
+func loginBlocked(ip string) bool {
+	if v, ok := ipRecord.Load(ip); ok {
+		vv := v.(*record)
+		if (time.Now().Unix() - vv.lastLoginTime.Unix()) >= 60 {
+			vv.hasLoginFailTimes = 0
+		}
+		if vv.hasLoginFailTimes >= 10 {
+			return true
+		}
 	}
-	if v, load := ipRecord.LoadOrStore(ip, &record{hasLoginFailTimes: 1, lastLoginTime: time.Now()}); load && explicit {
+	return false
+}
+
+func loginFailed(ip string) {
+	ban.Fail(ip, ban.ReasonLogin)
+	if v, load := ipRecord.LoadOrStore(ip, &record{hasLoginFailTimes: 1, lastLoginTime: time.Now()}); load {
 		vv := v.(*record)
 		vv.lastLoginTime = time.Now()
 		vv.hasLoginFailTimes += 1
 		ipRecord.Store(ip, vv)
 	}
-	return false
 }
+
 func (self *LoginController) Register() {
 	if self.Ctx.Request.Method == "GET" {
 		self.Data["web_base_url"] = beego.AppConfig.String("web_base_url")
@@ -133,7 +245,7 @@ func (self *LoginController) Register() {
 			self.ServeJSON()
 			return
 		}
-		if self.GetString("username") == "" || self.GetString("password") == "" || self.GetString("username") == beego.AppConfig.String("web_username") {
+		if self.GetString("username") == "" || self.GetString("password") == "" || self.GetString("username") == beego.AppConfig.String("web_username") || userExist(self.GetString("username")) {
 			self.Data["json"] = map[string]interface{}{"status": 0, "msg": "please check your input"}
 			self.ServeJSON()
 			return
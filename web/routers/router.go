@@ -1,6 +1,9 @@
 package routers
 
 import (
+	"net/http"
+
+	"ehang.io/nps/server"
 	"ehang.io/nps/web/controllers"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/context"
@@ -8,6 +11,11 @@ import (
 
 func Init() {
 	web_base_url := beego.AppConfig.String("web_base_url")
+	// 没有单独配置 metrics_port 时在 web 管理端口上提供 /metrics，不经过登录验证
+	if beego.AppConfig.DefaultBool("metrics_enable", false) && beego.AppConfig.DefaultInt("metrics_port", 0) == 0 {
+		beego.Handler(web_base_url+"/metrics", http.HandlerFunc(server.MetricsHandler))
+	}
+	initApi(web_base_url + "/api/v1")
 	if len(web_base_url) > 0 {
 		ns := beego.NewNamespace(web_base_url,
 			beego.NSRouter("/", &controllers.IndexController{}, "*:Root"),
@@ -16,9 +24,11 @@ func Init() {
 			beego.NSRouter("/login/verify", &controllers.LoginController{}, "*:Verify"),
 			beego.NSRouter("/login/register", &controllers.LoginController{}, "*:Register"),
 			beego.NSRouter("/login/out", &controllers.LoginController{}, "*:Out"),
+			beego.NSRouter("/login/totp", &controllers.LoginController{}, "post:Totp"),
 			beego.NSAutoRouter(&controllers.ClientController{}),
 			beego.NSAutoRouter(&controllers.AuthController{}),
 			beego.NSAutoRouter(&controllers.GlobalController{}),
+			beego.NSAutoRouter(&controllers.AccountController{}),
 			beego.NSCond(func(ctx *context.Context) bool {
 				return ctx.Input.Query("token") != ""
 			}),
@@ -31,9 +41,11 @@ func Init() {
 		beego.Router("/login/verify", &controllers.LoginController{}, "*:Verify")
 		beego.Router("/login/register", &controllers.LoginController{}, "*:Register")
 		beego.Router("/login/out", &controllers.LoginController{}, "*:Out")
+		beego.Router("/login/totp", &controllers.LoginController{}, "post:Totp")
 		beego.AutoRouter(&controllers.ClientController{})
 		beego.AutoRouter(&controllers.AuthController{})
 		beego.AutoRouter(&controllers.GlobalController{})
+		beego.AutoRouter(&controllers.AccountController{})
 
 		beego.Router("/index/togglebypass", &controllers.IndexController{}, "post:ToggleBypassStatus")         // 添加新路由
 		beego.Router("/index/togglehostbypass", &controllers.IndexController{}, "post:ToggleHostBypassStatus") // 添加新路由
@@ -44,3 +56,24 @@ func Init() {
 
 	}
 }
+
+// initApi 注册 /api/v1 接口，接口使用令牌验证，与 web 管理页面的登录无关
+func initApi(prefix string) {
+	api := &controllers.ApiController{}
+	beego.Router(prefix+"/openapi.json", api, "get:OpenApi")
+	beego.Router(prefix+"/clients", api, "get:ListClients;post:CreateClient")
+	beego.Router(prefix+"/clients/:id:int", api, "get:GetClient;put:UpdateClient;delete:DeleteClient")
+	beego.Router(prefix+"/tunnels", api, "get:ListTunnels;post:CreateTunnel")
+	beego.Router(prefix+"/tunnels/:id:int", api, "get:GetTunnel;put:UpdateTunnel;delete:DeleteTunnel")
+	beego.Router(prefix+"/tunnels/:id:int/start", api, "post:StartTunnel")
+	beego.Router(prefix+"/tunnels/:id:int/stop", api, "post:StopTunnel")
+	beego.Router(prefix+"/hosts", api, "get:ListHosts;post:CreateHost")
+	beego.Router(prefix+"/hosts/:id:int", api, "get:GetHost;put:UpdateHost;delete:DeleteHost")
+	beego.Router(prefix+"/global", api, "get:GetGlobal;put:UpdateGlobal")
+	beego.Router(prefix+"/tokens", api, "get:ListTokens;post:CreateToken")
+	beego.Router(prefix+"/tokens/:id:int", api, "delete:DeleteToken")
+	beego.Router(prefix+"/bans", api, "get:ListBans")
+	beego.Router(prefix+"/bans/:ip", api, "delete:DeleteBan")
+	beego.Router(prefix+"/audit", api, "get:ListAudit")
+	beego.Router(prefix+"/audit/verify", api, "get:VerifyAudit")
+}